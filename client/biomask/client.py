@@ -169,14 +169,22 @@ class BiomaskClient:
             device_public_key = f.read()
         pub_key_hash = hashlib.sha256(device_public_key.encode()).hexdigest()
         signature = self.signer.sign_string(p)
-        await self.__chaincode_invoke("StoreHelperData", p, pub_key_hash, signature, user_nickname)
+        version = await self.__helper_data_version(user_nickname)
+        await self.__chaincode_invoke("StoreHelperData", p, pub_key_hash, signature, user_nickname, str(version))
         return r
+
+    async def __helper_data_version(self, user_nickname: str) -> int:
+        try:
+            record = json.loads(await self.__chaincode_query("GetHelperData", user_nickname))
+        except Exception:
+            return 0
+        return record["version"]
     
     async def restore_key(
         self,
         image_path: str,
         user_nickname: str,
     ) -> str:
-        p = await self.__chaincode_query("GetHelperData", user_nickname)
-        r = fuzzy_recover(image_path, p)
+        record = json.loads(await self.__chaincode_query("GetHelperData", user_nickname))
+        r = fuzzy_recover(image_path, record["data"])
         return r
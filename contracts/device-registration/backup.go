@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// backupObjectTypes are the record types ExportAll streams, in the order it streams them
+var backupObjectTypes = []string{"PhotoVote", "Photo", "DeviceKey", "HelperData"}
+
+// BackupRecord is one world state record of an ExportAll stream; exactly one payload field is set,
+// matching Type
+type BackupRecord struct {
+	Type       string            `json:"type"` // Object type of the record: "PhotoVote", "Photo", "DeviceKey" or "HelperData"
+	Key        []string          `json:"key"`  // Composite key attributes of the record
+	Vote       *PhotoVote        `json:"vote,omitempty" metadata:",optional"`
+	Photo      *IPFSPhoto        `json:"photo,omitempty" metadata:",optional"`
+	DeviceKey  *DeviceKey        `json:"deviceKey,omitempty" metadata:",optional"`
+	HelperData *HelperDataRecord `json:"helperData,omitempty" metadata:",optional"`
+}
+
+// BackupPage is one page of an ExportAll stream with the bookmark that continues it
+type BackupPage struct {
+	Records  []BackupRecord `json:"records"`
+	Bookmark string         `json:"bookmark"` // Pass to the next call to continue, empty once the stream is complete
+}
+
+// newBackupRecord decodes a world state value into a record of its object type
+func newBackupRecord(objectType string, key []string, value []byte) (BackupRecord, error) {
+	record := BackupRecord{Type: objectType, Key: key}
+
+	var err error
+	switch objectType {
+	case "PhotoVote":
+		record.Vote = new(PhotoVote)
+		err = json.Unmarshal(value, record.Vote)
+	case "Photo":
+		record.Photo = new(IPFSPhoto)
+		err = json.Unmarshal(value, record.Photo)
+	case "DeviceKey":
+		record.DeviceKey = new(DeviceKey)
+		err = json.Unmarshal(value, record.DeviceKey)
+	case "HelperData":
+		record.HelperData = new(HelperDataRecord)
+		err = json.Unmarshal(value, record.HelperData)
+	}
+	if err != nil {
+		return BackupRecord{}, fmt.Errorf("failed to unmarshal %s record %v: %v", objectType, key, err)
+	}
+
+	return record, nil
+}
+
+// ExportAll returns up to pageSize records of one ordered stream over votes, photos, device keys and
+// helper data, each type in key order, for backups (admin only). The bookmark names the type being
+// read and the position within it, so a page may end in one type and the next continue in another.
+func (dr *DeviceRegistration) ExportAll(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*BackupPage, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive")
+	}
+
+	typeIndex := 0
+	innerBookmark := ""
+	if bookmark != "" {
+		objectType, position, found := strings.Cut(bookmark, ":")
+		typeIndex = slices.Index(backupObjectTypes, objectType)
+		if !found || typeIndex < 0 {
+			return nil, fmt.Errorf("invalid export bookmark %q", bookmark)
+		}
+		innerBookmark = position
+	}
+
+	page := &BackupPage{
+		Records: make([]BackupRecord, 0, pageSize),
+	}
+	for ; typeIndex < len(backupObjectTypes); typeIndex++ {
+		objectType := backupObjectTypes[typeIndex]
+		remaining := pageSize - int32(len(page.Records))
+
+		iterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(objectType, []string{}, remaining, innerBookmark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s records: %v", objectType, err)
+		}
+
+		for iterator.HasNext() {
+			entry, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return nil, fmt.Errorf("failed to iterate %s records: %v", objectType, err)
+			}
+
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+			if err != nil {
+				iterator.Close()
+				return nil, fmt.Errorf("failed to split %s key: %v", objectType, err)
+			}
+
+			record, err := newBackupRecord(objectType, attributes, entry.Value)
+			if err != nil {
+				iterator.Close()
+				return nil, err
+			}
+			page.Records = append(page.Records, record)
+		}
+		iterator.Close()
+
+		// A short page means the type is exhausted; a full one may have more, so resume within it
+		if metadata.GetFetchedRecordsCount() == remaining {
+			page.Bookmark = objectType + ":" + metadata.GetBookmark()
+			return page, nil
+		}
+		innerBookmark = ""
+	}
+
+	return page, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExportAllPaginatesAcrossTypes(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "export-1", "export-2")
+	e.cast(vote.VoteId, "voter-1", true)
+	e.startVote(newTestDevice(t, 1), "export-3")
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), "exported", 0))
+	expected := []string{"PhotoVote", "PhotoVote", "Photo", "Photo", "Photo", "DeviceKey", "DeviceKey", "HelperData"}
+
+	for _, pageSize := range []int32{1, 2, 3, 8, 100} {
+		types := make([]string, 0, len(expected))
+		keys := make(map[string]bool)
+		bookmark := ""
+		for pages := 0; ; pages++ {
+			if pages > len(expected)+1 {
+				t.Fatalf("page size %d: export did not end", pageSize)
+			}
+			page, err := e.dr.ExportAll(e.admin(), pageSize, bookmark)
+			requireNoError(t, err)
+			if int32(len(page.Records)) > pageSize {
+				t.Fatalf("page size %d: page of %d records", pageSize, len(page.Records))
+			}
+			for _, record := range page.Records {
+				key := record.Type + "/" + strings.Join(record.Key, "/")
+				if keys[key] {
+					t.Fatalf("page size %d: record %s exported twice", pageSize, key)
+				}
+				keys[key] = true
+				types = append(types, record.Type)
+			}
+			if page.Bookmark == "" {
+				break
+			}
+			bookmark = page.Bookmark
+		}
+		if !slices.Equal(types, expected) {
+			t.Fatalf("page size %d: exported types %v, expected %v", pageSize, types, expected)
+		}
+	}
+
+	page, err := e.dr.ExportAll(e.admin(), 3, "")
+	requireNoError(t, err)
+	if page.Records[0].Vote == nil || page.Records[0].Vote.VoteId != vote.VoteId || page.Records[2].Photo == nil {
+		t.Fatalf("records do not carry their typed payload: %+v", page.Records)
+	}
+	_, err = e.dr.ExportAll(e.ctx("user", "Org2MSP"), 3, "")
+	requireError(t, err)
+	_, err = e.dr.ExportAll(e.admin(), 3, "Unknown:key")
+	requireError(t, err)
+	_, err = e.dr.ExportAll(e.admin(), 0, "")
+	requireError(t, err)
+}
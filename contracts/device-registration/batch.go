@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// VoteRequest is one vote to open in a StartPhotoVotes batch
+type VoteRequest struct {
+	Photos          []IPFSPhoto `json:"photos"`
+	DevicePublicKey string      `json:"devicePublicKey"`
+}
+
+// VoteRequestResult is the outcome of one batch request; Vote is omitted when Error is set
+type VoteRequestResult struct {
+	Index int        `json:"index"`
+	Vote  *PhotoVote `json:"vote,omitempty" metadata:",optional"`
+	Error string     `json:"error"`
+}
+
+// StartPhotoVotes opens a vote for each request, returning per-request results in order.
+// When atomic is set any failing request fails the whole transaction; otherwise failed
+// requests are reported and write nothing while the rest are opened.
+func (dr *DeviceRegistration) StartPhotoVotes(ctx contractapi.TransactionContextInterface, requests []VoteRequest, atomic bool) ([]*VoteRequestResult, error) {
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("vote requests cannot be empty")
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	strictFailures, err := checkStrictVoteRequestsArg(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := newVoteBatch()
+	results := make([]*VoteRequestResult, 0, len(requests))
+	for i, request := range requests {
+		result := &VoteRequestResult{Index: i}
+
+		var vote *PhotoVote
+		err := strictFailures[i]
+		if err == nil {
+			vote, err = startPhotoVote(ctx, request.Photos, request.DevicePublicKey, VoteOptions{}, batch)
+		}
+		if err != nil {
+			if atomic {
+				return nil, fmt.Errorf("vote request %d: %v", i, err)
+			}
+			result.Error = err.Error()
+		} else {
+			result.Vote = vote
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// HelperDataInput is one record to store in a StoreHelperDataBatch batch, with the arguments of StoreHelperData
+type HelperDataInput struct {
+	HelperData      string `json:"helperData"`
+	PubKeyHash      string `json:"pubKeyHash"`
+	Signature       string `json:"signature"` // Hex PSS signature of HelperData by the device key
+	Nickname        string `json:"nickname"`
+	ExpectedVersion int    `json:"expectedVersion"` // Version of the stored record being replaced, 0 when none exists yet
+}
+
+// HelperDataResult is the outcome of one helper data batch record
+type HelperDataResult struct {
+	Index    int    `json:"index"`
+	Nickname string `json:"nickname"`
+	Error    string `json:"error"`
+}
+
+// StoreHelperDataBatch stores each helper data record with its own signature verification, returning
+// per-record results in order. When atomic is set any failing record fails the whole transaction;
+// otherwise failed records are reported and write nothing while the rest are stored.
+func (dr *DeviceRegistration) StoreHelperDataBatch(ctx contractapi.TransactionContextInterface, records []HelperDataInput, atomic bool) ([]*HelperDataResult, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("helper data records cannot be empty")
+	}
+
+	// Writes are not visible to reads within a transaction, so a nickname may be stored only once
+	seen := make(map[string]bool)
+	results := make([]*HelperDataResult, 0, len(records))
+	for i, record := range records {
+		result := &HelperDataResult{Index: i, Nickname: record.Nickname}
+
+		var err error
+		if seen[record.Nickname] {
+			err = fmt.Errorf("nickname %s appears more than once in the batch", record.Nickname)
+		} else {
+			err = storeHelperData(ctx, record.HelperData, record.PubKeyHash, record.Signature, record.Nickname, record.ExpectedVersion)
+		}
+		if err != nil {
+			if atomic {
+				return nil, fmt.Errorf("helper data record %d: %v", i, err)
+			}
+			result.Error = err.Error()
+		} else {
+			seen[record.Nickname] = true
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
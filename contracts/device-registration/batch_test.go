@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// typoVoteRequests returns vote requests for two devices and their raw JSON, in which the second
+// request's photo carries a mis-cased "mimetype" key
+func typoVoteRequests(t *testing.T) ([]VoteRequest, string) {
+	t.Helper()
+	requests := []VoteRequest{
+		{Photos: []IPFSPhoto{newTestDevice(t, 0).photo("batch-a")}, DevicePublicKey: newTestDevice(t, 0).publicKey},
+		{Photos: []IPFSPhoto{newTestDevice(t, 1).photo("batch-b")}, DevicePublicKey: newTestDevice(t, 1).publicKey},
+	}
+	requestsJSON, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := strings.Replace(string(requestsJSON), `"ipfsHash":"`+requests[1].Photos[0].IPFSHash+`"`, `"ipfsHash":"`+requests[1].Photos[0].IPFSHash+`","mimetype":"image/png"`, 1)
+	if raw == string(requestsJSON) {
+		t.Fatal("typo was not injected")
+	}
+	return requests, raw
+}
+
+func TestStartPhotoVotesLenientByDefault(t *testing.T) {
+	e := newTestEnv(t)
+	requests, raw := typoVoteRequests(t)
+
+	results, err := e.dr.StartPhotoVotes(e.ctxWithArgs("uploader", "Org1MSP", "StartPhotoVotes", raw, "true"), requests, true)
+	requireNoError(t, err)
+	for _, result := range results {
+		if result.Error != "" {
+			t.Fatalf("request %d: %s", result.Index, result.Error)
+		}
+	}
+}
+
+func TestStartPhotoVotesStrictRejectsTypoedField(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"strictJSONInput": true}`)
+	requests, raw := typoVoteRequests(t)
+
+	_, err := e.dr.StartPhotoVotes(e.ctxWithArgs("uploader", "Org1MSP", "StartPhotoVotes", raw, "true"), requests, true)
+	requireError(t, err)
+	if !strings.Contains(err.Error(), "mimetype") {
+		t.Fatalf("error does not name the unknown field: %v", err)
+	}
+
+	// The mock stub keeps the writes of a failed transaction, so the non-atomic batch runs on a fresh ledger
+	e = newTestEnv(t)
+	e.setConfig(`{"strictJSONInput": true}`)
+	results, err := e.dr.StartPhotoVotes(e.ctxWithArgs("uploader", "Org1MSP", "StartPhotoVotes", raw, "false"), requests, false)
+	requireNoError(t, err)
+	if results[0].Error != "" || results[0].Vote == nil {
+		t.Fatalf("request 0 was not opened: %s", results[0].Error)
+	}
+	if !strings.Contains(results[1].Error, "mimetype") || results[1].Vote != nil {
+		t.Fatalf("request 1 was not rejected for its unknown field: %+v", results[1])
+	}
+}
+
+// mixedVoteRequests returns three vote requests of which the second carries a forged signature
+func mixedVoteRequests(t *testing.T) []VoteRequest {
+	t.Helper()
+	forged := newTestDevice(t, 1).photo("mixed-forged")
+	forged.Signature = newTestDevice(t, 2).sign("forged")
+	return []VoteRequest{
+		{Photos: []IPFSPhoto{newTestDevice(t, 0).photo("mixed-a")}, DevicePublicKey: newTestDevice(t, 0).publicKey},
+		{Photos: []IPFSPhoto{forged}, DevicePublicKey: newTestDevice(t, 1).publicKey},
+		{Photos: []IPFSPhoto{newTestDevice(t, 2).photo("mixed-c")}, DevicePublicKey: newTestDevice(t, 2).publicKey},
+	}
+}
+
+func TestStartPhotoVotesReportsMixedResults(t *testing.T) {
+	e := newTestEnv(t)
+	results, err := e.dr.StartPhotoVotes(e.ctx("uploader", "Org1MSP"), mixedVoteRequests(t), false)
+	requireNoError(t, err)
+	if len(results) != 3 {
+		t.Fatalf("%d results for three requests", len(results))
+	}
+	for i, result := range results {
+		failed := i == 1
+		if result.Index != i || (result.Error != "") != failed || (result.Vote == nil) != failed {
+			t.Errorf("result %d: %+v", i, result)
+		}
+	}
+	if e.getState("DeviceKey", newTestDevice(t, 1).hash) != nil {
+		t.Fatal("the failed request wrote its device key")
+	}
+	if status := e.vote(results[2].Vote.VoteId).Status; status != VoteStatusPending {
+		t.Fatalf("request after the failure opened with status %s", status)
+	}
+}
+
+func TestStartPhotoVotesAtomicFailsWholeBatch(t *testing.T) {
+	e := newTestEnv(t)
+	_, err := e.dr.StartPhotoVotes(e.ctx("uploader", "Org1MSP"), mixedVoteRequests(t), true)
+	requireError(t, err)
+	if !strings.Contains(err.Error(), "request 1") {
+		t.Fatalf("error does not name the failing request: %v", err)
+	}
+}
+
+// mixedHelperDataRecords returns helper data records for a verified device in which the second record
+// carries a bad signature and the third repeats the first record's nickname
+func mixedHelperDataRecords(e *testEnv) []HelperDataInput {
+	device := newHelperDataDevice(e)
+	record := func(data string, nickname string) HelperDataInput {
+		return HelperDataInput{HelperData: data, PubKeyHash: device.hash, Signature: device.sign(data), Nickname: nickname}
+	}
+	badSignature := record("forged", "forged")
+	badSignature.Signature = device.sign("other data")
+	return []HelperDataInput{record("first", "first"), badSignature, record("repeat", "first"), record("second", "second")}
+}
+
+func TestStoreHelperDataBatchReportsMixedResults(t *testing.T) {
+	e := newTestEnv(t)
+	results, err := e.dr.StoreHelperDataBatch(e.ctx("uploader", "Org1MSP"), mixedHelperDataRecords(e), false)
+	requireNoError(t, err)
+	if len(results) != 4 {
+		t.Fatalf("%d results for four records", len(results))
+	}
+	for i, result := range results {
+		failed := i == 1 || i == 2
+		if result.Index != i || (result.Error != "") != failed {
+			t.Errorf("result %d: %+v", i, result)
+		}
+	}
+	for nickname, data := range map[string]string{"first": "first", "second": "second"} {
+		record, err := e.dr.GetHelperData(e.admin(), nickname)
+		requireNoError(t, err)
+		if record.Data != data {
+			t.Errorf("nickname %s stores %q, want %q", nickname, record.Data, data)
+		}
+	}
+	if e.getState("HelperData", "forged") != nil {
+		t.Fatal("the record with a bad signature was stored")
+	}
+}
+
+func TestStoreHelperDataBatchAtomicFailsWholeBatch(t *testing.T) {
+	e := newTestEnv(t)
+	_, err := e.dr.StoreHelperDataBatch(e.ctx("uploader", "Org1MSP"), mixedHelperDataRecords(e), true)
+	requireError(t, err)
+	if !strings.Contains(err.Error(), "helper data record 1") {
+		t.Fatalf("error does not name the failing record: %v", err)
+	}
+	_, err = e.dr.StoreHelperDataBatch(e.ctx("uploader", "Org1MSP"), nil, true)
+	requireError(t, err)
+}
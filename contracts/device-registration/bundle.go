@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// VoteBundle is a portable snapshot of a vote together with its photos, device key and counted ballots
+type VoteBundle struct {
+	Vote      PhotoVote         `json:"vote"`
+	Photos    []IPFSPhoto       `json:"photos"`
+	DeviceKey DeviceKey         `json:"deviceKey"`
+	Ballots   []VoteParticipant `json:"ballots,omitempty" metadata:",optional"` // Counted ballots, exported while the vote is open only to admins
+}
+
+// ExportedVoteBundle wraps a bundle with the SHA-256 digest of its JSON encoding
+type ExportedVoteBundle struct {
+	Bundle VoteBundle `json:"bundle"`
+	Digest string     `json:"digest"` // Hex-encoded SHA-256 of the JSON-encoded bundle
+}
+
+// bundleDigest computes the hex SHA-256 digest of a bundle's JSON encoding
+func bundleDigest(bundle VoteBundle) (string, error) {
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal bundle: %v", err)
+	}
+	digest := sha256.Sum256(bundleJSON)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// ExportVoteBundle assembles a vote, its photos and its device key into a single digest-protected bundle
+func (dr *DeviceRegistration) ExportVoteBundle(ctx contractapi.TransactionContextInterface, voteId string) (*ExportedVoteBundle, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	photos := make([]IPFSPhoto, 0, len(vote.PhotoIPFSHashes))
+	for _, ipfsHash := range vote.PhotoIPFSHashes {
+		photo, err := dr.GetPhotoMetadata(ctx, ipfsHash)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, *photo)
+	}
+
+	deviceKey, err := getDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := VoteBundle{
+		Vote:      *vote,
+		Photos:    photos,
+		DeviceKey: *deviceKey,
+	}
+
+	// Choices of an open vote are hidden from everyone but admins, who need them to migrate the vote
+	if !ballotsHidden(vote) || requireAdmin(ctx) == nil {
+		bundle.Ballots, err = getVoterBallots(ctx, vote.VoteId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	digest, err := bundleDigest(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExportedVoteBundle{
+		Bundle: bundle,
+		Digest: digest,
+	}, nil
+}
+
+// bundleRecord is a single world state entry a bundle import would write
+type bundleRecord struct {
+	key   string
+	value []byte
+}
+
+// newBundleRecord marshals a value into a bundle record
+func newBundleRecord(key string, value interface{}) (bundleRecord, error) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return bundleRecord{}, err
+	}
+	return bundleRecord{key: key, value: valueJSON}, nil
+}
+
+// bundleRecords lists the composite keys and values stored by a bundle, with photos encoded under the
+// configured storage mode
+func bundleRecords(ctx contractapi.TransactionContextInterface, bundle VoteBundle, config *ContractConfig) ([]bundleRecord, error) {
+	records := make([]bundleRecord, 0, 3*len(bundle.Photos)+len(bundle.Ballots)+6)
+
+	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{bundle.Vote.VoteId})
+	if err != nil {
+		return nil, err
+	}
+	record, err := newBundleRecord(voteKey, bundle.Vote)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, record)
+
+	voteStatusIndexKey, err := ctx.GetStub().CreateCompositeKey("VoteByStatus", []string{string(bundle.Vote.Status), bundle.Vote.VoteId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for vote status index: %v", err)
+	}
+	records = append(records, bundleRecord{key: voteStatusIndexKey, value: []byte{0x00}})
+
+	for _, photo := range bundle.Photos {
+		photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{photo.IPFSHash})
+		if err != nil {
+			return nil, err
+		}
+		// A digest-only photo was accepted without re-verifying its signature, so it is stored as such
+		digestOnly, err := bundlePhotoDigestOnly(photo)
+		if err != nil {
+			return nil, err
+		}
+		if digestOnly {
+			photo.SignatureUnverified = true
+			photo.SignatureMode = config.SignatureMode
+		}
+		photoJSON, err := photoRecordJSON(photo, config)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, bundleRecord{key: photoKey, value: photoJSON})
+
+		photoVoteRefKey, err := ctx.GetStub().CreateCompositeKey("PhotoVoteRef", []string{photo.IPFSHash})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for photo vote index: %v", err)
+		}
+		records = append(records, bundleRecord{key: photoVoteRefKey, value: []byte(bundle.Vote.VoteId)})
+
+		photoVoteHistoryKey, err := ctx.GetStub().CreateCompositeKey("PhotoVoteHistory", []string{photo.IPFSHash, bundle.Vote.VoteId})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for photo vote history: %v", err)
+		}
+		records = append(records, bundleRecord{key: photoVoteHistoryKey, value: []byte{0x00}})
+	}
+
+	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{bundle.DeviceKey.PublicKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device: %v", err)
+	}
+	record, err = newBundleRecord(deviceKeyCompositeKey, bundle.DeviceKey)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, record)
+
+	statusIndexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByStatus", []string{string(bundle.DeviceKey.Status), bundle.DeviceKey.PublicKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device status index: %v", err)
+	}
+	records = append(records, bundleRecord{key: statusIndexKey, value: []byte{0x00}})
+
+	if bundle.DeviceKey.VerifiedAt != "" {
+		verifiedAt, err := time.Parse(time.RFC3339, bundle.DeviceKey.VerifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("device key has invalid verification time: %v", err)
+		}
+		verifiedAtKey, err := verifiedAtIndexKey(ctx, verifiedAt, bundle.DeviceKey.PublicKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, bundleRecord{key: verifiedAtKey, value: []byte{0x00}})
+	}
+
+	for _, ballot := range bundle.Ballots {
+		ballotKey, err := ctx.GetStub().CreateCompositeKey("VoterBallot", []string{bundle.Vote.VoteId, fmt.Sprintf("%04d", ballot.Round), ballot.VoterID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for voter ballot: %v", err)
+		}
+		record, err := newBundleRecord(ballotKey, ballot)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if bundle.Vote.ResultHash != "" {
+		resultHashKey, err := ctx.GetStub().CreateCompositeKey("VoteByResultHash", []string{bundle.Vote.ResultHash})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for result hash index: %v", err)
+		}
+		records = append(records, bundleRecord{key: resultHashKey, value: []byte(bundle.Vote.VoteId)})
+	}
+
+	deviceVoteIndexKey, err := ctx.GetStub().CreateCompositeKey("DeviceVotes", []string{bundle.Vote.DevicePublicKey, bundle.Vote.CreatedAt, bundle.Vote.VoteId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device vote index: %v", err)
+	}
+	records = append(records, bundleRecord{key: deviceVoteIndexKey, value: []byte{0x00}})
+
+	return records, nil
+}
+
+// checkVoteBundle verifies a bundle's digest, internal consistency and photo signatures
+func checkVoteBundle(exported ExportedVoteBundle, config *ContractConfig) error {
+	digest, err := bundleDigest(exported.Bundle)
+	if err != nil {
+		return err
+	}
+	if digest != exported.Digest {
+		return fmt.Errorf("bundle digest mismatch: expected %s, computed %s", exported.Digest, digest)
+	}
+
+	bundle := exported.Bundle
+	pubKeyHash := fmt.Sprintf("%x", sha256.Sum256([]byte(bundle.DeviceKey.PublicKey)))
+	if pubKeyHash != bundle.DeviceKey.PublicKeyHash {
+		return fmt.Errorf("device key hash %s does not match its public key", bundle.DeviceKey.PublicKeyHash)
+	}
+	if bundle.Vote.DevicePublicKey != pubKeyHash {
+		return fmt.Errorf("vote %s references device %s, bundle contains %s", bundle.Vote.VoteId, bundle.Vote.DevicePublicKey, pubKeyHash)
+	}
+
+	if bundle.Vote.ConsensusRule != "" && bundle.Vote.ConsensusRule != consensusRuleFor(bundle.Vote.MinValidVotes) {
+		return fmt.Errorf("vote %s records consensus rule %s, its settings are evaluated under %s", bundle.Vote.VoteId, bundle.Vote.ConsensusRule, consensusRuleFor(bundle.Vote.MinValidVotes))
+	}
+
+	if len(bundle.Photos) != len(bundle.Vote.PhotoIPFSHashes) {
+		return fmt.Errorf("vote %s references %d photos, bundle contains %d", bundle.Vote.VoteId, len(bundle.Vote.PhotoIPFSHashes), len(bundle.Photos))
+	}
+	for i, photo := range bundle.Photos {
+		if photo.IPFSHash != bundle.Vote.PhotoIPFSHashes[i] {
+			return fmt.Errorf("bundle photo %s is not referenced by vote %s", photo.IPFSHash, bundle.Vote.VoteId)
+		}
+
+		// A carried payload digest is no proof of what was signed: a photo that still has its signed
+		// fields must hash to it, and a digest-only compact photo cannot be re-verified at all
+		digestOnly, err := bundlePhotoDigestOnly(photo)
+		if err != nil {
+			return err
+		}
+		if digestOnly {
+			if config.SignatureMode == "STRICT" {
+				return fmt.Errorf("photo with hash %s carries only a payload digest, which the STRICT signature mode cannot re-verify", photo.IPFSHash)
+			}
+			continue
+		}
+		photo.SignedPayloadDigest = ""
+
+		// The bundle digest is a plain hash anyone can recompute, so the photo's own unverified mark
+		// only counts where this contract's signature mode would have accepted it too
+		if verifyPhotoSignature(photo, bundle.DeviceKey.PublicKey, bundle.DeviceKey.SignatureEncoding, pssOptions(config)) {
+			continue
+		}
+		if !photo.SignatureUnverified {
+			return fmt.Errorf("invalid digital signature for photo with hash: %s", photo.IPFSHash)
+		}
+		if config.SignatureMode == "STRICT" {
+			return fmt.Errorf("photo with hash %s has an unverified signature, which the STRICT signature mode does not accept", photo.IPFSHash)
+		}
+	}
+
+	err = checkBundleVerdict(bundle, config)
+	if err != nil {
+		return err
+	}
+
+	return checkBundleBallots(bundle)
+}
+
+// checkBundleVerdict requires a finalized bundle vote's status to be the one its tally evaluates to,
+// and a VERIFIED device key to be backed by that approval or by a recorded forced verification
+func checkBundleVerdict(bundle VoteBundle, config *ContractConfig) error {
+	vote := bundle.Vote
+	if vote.Status == VoteStatusApproved || vote.Status == VoteStatusRejected {
+		thresholds := configuredThresholds(&vote, config)
+		if vote.Outcome != nil {
+			thresholds = vote.Outcome.Thresholds
+		}
+		err := validateThresholds(thresholds)
+		if err != nil {
+			return fmt.Errorf("vote %s records invalid thresholds: %v", vote.VoteId, err)
+		}
+		outcome := evaluateVote(&vote, thresholds)
+		if outcome.Status != vote.Status {
+			return fmt.Errorf("vote %s is %s, but its tally evaluates to %s", vote.VoteId, vote.Status, outcome.Status)
+		}
+	}
+
+	if bundle.DeviceKey.Status == DeviceStatusVerified && vote.Status != VoteStatusApproved && bundle.DeviceKey.ForceVerifiedBy == "" {
+		return fmt.Errorf("device key %s is VERIFIED without an approved vote or a forced verification", bundle.DeviceKey.PublicKeyHash)
+	}
+	return nil
+}
+
+// bundlePhotoDigestOnly reports whether a bundle photo is a compact record holding only the digest of
+// its signed payload, failing when a photo that still carries its signed fields does not hash to it
+func bundlePhotoDigestOnly(photo IPFSPhoto) (bool, error) {
+	if photo.SignedPayloadDigest == "" {
+		return false, nil
+	}
+	hashed := sha256.Sum256([]byte(photoSigningPayload(photo)))
+	if photo.SignedPayloadDigest == hex.EncodeToString(hashed[:]) {
+		return false, nil
+	}
+	if photo.TimeStamp != "" {
+		return false, fmt.Errorf("payload digest of photo with hash %s does not match its signed fields", photo.IPFSHash)
+	}
+	return true, nil
+}
+
+// checkBundleBallots requires a bundle's ballots, when it carries any, to be exactly the voters of each
+// round with the choices its tally adds up to
+func checkBundleBallots(bundle VoteBundle) error {
+	if len(bundle.Ballots) == 0 {
+		return nil
+	}
+
+	vote := bundle.Vote
+	rounds := append(slices.Clone(vote.Rounds), RoundResult{
+		Round:      len(vote.Rounds) + 1,
+		VoteCount:  vote.VoteCount,
+		ValidVotes: vote.ValidVotes,
+		Voters:     vote.Voters,
+	})
+	counted := make(map[int]int)
+	valid := make(map[int]int)
+	seen := make(map[string]bool)
+	for _, ballot := range bundle.Ballots {
+		if ballot.Round < 1 || ballot.Round > len(rounds) || !slices.Contains(rounds[ballot.Round-1].Voters, ballot.VoterID) {
+			return fmt.Errorf("ballot of %s in round %d is not counted by vote %s", ballot.VoterID, ballot.Round, vote.VoteId)
+		}
+		ballotKey := fmt.Sprintf("%d/%s", ballot.Round, ballot.VoterID)
+		if seen[ballotKey] {
+			return fmt.Errorf("ballot of %s in round %d appears more than once", ballot.VoterID, ballot.Round)
+		}
+		seen[ballotKey] = true
+
+		switch ballot.Choice {
+		case "VALID":
+			valid[ballot.Round]++
+		case "INVALID":
+		default:
+			return fmt.Errorf("ballot of %s has unknown choice %s", ballot.VoterID, ballot.Choice)
+		}
+		counted[ballot.Round]++
+	}
+
+	for _, round := range rounds {
+		if counted[round.Round] != len(round.Voters) || valid[round.Round] != round.ValidVotes {
+			return fmt.Errorf("ballots of round %d do not match the tally of vote %s", round.Round, vote.VoteId)
+		}
+	}
+
+	return nil
+}
+
+// bundleConflicts returns the keys of bundle records that already exist in the world state
+func bundleConflicts(ctx contractapi.TransactionContextInterface, records []bundleRecord) ([]string, error) {
+	conflicts := make([]string, 0)
+	for _, record := range records {
+		existing, err := ctx.GetStub().GetState(record.key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existing != nil {
+			conflicts = append(conflicts, record.key)
+		}
+	}
+	return conflicts, nil
+}
+
+// BundleValidation reports whether ImportVoteBundle would accept a bundle
+type BundleValidation struct {
+	Valid       bool     `json:"valid"`
+	VoteId      string   `json:"voteId,omitempty" metadata:",optional"`      // Vote carried by the bundle, empty when it cannot be parsed
+	Digest      string   `json:"digest,omitempty" metadata:",optional"`      // Digest recomputed from the bundle contents
+	BundleError string   `json:"bundleError,omitempty" metadata:",optional"` // Why the bundle failed its parse, digest, consistency or signature checks
+	RecordCount int      `json:"recordCount"`                                // World state entries an import would write
+	Conflicts   []string `json:"conflicts"`                                  // Keys of records that already exist and would block the import
+}
+
+// ValidateVoteBundle runs every check ImportVoteBundle would without writing anything, listing all
+// conflicting records instead of stopping at the first (admin only)
+func (dr *DeviceRegistration) ValidateVoteBundle(ctx contractapi.TransactionContextInterface, bundleJSON string) (*BundleValidation, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	report := &BundleValidation{
+		Conflicts: make([]string, 0),
+	}
+
+	var exported ExportedVoteBundle
+	err := json.Unmarshal([]byte(bundleJSON), &exported)
+	if err != nil {
+		report.BundleError = fmt.Sprintf("failed to parse bundle: %v", err)
+		return report, nil
+	}
+	report.VoteId = exported.Bundle.Vote.VoteId
+
+	report.Digest, err = bundleDigest(exported.Bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkVoteBundle(exported, config); err != nil {
+		report.BundleError = err.Error()
+	}
+
+	records, err := bundleRecords(ctx, exported.Bundle, config)
+	if err != nil {
+		report.BundleError = fmt.Sprintf("failed to build bundle records: %v", err)
+		return report, nil
+	}
+	report.RecordCount = len(records)
+
+	report.Conflicts, err = bundleConflicts(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Valid = report.BundleError == "" && len(report.Conflicts) == 0
+	return report, nil
+}
+
+// ImportVoteBundle writes an exported bundle into the world state without overwriting existing records (admin only)
+func (dr *DeviceRegistration) ImportVoteBundle(ctx contractapi.TransactionContextInterface, bundleJSON string) (*PhotoVote, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var exported ExportedVoteBundle
+	err := json.Unmarshal([]byte(bundleJSON), &exported)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bundle: %v", err)
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkVoteBundle(exported, config)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := bundleRecords(ctx, exported.Bundle, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to overwrite anything before writing a single record
+	conflicts, err := bundleConflicts(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("record %q already exists", conflicts[0])
+	}
+
+	for _, record := range records {
+		err = ctx.GetStub().PutState(record.key, record.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store record %s: %v", record.key, err)
+		}
+	}
+
+	return &exported.Bundle.Vote, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+// exportBundle exports a vote as an admin, failing the test on error
+func (e *testEnv) exportBundle(voteId string) *ExportedVoteBundle {
+	e.t.Helper()
+	exported, err := e.dr.ExportVoteBundle(e.admin(), voteId)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return exported
+}
+
+// bundleJSON re-digests a possibly edited bundle and encodes it for import
+func bundleJSON(t *testing.T, exported *ExportedVoteBundle) string {
+	t.Helper()
+	digest, err := bundleDigest(exported.Bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported.Digest = digest
+	encoded, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestImportRejectsSelfDeclaredUnverifiedSignature(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "bundled")
+
+	exported := source.exportBundle(vote.VoteId)
+	exported.Bundle.Photos[0].Signature = newTestDevice(t, 1).sign("forged")
+	exported.Bundle.Photos[0].SignatureUnverified = true
+	forged := bundleJSON(t, exported)
+
+	strict := newTestEnv(t)
+	_, err := strict.dr.ImportVoteBundle(strict.admin(), forged)
+	requireError(t, err)
+
+	lenient := newTestEnv(t)
+	lenient.setConfig(`{"signatureMode": "WARN"}`)
+	_, err = lenient.dr.ImportVoteBundle(lenient.admin(), forged)
+	requireNoError(t, err)
+}
+
+func TestImportRejectsInvalidSignatureWithoutMark(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "bundled")
+
+	exported := source.exportBundle(vote.VoteId)
+	exported.Bundle.Photos[0].Signature = newTestDevice(t, 1).sign("forged")
+
+	target := newTestEnv(t)
+	target.setConfig(`{"signatureMode": "OFF"}`)
+	_, err := target.dr.ImportVoteBundle(target.admin(), bundleJSON(t, exported))
+	requireError(t, err)
+}
+
+func TestImportRefusesCarriedPayloadDigestAsProof(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "genuine", "forged")
+	genuine := device.photo("genuine")
+	hashed := sha256.Sum256([]byte(photoSigningPayload(genuine)))
+
+	// Another photo's digest and signature copied onto a photo that keeps its own signed fields
+	exported := source.exportBundle(vote.VoteId)
+	exported.Bundle.Photos[1].SignedPayloadDigest = hex.EncodeToString(hashed[:])
+	exported.Bundle.Photos[1].Signature = genuine.Signature
+	lenient := newTestEnv(t)
+	lenient.setConfig(`{"signatureMode": "WARN"}`)
+	_, err := lenient.dr.ImportVoteBundle(lenient.admin(), bundleJSON(t, exported))
+	requireError(t, err)
+
+	// The same copy with the signed fields dropped, posing as a compact record
+	exported.Bundle.Photos[1].TimeStamp = ""
+	exported.Bundle.Photos[1].Description = ""
+	strict := newTestEnv(t)
+	_, err = strict.dr.ImportVoteBundle(strict.admin(), bundleJSON(t, exported))
+	requireError(t, err)
+}
+
+func TestImportMarksDigestOnlyPhotosUnverified(t *testing.T) {
+	source := newTestEnv(t)
+	source.setConfig(`{"photoStorageMode": "COMPACT"}`)
+	vote := source.startVote(newTestDevice(t, 0), "compact")
+	compact := bundleJSON(t, source.exportBundle(vote.VoteId))
+
+	strict := newTestEnv(t)
+	_, err := strict.dr.ImportVoteBundle(strict.admin(), compact)
+	requireError(t, err)
+
+	lenient := newTestEnv(t)
+	lenient.setConfig(`{"signatureMode": "WARN"}`)
+	_, err = lenient.dr.ImportVoteBundle(lenient.admin(), compact)
+	requireNoError(t, err)
+	stored, err := lenient.dr.GetPhotoMetadata(lenient.admin(), testCID("compact"))
+	requireNoError(t, err)
+	if !stored.SignatureUnverified || stored.SignatureMode != "WARN" {
+		t.Fatalf("digest-only photo imported as unverified %v under mode %q", stored.SignatureUnverified, stored.SignatureMode)
+	}
+}
+
+func TestImportCarriesBallotsAndVerificationIndex(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "migrated")
+	source.cast(vote.VoteId, "voter-1", true)
+
+	exported := source.exportBundle(vote.VoteId)
+	if len(exported.Bundle.Ballots) != 1 {
+		t.Fatalf("bundle carries %d ballots, want 1", len(exported.Bundle.Ballots))
+	}
+
+	target := newTestEnv(t)
+	_, err := target.dr.ImportVoteBundle(target.admin(), bundleJSON(t, exported))
+	requireNoError(t, err)
+
+	participants, err := target.dr.GetVoteParticipants(target.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if len(participants) != 1 || participants[0].VoterID != "voter-1" || participants[0].Choice != "VALID" {
+		t.Fatalf("imported participants = %+v", participants)
+	}
+	verified, err := target.dr.GetRecentlyVerifiedDevices(target.admin(), 10)
+	requireNoError(t, err)
+	if len(verified) != 1 || verified[0].PublicKeyHash != device.hash {
+		t.Fatalf("recently verified devices after import = %v", verified)
+	}
+}
+
+func TestImportRejectsForgedApproval(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "unvoted")
+	importBundle := func(edit func(bundle *VoteBundle)) error {
+		t.Helper()
+		exported := source.exportBundle(vote.VoteId)
+		edit(&exported.Bundle)
+		target := newTestEnv(t)
+		_, err := target.dr.ImportVoteBundle(target.admin(), bundleJSON(t, exported))
+		return err
+	}
+
+	// An APPROVED vote without a single ballot, with and without forged lenient thresholds
+	requireError(t, importBundle(func(bundle *VoteBundle) {
+		bundle.Vote.Status = VoteStatusApproved
+		bundle.DeviceKey.Status = DeviceStatusVerified
+	}))
+	requireError(t, importBundle(func(bundle *VoteBundle) {
+		bundle.Vote.Status = VoteStatusApproved
+		bundle.Vote.Outcome = &VoteOutcome{VoteId: vote.VoteId, Status: VoteStatusApproved, Thresholds: VoteThresholds{TieBreak: "APPROVE"}}
+		bundle.DeviceKey.Status = DeviceStatusVerified
+	}))
+	// A VERIFIED device key backed by neither an approval nor a forced verification
+	requireError(t, importBundle(func(bundle *VoteBundle) {
+		bundle.DeviceKey.Status = DeviceStatusVerified
+	}))
+	requireNoError(t, importBundle(func(bundle *VoteBundle) {
+		bundle.DeviceKey.Status = DeviceStatusVerified
+		bundle.DeviceKey.ForceVerifiedBy = "admin"
+	}))
+}
+
+func TestImportRejectsBallotsThatDisagreeWithTally(t *testing.T) {
+	source := newTestEnv(t)
+	vote := source.startVote(newTestDevice(t, 0), "migrated")
+	source.cast(vote.VoteId, "voter-1", true)
+
+	exported := source.exportBundle(vote.VoteId)
+	exported.Bundle.Ballots[0].Choice = "INVALID"
+
+	target := newTestEnv(t)
+	_, err := target.dr.ImportVoteBundle(target.admin(), bundleJSON(t, exported))
+	requireError(t, err)
+}
+
+func TestExportHidesOpenBallotsFromNonAdmins(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "open")
+	e.cast(vote.VoteId, "voter-1", true)
+
+	exported, err := e.dr.ExportVoteBundle(e.ctx("reader", "Org2MSP"), vote.VoteId)
+	requireNoError(t, err)
+	if len(exported.Bundle.Ballots) != 0 {
+		t.Fatalf("non-admin export of an open vote carries %d ballots", len(exported.Bundle.Ballots))
+	}
+	if len(e.exportBundle(vote.VoteId).Bundle.Ballots) != 1 {
+		t.Fatal("admin export of an open vote is missing its ballot")
+	}
+}
+
+func TestExportVoteBundleContainsVotePhotosAndKey(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "first", "second")
+
+	exported := e.exportBundle(vote.VoteId)
+	bundle := exported.Bundle
+	if bundle.Vote.VoteId != vote.VoteId || bundle.DeviceKey.PublicKeyHash != device.hash {
+		t.Fatalf("bundle holds vote %s and key %s", bundle.Vote.VoteId, bundle.DeviceKey.PublicKeyHash)
+	}
+	if len(bundle.Photos) != 2 || bundle.Photos[0].IPFSHash != vote.PhotoIPFSHashes[0] || bundle.Photos[1].IPFSHash != vote.PhotoIPFSHashes[1] {
+		t.Fatalf("bundle photos do not match the vote: %+v", bundle.Photos)
+	}
+
+	// The digest is the SHA-256 of the bundle's JSON encoding
+	bundleJSON, err := json.Marshal(bundle)
+	requireNoError(t, err)
+	digest := sha256.Sum256(bundleJSON)
+	if exported.Digest != hex.EncodeToString(digest[:]) {
+		t.Fatalf("digest %s does not verify", exported.Digest)
+	}
+
+	_, err = e.dr.ExportVoteBundle(e.admin(), "vote-missing")
+	requireError(t, err)
+}
+
+func TestImportVoteBundleChecksDigestConflictsAndCaller(t *testing.T) {
+	source := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := source.startVote(device, "migrated")
+	exported := source.exportBundle(vote.VoteId)
+	clean := bundleJSON(t, exported)
+
+	// An edit the digest no longer covers is refused
+	tampered := *exported
+	tampered.Bundle.Vote.ValidVotes = 5
+	tamperedJSON, err := json.Marshal(tampered)
+	requireNoError(t, err)
+	target := newTestEnv(t)
+	_, err = target.dr.ImportVoteBundle(target.admin(), string(tamperedJSON))
+	requireError(t, err)
+
+	_, err = target.dr.ImportVoteBundle(target.ctx("voter-1", "Org2MSP"), clean)
+	requireError(t, err)
+
+	imported, err := target.dr.ImportVoteBundle(target.admin(), clean)
+	requireNoError(t, err)
+	if imported.VoteId != vote.VoteId || target.vote(vote.VoteId).DevicePublicKey != device.hash {
+		t.Fatalf("imported vote %+v", imported)
+	}
+	if target.getState("Photo", vote.PhotoIPFSHashes[0]) == nil || target.deviceKey(device.hash).PublicKey != device.publicKey {
+		t.Fatal("import did not write the photo and device key")
+	}
+
+	// Importing the same bundle again would overwrite the records it already wrote
+	_, err = target.dr.ImportVoteBundle(target.admin(), clean)
+	requireError(t, err)
+}
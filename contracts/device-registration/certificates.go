@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// certificatePEMType is the PEM block type of X.509 certificates in device chains and trust anchors
+const certificatePEMType = "CERTIFICATE"
+
+// parseCertificates decodes a sequence of PEM certificates, returning each alongside its PEM text
+func parseCertificates(certificatesPEM string) ([]*x509.Certificate, []string, error) {
+	certificates := make([]*x509.Certificate, 0)
+	blocks := make([]string, 0)
+
+	rest := []byte(certificatesPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != certificatePEMType {
+			return nil, nil, fmt.Errorf("unsupported PEM block type %q: expected %q", block.Type, certificatePEMType)
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certificates = append(certificates, certificate)
+		blocks = append(blocks, string(pem.EncodeToMemory(block)))
+	}
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, nil, fmt.Errorf("failed to decode certificate")
+	}
+	if len(certificates) == 0 {
+		return nil, nil, fmt.Errorf("no certificates found")
+	}
+
+	return certificates, blocks, nil
+}
+
+// isCertificateChainPEM reports whether a device key is presented as a certificate chain
+func isCertificateChainPEM(devicePublicKey string) bool {
+	block, _ := pem.Decode([]byte(devicePublicKey))
+	return block != nil && block.Type == certificatePEMType
+}
+
+// verifyCertificateChain checks a leaf-first certificate chain against the configured trust anchors
+// at the given time and returns the leaf public key in PEM format with the chain's certificates
+func verifyCertificateChain(chainPEM string, config *ContractConfig, at time.Time) (string, []string, error) {
+	if len(config.TrustAnchors) == 0 {
+		return "", nil, fmt.Errorf("no trust anchors configured for certificate chains")
+	}
+
+	certificates, chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid certificate chain: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	for _, anchorPEM := range config.TrustAnchors {
+		anchors, _, err := parseCertificates(anchorPEM)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid trust anchor: %v", err)
+		}
+		for _, anchor := range anchors {
+			roots.AddCert(anchor)
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	leaf := certificates[0]
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("untrusted certificate chain: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(leaf.PublicKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode leaf public key: %v", err)
+	}
+	leafKeyPEM := pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: der})
+
+	return string(leafKeyPEM), chain, nil
+}
+
+// expiredCertificate describes the first certificate of a stored chain that has expired at the given
+// time, or returns "" when the whole chain is still within its validity period
+func expiredCertificate(chain []string, at time.Time) (string, error) {
+	for i, certificatePEM := range chain {
+		certificates, _, err := parseCertificates(certificatePEM)
+		if err != nil {
+			return "", fmt.Errorf("invalid stored certificate chain: %v", err)
+		}
+		for _, certificate := range certificates {
+			if at.After(certificate.NotAfter) {
+				return fmt.Sprintf("certificate %d of the chain (%s) expired at %s", i, certificate.Subject, certificate.NotAfter.UTC().Format(time.RFC3339)), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// resolveDevicePublicKey returns the PEM public key a device signs with, verifying it first when
+// the device presents a certificate chain instead of a bare key
+func resolveDevicePublicKey(ctx contractapi.TransactionContextInterface, devicePublicKey string, config *ContractConfig) (string, []string, error) {
+	if !isCertificateChainPEM(devicePublicKey) {
+		return devicePublicKey, nil, nil
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return verifyCertificateChain(devicePublicKey, config, txTime)
+}
+
+// certificateCreator presents a serialized identity as the creator of a transaction
+type certificateCreator []byte
+
+// GetCreator returns the serialized identity
+func (c certificateCreator) GetCreator() ([]byte, error) {
+	return c, nil
+}
+
+// certificateClientID returns the client identity ID a transaction submitted with the PEM certificate
+// would have; the ID depends only on the subject and issuer, so it survives certificate renewal
+func certificateClientID(certificatePEM string) (string, error) {
+	creator, err := proto.Marshal(&msp.SerializedIdentity{IdBytes: []byte(certificatePEM)})
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize certificate identity: %v", err)
+	}
+	return cid.GetID(certificateCreator(creator))
+}
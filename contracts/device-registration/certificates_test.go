@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trustAnchors configures the given PEM certificates as the only trust anchors
+func (e *testEnv) trustAnchors(anchors ...string) {
+	e.t.Helper()
+	anchorsJSON, err := json.Marshal(anchors)
+	requireNoError(e.t, err)
+	e.setConfig(`{"trustAnchors": ` + string(anchorsJSON) + `}`)
+}
+
+func TestStartPhotoVoteVerifiesCertificateChain(t *testing.T) {
+	device := newTestDevice(t, 0)
+	chain, anchor := device.certificateChain(t, "device-0")
+	start := func(e *testEnv, name string) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo(name)}, chain)
+		return err
+	}
+
+	e := newTestEnv(t)
+	requireError(t, start(e, "no-anchors"))
+	e.trustAnchors(anchor)
+	requireNoError(t, start(e, "trusted"))
+	deviceKey := e.deviceKey(device.hash)
+	if deviceKey.PublicKey != device.publicKey || len(deviceKey.CertificateChain) != 1 || deviceKey.CertificateChain[0] != chain {
+		t.Fatalf("device key stored from the chain: %+v", deviceKey)
+	}
+
+	untrusted := newTestEnv(t)
+	otherLeaf, _ := newTestDevice(t, 1).certificateChain(t, "other")
+	untrusted.trustAnchors(otherLeaf)
+	requireError(t, start(untrusted, "untrusted"))
+
+	expired := newTestEnv(t)
+	expired.trustAnchors(anchor)
+	expired.advance(6 * 365 * 24 * time.Hour)
+	requireError(t, start(expired, "expired"))
+}
+
+func TestExpiredCertificateFlagsApproval(t *testing.T) {
+	device := newTestDevice(t, 0)
+	chain, anchor := device.certificateChain(t, "device-0")
+	anchorJSON, err := json.Marshal([]string{anchor})
+	requireNoError(t, err)
+	approve := func(rejectExpired bool, age time.Duration) *PhotoVote {
+		t.Helper()
+		e := newTestEnv(t)
+		e.setConfig(fmt.Sprintf(`{"trustAnchors": %s, "rejectExpiredCertificates": %v}`, anchorJSON, rejectExpired))
+		vote, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("certified")}, chain)
+		requireNoError(t, err)
+		e.advance(age)
+		e.cast(vote.VoteId, "voter-1", true)
+		return e.vote(vote.VoteId)
+	}
+
+	if vote := approve(true, time.Hour); vote.Status != VoteStatusApproved {
+		t.Fatalf("vote with a valid certificate is %s", vote.Status)
+	}
+	expired := approve(true, 6*365*24*time.Hour)
+	if expired.Status != VoteStatusFlagged || !strings.Contains(expired.FlagReason, "expired at 2030-01-01T00:00:00Z") {
+		t.Fatalf("vote with an expired certificate is %s: %q", expired.Status, expired.FlagReason)
+	}
+	// The check is opt-in, so an expired certificate still approves by default
+	if vote := approve(false, 6*365*24*time.Hour); vote.Status != VoteStatusApproved {
+		t.Fatalf("vote with an expired certificate and the check disabled is %s", vote.Status)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// minCommitNonceBytes is the shortest nonce, in decoded bytes, a ballot may be revealed with
+const minCommitNonceBytes = 16
+
+// ballotCommitment returns the hex SHA-256 of the voter's identity, a choice ("true" or "false") and
+// the hex nonce, concatenated in that order
+func ballotCommitment(voterID string, isValid bool, nonce string) string {
+	commitment := sha256.Sum256([]byte(voterID + strconv.FormatBool(isValid) + nonce))
+	return hex.EncodeToString(commitment[:])
+}
+
+// getCommitRevealVote reads a pending commit-reveal vote and reports whether its reveal phase has opened
+func getCommitRevealVote(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, bool, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = requireVotingOpen(config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, false, err
+	}
+	if vote.Status != VoteStatusPending {
+		return nil, false, fmt.Errorf("voting for this photo set has ended")
+	}
+	if !vote.CommitReveal {
+		return nil, false, fmt.Errorf("vote %s does not use commit-reveal", voteId)
+	}
+
+	if config.BlockDeviceSelfVote {
+		err = rejectDeviceSelfVote(ctx, vote)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	revealOpensAt, err := time.Parse(time.RFC3339, vote.RevealOpensAt)
+	if err != nil {
+		return nil, false, fmt.Errorf("vote %s has invalid reveal time: %v", voteId, err)
+	}
+
+	return vote, !txTime.Before(revealOpensAt), nil
+}
+
+// CommitVote records the hash of a hidden ballot before the reveal phase. The commitment is the hex
+// SHA-256 of the caller's identity, "true" or "false" and a random hex nonce of at least 16 bytes,
+// concatenated; binding the identity keeps a public commitment from being copied by another voter,
+// and the nonce keeps the choice from being guessed by hashing both options.
+func (dr *DeviceRegistration) CommitVote(ctx contractapi.TransactionContextInterface, voteId string, commitmentHash string) error {
+	vote, revealOpen, err := getCommitRevealVote(ctx, voteId)
+	if err != nil {
+		return err
+	}
+	if revealOpen {
+		return fmt.Errorf("commit phase for vote %s closed at %s", voteId, vote.RevealOpensAt)
+	}
+
+	if decoded, err := hex.DecodeString(commitmentHash); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("commitment must be a hex-encoded SHA-256 hash")
+	}
+
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+	if !isEligibleVoter(vote, voterID) {
+		return fmt.Errorf("voter is not eligible to vote on %s", voteId)
+	}
+	if _, committed := vote.Commitments[voterID]; committed {
+		return fmt.Errorf("voter has already committed a vote")
+	}
+
+	if vote.Commitments == nil {
+		vote.Commitments = make(map[string]string)
+	}
+	vote.Commitments[voterID] = commitmentHash
+
+	return putVote(ctx, vote, vote.Status)
+}
+
+// RevealVote opens the caller's committed ballot once the reveal phase has started and counts it; the
+// choice and nonce must reproduce the commitment, see CommitVote
+func (dr *DeviceRegistration) RevealVote(ctx contractapi.TransactionContextInterface, voteId string, isValid bool, nonce string) error {
+	vote, revealOpen, err := getCommitRevealVote(ctx, voteId)
+	if err != nil {
+		return err
+	}
+	if !revealOpen {
+		return fmt.Errorf("votes on %s cannot be revealed before %s", voteId, vote.RevealOpensAt)
+	}
+
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	commitment, committed := vote.Commitments[voterID]
+	if !committed {
+		return fmt.Errorf("voter has not committed a vote on %s", voteId)
+	}
+	if slices.Contains(vote.Voters, voterID) {
+		return fmt.Errorf("voter has already cast a vote")
+	}
+	if decoded, err := hex.DecodeString(nonce); err != nil || len(decoded) < minCommitNonceBytes {
+		return fmt.Errorf("nonce must be hex-encoded and at least %d bytes", minCommitNonceBytes)
+	}
+	if ballotCommitment(voterID, isValid, nonce) != commitment {
+		return fmt.Errorf("revealed ballot does not match the commitment")
+	}
+
+	return castBallots(ctx, vote, voterID, isValid)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNonce derives a 32-byte hex commit-reveal nonce from a name
+func testNonce(name string) string {
+	hashed := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hashed[:])
+}
+
+func TestCommitRevealCountsMatchingReveal(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"commitReveal": true, "revealDelaySeconds": 60}`, "hidden")
+
+	requireError(t, e.dr.CastVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true))
+	requireError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, "not-a-hash"))
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, ballotCommitment("voter-1", true, testNonce("nonce-1"))))
+	requireError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, ballotCommitment("voter-1", false, testNonce("nonce-2"))))
+	if got := e.vote(vote.VoteId); len(got.Voters) != 0 || got.ValidVotes != 0 {
+		t.Fatalf("committed ballot was counted before its reveal: %+v", got)
+	}
+
+	requireError(t, e.dr.RevealVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true, testNonce("nonce-1")))
+	e.advance(time.Minute)
+	requireError(t, e.dr.CommitVote(e.ctx("voter-2", "Org1MSP"), vote.VoteId, ballotCommitment("voter-2", true, testNonce("late"))))
+	requireNoError(t, e.dr.RevealVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true, testNonce("nonce-1")))
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("status after the deciding reveal %s", got)
+	}
+}
+
+func TestCommitRevealRejectsMismatchedReveal(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"commitReveal": true, "revealDelaySeconds": 60}`, "mismatch")
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, ballotCommitment("voter-1", true, testNonce("nonce"))))
+	e.advance(time.Minute)
+
+	requireError(t, e.dr.RevealVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, false, testNonce("nonce")))
+	requireError(t, e.dr.RevealVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true, testNonce("other-nonce")))
+	requireError(t, e.dr.RevealVote(e.ctx("voter-2", "Org1MSP"), vote.VoteId, true, testNonce("nonce")))
+	if got := e.vote(vote.VoteId); got.Status != VoteStatusPending || len(got.Voters) != 0 {
+		t.Fatalf("a mismatched reveal was counted: %+v", got)
+	}
+}
+
+func TestCommitRevealBindsVoterAndNonce(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"commitReveal": true, "revealDelaySeconds": 60}`, "copied")
+	commitment := ballotCommitment("voter-1", true, testNonce("original"))
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, commitment))
+
+	// The commitment is public, but a copy does not open for another voter even with the same reveal
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-2", "Org1MSP"), vote.VoteId, e.vote(vote.VoteId).Commitments["voter-1"]))
+	short := ballotCommitment("voter-3", true, "00ff")
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-3", "Org1MSP"), vote.VoteId, short))
+	e.advance(time.Minute)
+
+	requireError(t, e.dr.RevealVote(e.ctx("voter-2", "Org1MSP"), vote.VoteId, true, testNonce("original")))
+	err := e.dr.RevealVote(e.ctx("voter-3", "Org1MSP"), vote.VoteId, true, "00ff")
+	if err == nil || !strings.Contains(err.Error(), "at least 16 bytes") {
+		t.Fatalf("RevealVote with a short nonce: %v", err)
+	}
+	if got := e.vote(vote.VoteId); len(got.Voters) != 0 {
+		t.Fatalf("copied or short-nonce reveals were counted: %+v", got.Voters)
+	}
+	requireNoError(t, e.dr.RevealVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true, testNonce("original")))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// configKey is the world state key holding the contract configuration
+const configKey = "ContractConfig"
+
+// ContractConfig holds contract-wide settings stored in the world state
+type ContractConfig struct {
+	AdminMSPs                  []string       `json:"adminMSPs"`                                   // MSP IDs allowed to run administrative transactions
+	VoteCooldownSeconds        int64          `json:"voteCooldownSeconds"`                         // Minimum time between votes started for the same device key
+	Thresholds                 VoteThresholds `json:"thresholds"`                                  // Consensus parameters applied to votes
+	DescriptionPolicy          string         `json:"descriptionPolicy"`                           // "STRIP" or "REJECT" non-printable characters in descriptions
+	MaxDescriptionLength       int            `json:"maxDescriptionLength"`                        // Maximum description length in characters, 0 for no limit
+	RequireDescription         bool           `json:"requireDescription"`                          // Reject photos without a description
+	RequireMonotonicTimestamps bool           `json:"requireMonotonicTimestamps"`                  // Reject photo sets whose RFC3339 timestamps decrease
+	VotingPaused               bool           `json:"votingPaused"`                                // Circuit breaker blocking new votes and casts
+	BlockDeviceSelfVote        bool           `json:"blockDeviceSelfVote"`                         // Reject casts from an identity whose certificate key is the device key under vote
+	TrustAnchors               []string       `json:"trustAnchors,omitempty" metadata:",optional"` // PEM root certificates that device certificate chains must chain to
+	StrictJSONInput            bool           `json:"strictJSONInput"`                             // Reject unknown or mis-cased fields in JSON transaction inputs
+	MinSignatureFormat         int            `json:"minSignatureFormat"`                          // Lowest photo signature format accepted; 2 requires signed descriptions and metadata
+	PSSSaltLength              int            `json:"pssSaltLength"`                               // RSA-PSS salt length in bytes; -1 for the hash length (the client default), 0 to auto-detect
+	ReuseExistingPhotos        bool           `json:"reuseExistingPhotos"`                         // Let a new vote reference an already stored photo signed by the same device key instead of rejecting it
+	PhotoFlagThreshold         float64        `json:"photoFlagThreshold"`                          // Share of a vote's photos that, once flagged, returns its device key to UNVERIFIED; 0 disables
+	NicknamePattern            string         `json:"nicknamePattern"`                             // Regular expression helper data nicknames must match, anchor it to constrain the whole nickname, e.g. ^[A-Za-z0-9_.-]{1,64}$; empty, the default, allows any valid UTF-8 nickname without control characters
+	HelperDataRetentionSeconds int64          `json:"helperDataRetentionSeconds"`                  // Lifetime of a stored helper data record, 0 to keep records indefinitely
+	MaxPendingVotesPerDevice   int            `json:"maxPendingVotesPerDevice"`                    // Votes a device key may have PENDING or READY at once, 0 for no limit
+	SignatureMode              string         `json:"signatureMode"`                               // "STRICT" rejects photos with invalid signatures, "WARN" logs and accepts them, "OFF" skips verification
+	MinDistinctUploaders       int            `json:"minDistinctUploaders"`                        // Different UploadedBy identities a vote's photo set must come from, 0 for no requirement
+	MaxVotersPerVote           int            `json:"maxVotersPerVote"`                            // Ballots a single vote may count, 0 for no limit beyond the counter range
+	MinPerVoteQuorum           int            `json:"minPerVoteQuorum"`                            // Lowest quorum a per-vote quorum fraction may resolve to, 0 for no bound
+	MaxPerVoteQuorum           int            `json:"maxPerVoteQuorum"`                            // Highest quorum a per-vote quorum fraction may resolve to, 0 for no bound
+	MissingDeviceKeyPolicy     string         `json:"missingDeviceKeyPolicy"`                      // When a vote's device key is gone at finalization: "FAIL" the transaction or "FLAG" the vote
+	RequireEnrollmentSession   bool           `json:"requireEnrollmentSession"`                    // Reject votes not bound to an unused enrollment session challenge
+	VerificationMaxAgeSeconds  int64          `json:"verificationMaxAgeSeconds"`                   // Age after which a VERIFIED device key is due for re-verification, 0 disables the check
+	PhotoStorageMode           string         `json:"photoStorageMode"`                            // "FULL" stores every photo field, "COMPACT" keeps only the hash, signature, uploader and contract-assigned state
+	EventsEnabled              bool           `json:"eventsEnabled"`                               // Emit chaincode events; when false transactions set none
+	AllowedHashAlgorithms      []string       `json:"allowedHashAlgorithms"`                       // Multihash algorithms photo CIDs may use, see multihashAlgorithms
+	RejectExpiredCertificates  bool           `json:"rejectExpiredCertificates"`                   // Flag instead of approve a vote whose device key certificate chain has expired at finalization
+	DefaultDescriptionTemplate string         `json:"defaultDescriptionTemplate"`                  // Description given to photos submitted without one when it is not signed; {n}, {uploader}, {timestamp} and {hash} are replaced, empty disables
+	MaxDescriptionBytes        int            `json:"maxDescriptionBytes"`                         // Maximum stored description size in UTF-8 bytes, checked after sanitization, 0 for no limit
+}
+
+// defaultConfig returns the settings used until an admin stores a configuration
+func defaultConfig() ContractConfig {
+	return ContractConfig{
+		AdminMSPs:           []string{"Org1MSP"},
+		VoteCooldownSeconds: 0,
+		Thresholds: VoteThresholds{
+			MinVoters:     1,
+			ApprovalRatio: 0.5,
+			TieBreak:      "PENDING",
+		},
+		DescriptionPolicy:      "STRIP",
+		MaxDescriptionLength:   512,
+		BlockDeviceSelfVote:    true,
+		MinSignatureFormat:     photoSignatureFormatV1,
+		PSSSaltLength:          rsa.PSSSaltLengthEqualsHash,
+		PhotoFlagThreshold:     0.5,
+		SignatureMode:          "STRICT",
+		MissingDeviceKeyPolicy: "FAIL",
+		PhotoStorageMode:       "FULL",
+		EventsEnabled:          true,
+		AllowedHashAlgorithms:  []string{"sha2-256"},
+	}
+}
+
+// validateConfig checks that settings are within sane bounds
+func validateConfig(config ContractConfig) error {
+	if len(config.AdminMSPs) == 0 {
+		return fmt.Errorf("at least one admin MSP must be configured")
+	}
+	if config.VoteCooldownSeconds < 0 {
+		return fmt.Errorf("vote cooldown cannot be negative")
+	}
+	if config.DescriptionPolicy != "STRIP" && config.DescriptionPolicy != "REJECT" {
+		return fmt.Errorf("unknown description policy %s", config.DescriptionPolicy)
+	}
+	if config.MissingDeviceKeyPolicy != "FAIL" && config.MissingDeviceKeyPolicy != "FLAG" {
+		return fmt.Errorf("unknown missing device key policy %s", config.MissingDeviceKeyPolicy)
+	}
+	if config.PhotoStorageMode != "FULL" && config.PhotoStorageMode != "COMPACT" {
+		return fmt.Errorf("unknown photo storage mode %s", config.PhotoStorageMode)
+	}
+	if len(config.AllowedHashAlgorithms) == 0 {
+		return fmt.Errorf("at least one hash algorithm must be allowed")
+	}
+	for _, algorithm := range config.AllowedHashAlgorithms {
+		if !isKnownHashAlgorithm(algorithm) {
+			return fmt.Errorf("unknown hash algorithm %s", algorithm)
+		}
+	}
+	switch config.SignatureMode {
+	case "STRICT", "WARN", "OFF":
+	default:
+		return fmt.Errorf("unknown signature mode %s", config.SignatureMode)
+	}
+	if config.DefaultDescriptionTemplate != "" && config.MinSignatureFormat >= photoSignatureFormatV2 {
+		return fmt.Errorf("a default description template cannot apply while signature format 2 signs every description")
+	}
+	if config.MaxDescriptionLength < 0 {
+		return fmt.Errorf("maximum description length cannot be negative")
+	}
+	if config.MaxDescriptionBytes < 0 {
+		return fmt.Errorf("maximum description size cannot be negative")
+	}
+	if config.MinSignatureFormat < photoSignatureFormatV1 || config.MinSignatureFormat > photoSignatureFormatV2 {
+		return fmt.Errorf("unknown minimum signature format %d", config.MinSignatureFormat)
+	}
+	if config.PSSSaltLength < rsa.PSSSaltLengthEqualsHash {
+		return fmt.Errorf("invalid PSS salt length %d", config.PSSSaltLength)
+	}
+	if config.MaxPendingVotesPerDevice < 0 {
+		return fmt.Errorf("maximum pending votes per device cannot be negative")
+	}
+	if config.MaxVotersPerVote < 0 {
+		return fmt.Errorf("maximum voters per vote cannot be negative")
+	}
+	if config.MaxVotersPerVote > 0 && config.MaxVotersPerVote < config.Thresholds.MinVoters {
+		return fmt.Errorf("maximum voters per vote %d is below the %d voters quorum needs", config.MaxVotersPerVote, config.Thresholds.MinVoters)
+	}
+	if config.MinPerVoteQuorum < 0 || config.MaxPerVoteQuorum < 0 {
+		return fmt.Errorf("per-vote quorum bounds cannot be negative")
+	}
+	if config.MaxPerVoteQuorum > 0 && config.MinPerVoteQuorum > config.MaxPerVoteQuorum {
+		return fmt.Errorf("minimum per-vote quorum %d exceeds the maximum %d", config.MinPerVoteQuorum, config.MaxPerVoteQuorum)
+	}
+	if config.MinDistinctUploaders < 0 {
+		return fmt.Errorf("minimum distinct uploaders cannot be negative")
+	}
+	if config.HelperDataRetentionSeconds < 0 {
+		return fmt.Errorf("helper data retention cannot be negative")
+	}
+	if config.VerificationMaxAgeSeconds < 0 {
+		return fmt.Errorf("verification max age cannot be negative")
+	}
+	if config.PhotoFlagThreshold < 0 || config.PhotoFlagThreshold > 1 {
+		return fmt.Errorf("photo flag threshold must be in [0, 1]")
+	}
+	if _, err := regexp.Compile(config.NicknamePattern); err != nil {
+		return fmt.Errorf("invalid nickname pattern: %v", err)
+	}
+	for _, anchorPEM := range config.TrustAnchors {
+		if _, _, err := parseCertificates(anchorPEM); err != nil {
+			return fmt.Errorf("invalid trust anchor: %v", err)
+		}
+	}
+	return validateThresholds(config.Thresholds)
+}
+
+// getConfig reads the contract configuration, falling back to defaults for unset fields
+func getConfig(ctx contractapi.TransactionContextInterface) (*ContractConfig, error) {
+	config := defaultConfig()
+
+	configJSON, err := ctx.GetStub().GetState(configKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contract config: %v", err)
+	}
+	if configJSON != nil {
+		err = json.Unmarshal(configJSON, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal contract config: %v", err)
+		}
+	}
+
+	return &config, nil
+}
+
+// setEvent sets a chaincode event on the transaction unless events are disabled in the configuration
+func setEvent(ctx contractapi.TransactionContextInterface, name string, payload []byte) error {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if !config.EventsEnabled {
+		return nil
+	}
+
+	return ctx.GetStub().SetEvent(name, payload)
+}
+
+// requireAdmin returns an error unless the caller belongs to a configured admin MSP
+func requireAdmin(ctx contractapi.TransactionContextInterface) error {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get client MSP ID: %v", err)
+	}
+	if !slices.Contains(config.AdminMSPs, mspID) {
+		return fmt.Errorf("caller from MSP %s is not an admin", mspID)
+	}
+
+	return nil
+}
+
+// GetConfig returns the contract configuration currently in force
+func (dr *DeviceRegistration) GetConfig(ctx contractapi.TransactionContextInterface) (*ContractConfig, error) {
+	return getConfig(ctx)
+}
+
+// SetConfig merges the given JSON settings into the current configuration (admin only)
+func (dr *DeviceRegistration) SetConfig(ctx contractapi.TransactionContextInterface, configJSON string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(configJSON), config)
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %v", err)
+	}
+
+	err = validateConfig(*config)
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	return putConfig(ctx, config)
+}
+
+// putConfig stores the contract configuration
+func putConfig(ctx contractapi.TransactionContextInterface, config *ContractConfig) error {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	return ctx.GetStub().PutState(configKey, configJSON)
+}
+
+// pssOptions returns the RSA-PSS verification options for the configured salt length
+func pssOptions(config *ContractConfig) *rsa.PSSOptions {
+	return &rsa.PSSOptions{SaltLength: config.PSSSaltLength, Hash: crypto.SHA256}
+}
+
+// requireVotingOpen returns an error while the voting circuit breaker is engaged
+func requireVotingOpen(config *ContractConfig) error {
+	if config.VotingPaused {
+		return fmt.Errorf("voting paused")
+	}
+	return nil
+}
+
+// SetVotingPaused engages or releases the voting circuit breaker (admin only)
+func (dr *DeviceRegistration) SetVotingPaused(ctx contractapi.TransactionContextInterface, paused bool) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	config.VotingPaused = paused
+	return putConfig(ctx, config)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestVotingPauseBlocksWritesAndAllowsReads(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "before-pause")
+
+	requireError(t, e.dr.SetVotingPaused(e.ctx("voter-1", "Org2MSP"), true))
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), true))
+
+	err := e.dr.CastVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true)
+	if err == nil || !strings.Contains(err.Error(), "voting paused") {
+		t.Fatalf("CastVote while paused: %v", err)
+	}
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 1).photo("during-pause")}, newTestDevice(t, 1).publicKey)
+	if err == nil || !strings.Contains(err.Error(), "voting paused") {
+		t.Fatalf("StartPhotoVote while paused: %v", err)
+	}
+
+	if _, err := e.dr.GetVoteStatus(e.ctx("voter-1", "Org1MSP"), vote.VoteId); err != nil {
+		t.Fatalf("read while paused: %v", err)
+	}
+	if _, err := e.dr.GetPhotoMetadata(e.ctx("voter-1", "Org1MSP"), vote.PhotoIPFSHashes[0]); err != nil {
+		t.Fatalf("photo read while paused: %v", err)
+	}
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), false))
+	e.cast(vote.VoteId, "voter-1", true)
+}
+
+func TestPSSSaltLengthIsExplicit(t *testing.T) {
+	device := newTestDevice(t, 0)
+	photo := device.photo("salted")
+	hashed := sha256.Sum256([]byte(photoSigningPayload(photo)))
+	signature, err := rsa.SignPSS(rand.Reader, device.key, crypto.SHA256, hashed[:], &rsa.PSSOptions{SaltLength: 20})
+	requireNoError(t, err)
+	photo.Signature = hex.EncodeToString(signature)
+
+	cases := []struct {
+		configJSON string
+		valid      bool
+	}{
+		{`{}`, false}, // The default expects the hash length, 32 bytes
+		{`{"pssSaltLength": 20}`, true},
+		{`{"pssSaltLength": 16}`, false},
+		{`{"pssSaltLength": 0}`, true}, // Auto-detection accepts any salt length
+	}
+	for _, c := range cases {
+		e := newTestEnv(t)
+		e.setConfig(c.configJSON)
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		if (err == nil) != c.valid {
+			t.Errorf("config %s: StartPhotoVote error %v, expected valid %v", c.configJSON, err, c.valid)
+		}
+	}
+
+	e := newTestEnv(t)
+	requireError(t, e.dr.SetConfig(e.admin(), `{"pssSaltLength": -2}`))
+}
+
+func TestEventsEnabledToggle(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "events")
+	e.lastEvent()
+
+	e.setConfig(`{"eventsEnabled": false}`)
+	e.lastEvent()
+	e.cast(vote.VoteId, "voter-1", true)
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+	if event := e.lastEvent(); event != "" {
+		t.Fatalf("event %q set while events are disabled", event)
+	}
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("disabling events changed the outcome to %s", got)
+	}
+
+	e.setConfig(`{"eventsEnabled": true}`)
+	e.lastEvent()
+	other := newTestDevice(t, 1)
+	e.startVote(other, "events-enabled")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), other.hash, "compromised"))
+	if event := e.lastEvent(); event != "DeviceRevoked" {
+		t.Fatalf("last event %q with events enabled, want DeviceRevoked", event)
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// VoteThresholds are the consensus parameters a vote tally is evaluated against
+type VoteThresholds struct {
+	MinVoters     int     `json:"minVoters"`     // Quorum: votes required before a decision is made
+	ApprovalRatio float64 `json:"approvalRatio"` // Share of valid votes that must be exceeded for approval
+	TieBreak      string  `json:"tieBreak"`      // "PENDING", "APPROVE" or "REJECT" when valid and invalid votes are equal
+	RejectOnRatio bool    `json:"rejectOnRatio"` // Reject a vote whose quorate tally misses the ratio; otherwise it stays PENDING for more votes
+}
+
+// VoteOutcome explains how the consensus rules were applied to a vote's tally
+type VoteOutcome struct {
+	VoteId          string         `json:"voteId"`
+	Status          VoteStatus     `json:"status"`                                   // Status the tally resolves to
+	Thresholds      VoteThresholds `json:"thresholds"`                               // Thresholds the tally was evaluated against
+	QuorumMet       bool           `json:"quorumMet"`                                // Whether enough votes were cast
+	ValidRatio      float64        `json:"validRatio"`                               // Share of valid votes in the tally
+	RatioMet        bool           `json:"ratioMet"`                                 // Whether the valid share exceeded the approval ratio
+	TieBreakApplied bool           `json:"tieBreakApplied"`                          // Whether the tie-break rule decided the outcome
+	Reason          string         `json:"reason"`                                   // Human-readable summary of the decision
+	GraceOpen       bool           `json:"graceOpen,omitempty" metadata:",optional"` // Whether the tally is decided but still inside the post-quorum grace votes
+}
+
+// validateThresholds checks consensus parameters for consistency
+func validateThresholds(thresholds VoteThresholds) error {
+	if thresholds.MinVoters < 1 {
+		return fmt.Errorf("minimum voters must be at least 1")
+	}
+	if thresholds.ApprovalRatio < 0 || thresholds.ApprovalRatio >= 1 {
+		return fmt.Errorf("approval ratio must be in [0, 1)")
+	}
+	switch thresholds.TieBreak {
+	case "PENDING", "APPROVE", "REJECT":
+	default:
+		return fmt.Errorf("unknown tie-break rule %s", thresholds.TieBreak)
+	}
+	return nil
+}
+
+// evaluateVote applies the thresholds to the vote's current tally
+func evaluateVote(vote *PhotoVote, thresholds VoteThresholds) VoteOutcome {
+	outcome := VoteOutcome{
+		VoteId:     vote.VoteId,
+		Status:     VoteStatusPending,
+		Thresholds: thresholds,
+		QuorumMet:  vote.VoteCount >= thresholds.MinVoters,
+	}
+	if vote.VoteCount > 0 {
+		outcome.ValidRatio = float64(vote.ValidVotes) / float64(vote.VoteCount)
+	}
+	outcome.RatioMet = vote.VoteCount > 0 && outcome.ValidRatio > thresholds.ApprovalRatio
+
+	switch {
+	case !outcome.QuorumMet:
+		outcome.Reason = fmt.Sprintf("quorum not met: %d of %d votes cast", vote.VoteCount, thresholds.MinVoters)
+	case outcome.RatioMet:
+		outcome.Status = VoteStatusApproved
+		outcome.Reason = fmt.Sprintf("valid ratio %.2f exceeds %.2f", outcome.ValidRatio, thresholds.ApprovalRatio)
+	case vote.ValidVotes == vote.InvalidVotes:
+		outcome.TieBreakApplied = true
+		switch thresholds.TieBreak {
+		case "APPROVE":
+			outcome.Status = VoteStatusApproved
+		case "REJECT":
+			outcome.Status = VoteStatusRejected
+		}
+		outcome.Reason = fmt.Sprintf("tie of %d votes resolved by %s rule", vote.ValidVotes, thresholds.TieBreak)
+	case thresholds.RejectOnRatio:
+		outcome.Status = VoteStatusRejected
+		outcome.Reason = fmt.Sprintf("valid ratio %.2f does not exceed %.2f", outcome.ValidRatio, thresholds.ApprovalRatio)
+	default:
+		outcome.Reason = fmt.Sprintf("valid ratio %.2f does not exceed %.2f, waiting for more votes", outcome.ValidRatio, thresholds.ApprovalRatio)
+	}
+
+	// Approval additionally needs an absolute number of valid votes when the vote sets one
+	if outcome.Status == VoteStatusApproved && vote.ValidVotes < vote.MinValidVotes {
+		outcome.Status = VoteStatusPending
+		outcome.Reason = fmt.Sprintf("minimum valid votes not met: %d of %d", vote.ValidVotes, vote.MinValidVotes)
+	}
+
+	// A decided tally keeps accepting the vote's grace votes past quorum before it is settled
+	if outcome.Status != VoteStatusPending && vote.VoteCount < thresholds.MinVoters+vote.GraceVotes {
+		outcome.GraceOpen = true
+		outcome.Reason = fmt.Sprintf("grace period open: %d of %d additional votes cast, tally would resolve %s", vote.VoteCount-thresholds.MinVoters, vote.GraceVotes, outcome.Status)
+		outcome.Status = VoteStatusPending
+	}
+
+	return outcome
+}
+
+// ExplainVoteOutcome describes which consensus conditions a vote met and why it resolved as it did
+func (dr *DeviceRegistration) ExplainVoteOutcome(ctx contractapi.TransactionContextInterface, voteId string) (*VoteOutcome, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finalized votes keep the explanation recorded when they were decided
+	if vote.Outcome != nil {
+		return vote.Outcome, nil
+	}
+
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return nil, err
+	}
+
+	outcome := evaluateVote(vote, thresholds)
+	return &outcome, nil
+}
+
+// effectiveThresholds resolves the consensus parameters that apply to a vote
+func effectiveThresholds(ctx contractapi.TransactionContextInterface, vote *PhotoVote) (VoteThresholds, error) {
+	if vote.Outcome != nil {
+		return vote.Outcome.Thresholds, nil
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return VoteThresholds{}, err
+	}
+
+	return configuredThresholds(vote, config), nil
+}
+
+// configuredThresholds returns the configured thresholds with a vote's quorum fraction applied
+func configuredThresholds(vote *PhotoVote, config *ContractConfig) VoteThresholds {
+	thresholds := config.Thresholds
+	if vote.QuorumFraction > 0 {
+		thresholds.MinVoters = fractionQuorum(vote.QuorumFraction, len(vote.EligibleVoters))
+	}
+	return thresholds
+}
+
+// consensusRuleFor names the rule a vote with the given minimum valid votes is evaluated under
+func consensusRuleFor(minValidVotes int) ConsensusRule {
+	if minValidVotes > 0 {
+		return ConsensusRuleRatioMinValid
+	}
+	return ConsensusRuleRatio
+}
+
+// voteConsensusRule returns a vote's consensus rule, deriving it for votes started before it was recorded
+func voteConsensusRule(vote *PhotoVote) ConsensusRule {
+	if vote.ConsensusRule != "" {
+		return vote.ConsensusRule
+	}
+	return consensusRuleFor(vote.MinValidVotes)
+}
+
+// EffectiveThresholds are the consensus parameters in force for one vote, with the per-vote rules applied on top
+type EffectiveThresholds struct {
+	VoteId        string         `json:"voteId"`
+	Thresholds    VoteThresholds `json:"thresholds"`
+	Source        string         `json:"source"`        // "FINALIZED" when recorded at finalization, "QUORUM_FRACTION" when quorum is a share of the eligible voters, otherwise "CONFIG"
+	MinValidVotes int            `json:"minValidVotes"` // Valid votes required for approval in addition to the ratio
+	GraceVotes    int            `json:"graceVotes"`    // Votes accepted past quorum before the decision is settled
+	ConsensusRule ConsensusRule  `json:"consensusRule"` // Approval rule the vote is evaluated under
+}
+
+// GetEffectiveThresholds returns the thresholds a vote is evaluated against and where they come from
+func (dr *DeviceRegistration) GetEffectiveThresholds(ctx contractapi.TransactionContextInterface, voteId string) (*EffectiveThresholds, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return nil, err
+	}
+
+	source := "CONFIG"
+	switch {
+	case vote.Outcome != nil:
+		source = "FINALIZED"
+	case vote.QuorumFraction > 0:
+		source = "QUORUM_FRACTION"
+	}
+
+	return &EffectiveThresholds{
+		VoteId:        vote.VoteId,
+		Thresholds:    thresholds,
+		Source:        source,
+		MinValidVotes: vote.MinValidVotes,
+		GraceVotes:    vote.GraceVotes,
+		ConsensusRule: voteConsensusRule(vote),
+	}, nil
+}
+
+// VoteProgress is a compact view of a vote's tally for polling clients
+type VoteProgress struct {
+	VoteCount          int        `json:"voteCount"`
+	ValidVotes         int        `json:"validVotes"`
+	InvalidVotes       int        `json:"invalidVotes"`
+	Status             VoteStatus `json:"status"`
+	QuorumReached      bool       `json:"quorumReached"`
+	RemainingForQuorum int        `json:"remainingForQuorum"` // Votes still needed before a decision can be made
+}
+
+// GetVoteProgress returns the tally of a vote and how many more votes quorum needs
+func (dr *DeviceRegistration) GetVoteProgress(ctx contractapi.TransactionContextInterface, voteId string) (*VoteProgress, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VoteProgress{
+		VoteCount:          vote.VoteCount,
+		ValidVotes:         vote.ValidVotes,
+		InvalidVotes:       vote.InvalidVotes,
+		Status:             vote.Status,
+		QuorumReached:      vote.VoteCount >= thresholds.MinVoters,
+		RemainingForQuorum: max(thresholds.MinVoters-vote.VoteCount, 0),
+	}, nil
+}
+
+// VoteResult is the canonical record of a finalized vote covered by its result hash
+type VoteResult struct {
+	VoteId          string     `json:"voteId"`
+	Status          VoteStatus `json:"status"`
+	DevicePublicKey string     `json:"devicePublicKey"`
+	PhotoIPFSHashes []string   `json:"photoIPFSHashes"`
+	VoteCount       int        `json:"voteCount"`
+	ValidVotes      int        `json:"validVotes"`
+	InvalidVotes    int        `json:"invalidVotes"`
+	Voters          []string   `json:"voters"`
+	FinalizedTxId   string     `json:"finalizedTxId"`
+	FinalizedAt     string     `json:"finalizedAt"`
+	ClosureReason   string     `json:"closureReason,omitempty"`
+	PriorRounds     int        `json:"priorRounds,omitempty"` // Inconclusive rounds before the deciding one
+}
+
+// canonicalVoteResult serializes the result fields of a finalized vote deterministically
+func canonicalVoteResult(vote *PhotoVote) ([]byte, error) {
+	result := VoteResult{
+		VoteId:          vote.VoteId,
+		Status:          vote.Status,
+		DevicePublicKey: vote.DevicePublicKey,
+		PhotoIPFSHashes: vote.PhotoIPFSHashes,
+		VoteCount:       vote.VoteCount,
+		ValidVotes:      vote.ValidVotes,
+		InvalidVotes:    vote.InvalidVotes,
+		Voters:          vote.Voters,
+		FinalizedTxId:   vote.FinalizedTxId,
+		FinalizedAt:     vote.FinalizedAt,
+		ClosureReason:   vote.ClosureReason,
+		PriorRounds:     len(vote.Rounds),
+	}
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal vote result: %v", err)
+	}
+	return resultJSON, nil
+}
+
+// Reasons recorded in ClosureReason when a vote ends; "EXPIRED" and "MERGED" are reserved for closure
+// paths that do not exist yet
+const (
+	ClosureQuorum = "QUORUM" // A cast decided the vote and it finalized automatically
+	ClosureAdmin  = "ADMIN"  // An admin finalized or re-evaluated the vote
+)
+
+// finalizeVote moves a vote to its decided status and records why it closed, the finalizing transaction
+// and result hash; a vote whose photos were removed or altered is marked FLAGGED with a FlagReason and
+// no closure reason instead, as is one whose device key is missing under the FLAG missing device key policy
+func finalizeVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote, outcome VoteOutcome, closureReason string) error {
+	// A device key removed out of band can neither back the signature checks nor be verified
+	deviceKey, err := findDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil {
+		return err
+	}
+	if deviceKey == nil {
+		config, err := getConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if config.MissingDeviceKeyPolicy != "FLAG" {
+			return fmt.Errorf("device key %s of vote %s no longer exists, so the vote cannot be finalized", vote.DevicePublicKey, vote.VoteId)
+		}
+		vote.Status = VoteStatusFlagged
+		vote.FlagReason = fmt.Sprintf("device key %s no longer exists", vote.DevicePublicKey)
+		return nil
+	}
+
+	issue, err := checkVotePhotos(ctx, vote)
+	if err != nil {
+		return err
+	}
+	if issue != "" {
+		vote.Status = VoteStatusFlagged
+		vote.FlagReason = issue
+		return nil
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	// An approval must not restore a device key that was revoked or rotated away while the vote was open
+	if outcome.Status == VoteStatusApproved && (deviceKey.Status == DeviceStatusRevoked || deviceKey.Status == DeviceStatusRotated) {
+		vote.Status = VoteStatusFlagged
+		vote.FlagReason = fmt.Sprintf("device key %s cannot be approved: it is %s", vote.DevicePublicKey, deviceKey.Status)
+		return nil
+	}
+
+	// An approval must not verify a device whose certificate has run out since the vote started
+	if outcome.Status == VoteStatusApproved && len(deviceKey.CertificateChain) > 0 {
+		config, err := getConfig(ctx)
+		if err != nil {
+			return err
+		}
+		if config.RejectExpiredCertificates {
+			expired, err := expiredCertificate(deviceKey.CertificateChain, txTime)
+			if err != nil {
+				return err
+			}
+			if expired != "" {
+				vote.Status = VoteStatusFlagged
+				vote.FlagReason = fmt.Sprintf("device key %s cannot be approved: %s", vote.DevicePublicKey, expired)
+				return nil
+			}
+		}
+	}
+
+	finalizerID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	vote.Status = outcome.Status
+	vote.ClosureReason = closureReason
+	vote.Outcome = &outcome
+	vote.FinalizedTxId = ctx.GetStub().GetTxID()
+	vote.FinalizedAt = txTime.Format(time.RFC3339)
+	vote.FinalizedBy = finalizerID
+
+	resultJSON, err := canonicalVoteResult(vote)
+	if err != nil {
+		return err
+	}
+	resultHash := sha256.Sum256(resultJSON)
+	vote.ResultHash = hex.EncodeToString(resultHash[:])
+
+	return putResultHashRef(ctx, vote)
+}
+
+// putResultHashRef records which vote produced a result hash
+func putResultHashRef(ctx contractapi.TransactionContextInterface, vote *PhotoVote) error {
+	refKey, err := ctx.GetStub().CreateCompositeKey("VoteByResultHash", []string{vote.ResultHash})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for result hash index: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(refKey, []byte(vote.VoteId))
+	if err != nil {
+		return fmt.Errorf("failed to store result hash index entry: %v", err)
+	}
+
+	return nil
+}
+
+// GetVoteByResultHash returns the finalized vote whose canonical result hashes to resultHash
+func (dr *DeviceRegistration) GetVoteByResultHash(ctx contractapi.TransactionContextInterface, resultHash string) (*PhotoVote, error) {
+	refKey, err := ctx.GetStub().CreateCompositeKey("VoteByResultHash", []string{strings.ToLower(resultHash)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for result hash index: %v", err)
+	}
+
+	voteId, err := ctx.GetStub().GetState(refKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result hash index: %v", err)
+	}
+	if voteId == nil {
+		return nil, fmt.Errorf("no vote produced result hash %s", resultHash)
+	}
+
+	return getVote(ctx, string(voteId))
+}
+
+// RebuildResultHashIndex indexes the result hash of every finalized vote, for votes finalized before the
+// index existed (admin only); it returns the number of votes indexed
+func (dr *DeviceRegistration) RebuildResultHashIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, vote := range votes {
+		if vote.ResultHash == "" {
+			continue
+		}
+		err = putResultHashRef(ctx, vote)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+
+	return indexed, nil
+}
+
+// settleVote finalizes a decided vote, or marks it READY to await FinalizeVote when it does not finalize automatically
+func settleVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote, outcome VoteOutcome, closureReason string) error {
+	if !vote.AutoFinalize {
+		vote.Status = VoteStatusReady
+		return nil
+	}
+	return finalizeVote(ctx, vote, outcome, closureReason)
+}
+
+// DeviceVerifiedEvent is the payload of the DeviceVerified chaincode event; listeners can check
+// ResultHash against the SHA-256 of CanonicalResult and against a later GetVoteResultProof
+type DeviceVerifiedEvent struct {
+	PublicKeyHash   string `json:"publicKeyHash"`
+	VoteId          string `json:"voteId"`
+	ResultHash      string `json:"resultHash"`
+	CanonicalResult string `json:"canonicalResult"` // JSON whose SHA-256 is ResultHash
+}
+
+// verifyApprovedDevice marks the device key of an APPROVED vote as VERIFIED and emits DeviceVerified
+func verifyApprovedDevice(ctx contractapi.TransactionContextInterface, vote *PhotoVote) error {
+	if vote.Status != VoteStatusApproved {
+		return nil
+	}
+
+	deviceKey, err := getDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil {
+		return err
+	}
+
+	previousStatus := deviceKey.Status
+	err = setDeviceVerified(ctx, deviceKey)
+	if err != nil {
+		return err
+	}
+	err = putDeviceKey(ctx, deviceKey, previousStatus)
+	if err != nil {
+		return fmt.Errorf("failed to update device key status: %v", err)
+	}
+
+	resultJSON, err := canonicalVoteResult(vote)
+	if err != nil {
+		return err
+	}
+
+	// Struct fields marshal in declaration order, so every peer emits identical bytes
+	eventJSON, err := json.Marshal(DeviceVerifiedEvent{
+		PublicKeyHash:   vote.DevicePublicKey,
+		VoteId:          vote.VoteId,
+		ResultHash:      vote.ResultHash,
+		CanonicalResult: string(resultJSON),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	return setEvent(ctx, "DeviceVerified", eventJSON)
+}
+
+// FinalizeVote applies the consensus rule to a pending or READY vote and finalizes it once it is decided,
+// after confirming its photos are still intact (admin only, refused while voting is paused)
+func (dr *DeviceRegistration) FinalizeVote(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = requireVotingOpen(config)
+	if err != nil {
+		return nil, err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+	if vote.Status != VoteStatusPending && vote.Status != VoteStatusReady {
+		return nil, fmt.Errorf("vote %s is not pending", voteId)
+	}
+
+	outcome, err := reevaluateVote(ctx, vote, true)
+	if err != nil {
+		return nil, err
+	}
+	if outcome.Status == VoteStatusPending {
+		return nil, fmt.Errorf("vote %s has not reached a decision: %s", voteId, outcome.Reason)
+	}
+
+	return vote, nil
+}
+
+// reevaluateVote applies the effective thresholds to a pending vote and, when it is decided, settles
+// and stores it; force finalizes even a vote that does not finalize automatically. Only admin actions
+// re-evaluate votes, so a vote closed here records the ADMIN closure reason.
+func reevaluateVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote, force bool) (VoteOutcome, error) {
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return VoteOutcome{}, err
+	}
+
+	outcome := evaluateVote(vote, thresholds)
+	if outcome.Status == VoteStatusPending {
+		return outcome, nil
+	}
+	previousStatus := vote.Status
+
+	if force {
+		err = finalizeVote(ctx, vote, outcome, ClosureAdmin)
+	} else {
+		err = settleVote(ctx, vote, outcome, ClosureAdmin)
+	}
+	if err != nil {
+		return VoteOutcome{}, err
+	}
+
+	err = verifyApprovedDevice(ctx, vote)
+	if err != nil {
+		return VoteOutcome{}, err
+	}
+
+	return outcome, putVote(ctx, vote, previousStatus)
+}
+
+// ReevaluationSummary reports the effect of re-running consensus over pending votes
+type ReevaluationSummary struct {
+	Evaluated      int            `json:"evaluated"`
+	Changed        int            `json:"changed"`
+	StatusCounts   map[string]int `json:"statusCounts"` // New status -> number of votes that moved to it
+	ChangedVoteIds []string       `json:"changedVoteIds"`
+}
+
+// ReevaluateAllPending applies the current consensus rule to every pending vote and settles
+// those that now qualify (admin only, refused while voting is paused)
+func (dr *DeviceRegistration) ReevaluateAllPending(ctx contractapi.TransactionContextInterface) (*ReevaluationSummary, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = requireVotingOpen(config)
+	if err != nil {
+		return nil, err
+	}
+
+	votes, err := getVotesByStatus(ctx, VoteStatusPending)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ReevaluationSummary{
+		StatusCounts:   make(map[string]int),
+		ChangedVoteIds: make([]string, 0),
+	}
+	for _, vote := range votes {
+		summary.Evaluated++
+
+		_, err := reevaluateVote(ctx, vote, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-evaluate vote %s: %v", vote.VoteId, err)
+		}
+		if vote.Status != VoteStatusPending {
+			summary.Changed++
+			summary.StatusCounts[string(vote.Status)]++
+			summary.ChangedVoteIds = append(summary.ChangedVoteIds, vote.VoteId)
+		}
+	}
+
+	return summary, nil
+}
+
+// VoteResultProof lets an off-chain party recompute a vote's result hash and locate the finalizing transaction
+type VoteResultProof struct {
+	VoteId          string `json:"voteId"`
+	CanonicalResult string `json:"canonicalResult"` // JSON whose SHA-256 is ResultHash
+	ResultHash      string `json:"resultHash"`
+	FinalizedTxId   string `json:"finalizedTxId"`
+	FinalizedAt     string `json:"finalizedAt"`
+	ChannelId       string `json:"channelId"`
+}
+
+// GetVoteResultProof returns the canonical result of a finalized vote with its hash and finalizing transaction
+func (dr *DeviceRegistration) GetVoteResultProof(ctx contractapi.TransactionContextInterface, voteId string) (*VoteResultProof, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+	if vote.ResultHash == "" {
+		return nil, fmt.Errorf("vote %s has not been finalized", voteId)
+	}
+
+	resultJSON, err := canonicalVoteResult(vote)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VoteResultProof{
+		VoteId:          vote.VoteId,
+		CanonicalResult: string(resultJSON),
+		ResultHash:      vote.ResultHash,
+		FinalizedTxId:   vote.FinalizedTxId,
+		FinalizedAt:     vote.FinalizedAt,
+		ChannelId:       ctx.GetStub().GetChannelID(),
+	}, nil
+}
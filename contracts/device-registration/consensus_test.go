@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDefaultThresholdsKeepRatioMissingVotePending(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "default-thresholds")
+
+	e.cast(vote.VoteId, "voter-1", false)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("status after one invalid ballot = %s, want PENDING", got)
+	}
+
+	e.cast(vote.VoteId, "voter-2", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("status after a tie = %s, want PENDING", got)
+	}
+
+	e.cast(vote.VoteId, "voter-3", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("status once valid ballots outnumber invalid = %s, want APPROVED", got)
+	}
+}
+
+func TestRejectOnRatioRejectsQuorateVote(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 1, "approvalRatio": 0.5, "tieBreak": "PENDING", "rejectOnRatio": true}}`)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "reject-on-ratio")
+
+	e.cast(vote.VoteId, "voter-1", false)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusRejected {
+		t.Fatalf("status = %s, want REJECTED", got)
+	}
+}
+
+func TestClosureReasonRecordsHowVoteEnded(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+
+	quorum := e.startVote(device, "closed-by-quorum")
+	e.cast(quorum.VoteId, "voter-1", true)
+	if got := e.vote(quorum.VoteId).ClosureReason; got != ClosureQuorum {
+		t.Fatalf("closure reason after a deciding cast = %q, want %q", got, ClosureQuorum)
+	}
+
+	manual := e.startVoteWithOptions(device, `{"autoFinalize": false}`, "closed-by-admin")
+	e.cast(manual.VoteId, "voter-1", true)
+	_, err := e.dr.FinalizeVote(e.admin(), manual.VoteId)
+	requireNoError(t, err)
+	if got := e.vote(manual.VoteId).ClosureReason; got != ClosureAdmin {
+		t.Fatalf("closure reason after FinalizeVote = %q, want %q", got, ClosureAdmin)
+	}
+}
+
+func TestFinalizedByRecordsTriggeringIdentity(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+
+	cast := e.startVote(device, "finalized-by-cast")
+	if got := e.vote(cast.VoteId).FinalizedBy; got != "" {
+		t.Fatalf("pending vote finalized by %q", got)
+	}
+	e.cast(cast.VoteId, "voter-1", true)
+	status, err := e.dr.GetVoteStatus(e.ctx("user", "Org2MSP"), cast.VoteId)
+	requireNoError(t, err)
+	if status.FinalizedBy != "voter-1" {
+		t.Fatalf("cast-finalized vote finalized by %q, want voter-1", status.FinalizedBy)
+	}
+
+	manual := e.startVoteWithOptions(device, `{"autoFinalize": false}`, "finalized-by-admin")
+	e.cast(manual.VoteId, "voter-2", true)
+	_, err = e.dr.FinalizeVote(e.ctx("other-admin", "Org1MSP"), manual.VoteId)
+	requireNoError(t, err)
+	status, err = e.dr.GetVoteStatus(e.ctx("user", "Org2MSP"), manual.VoteId)
+	requireNoError(t, err)
+	if status.FinalizedBy != "other-admin" {
+		t.Fatalf("admin-finalized vote finalized by %q, want other-admin", status.FinalizedBy)
+	}
+}
+
+func TestReevaluateAllPendingRecordsAdminClosure(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "reevaluated")
+	e.cast(vote.VoteId, "voter-1", true)
+
+	e.setConfig(`{"thresholds": {"minVoters": 1, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	_, err := e.dr.ReevaluateAllPending(e.admin())
+	requireNoError(t, err)
+	if got := e.vote(vote.VoteId); got.Status != VoteStatusApproved || got.ClosureReason != ClosureAdmin {
+		t.Fatalf("re-evaluated vote status %s, closure reason %q", got.Status, got.ClosureReason)
+	}
+}
+
+func TestFlaggedVoteHasNoClosureReason(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "flagged")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+
+	e.cast(vote.VoteId, "voter-1", true)
+	got := e.vote(vote.VoteId)
+	if got.Status != VoteStatusFlagged || got.FlagReason == "" || got.ClosureReason != "" {
+		t.Fatalf("flagged vote status %s, flag reason %q, closure reason %q", got.Status, got.FlagReason, got.ClosureReason)
+	}
+}
+
+func TestFinalizeVoteRequiresAdminAndOpenVoting(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"autoFinalize": false}`, "ready")
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusReady {
+		t.Fatalf("status = %s, want READY", got)
+	}
+
+	_, err := e.dr.FinalizeVote(e.ctx("voter-1", "Org2MSP"), vote.VoteId)
+	requireError(t, err)
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), true))
+	_, err = e.dr.FinalizeVote(e.admin(), vote.VoteId)
+	requireError(t, err)
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), false))
+	_, err = e.dr.FinalizeVote(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("status = %s, want APPROVED", got)
+	}
+}
+
+func TestPendingVoteOmitsFinalizationFields(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "pending")
+
+	var fields map[string]json.RawMessage
+	requireNoError(t, json.Unmarshal(e.getState("PhotoVote", vote.VoteId), &fields))
+	for _, field := range []string{"closureReason", "resultHash", "finalizedTxId", "finalizedAt"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("pending vote stores %s", field)
+		}
+	}
+
+	// The contract API validates returned votes against the metadata, which must not require the fields
+	response := e.invoke("GetVoteStatus", vote.VoteId)
+	if response.Status != 200 {
+		t.Fatalf("GetVoteStatus on a pending vote: %s", response.Message)
+	}
+}
+
+func TestExplainVoteOutcomeReportsEachCondition(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "REJECT", "rejectOnRatio": true}}`)
+	approved := e.startVote(newTestDevice(t, 0), "approved")
+	rejected := e.startVote(newTestDevice(t, 1), "rejected")
+	tied := e.startVote(newTestDevice(t, 2), "tied")
+	short := e.startVote(newTestDevice(t, 3), "short")
+
+	e.cast(approved.VoteId, "voter-1", true)
+	e.cast(approved.VoteId, "voter-2", true)
+	e.cast(rejected.VoteId, "voter-1", false)
+	e.cast(rejected.VoteId, "voter-2", false)
+	e.cast(tied.VoteId, "voter-1", true)
+	e.cast(tied.VoteId, "voter-2", false)
+	e.cast(short.VoteId, "voter-1", true)
+
+	explain := func(voteId string) *VoteOutcome {
+		outcome, err := e.dr.ExplainVoteOutcome(e.admin(), voteId)
+		requireNoError(t, err)
+		return outcome
+	}
+
+	if outcome := explain(approved.VoteId); outcome.Status != VoteStatusApproved || !outcome.QuorumMet || !outcome.RatioMet || outcome.ValidRatio != 1 {
+		t.Fatalf("approved outcome %+v", outcome)
+	}
+	if outcome := explain(rejected.VoteId); outcome.Status != VoteStatusRejected || !outcome.QuorumMet || outcome.RatioMet || outcome.TieBreakApplied {
+		t.Fatalf("ratio-rejected outcome %+v", outcome)
+	}
+	if outcome := explain(tied.VoteId); outcome.Status != VoteStatusRejected || !outcome.TieBreakApplied {
+		t.Fatalf("tie-broken outcome %+v", outcome)
+	}
+	if outcome := explain(short.VoteId); outcome.Status != VoteStatusPending || outcome.QuorumMet || outcome.Thresholds.MinVoters != 2 {
+		t.Fatalf("quorum-short outcome %+v", outcome)
+	}
+}
+
+func TestGetVoteProgressAcrossTallies(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "progress")
+	progress := func() *VoteProgress {
+		progress, err := e.dr.GetVoteProgress(e.admin(), vote.VoteId)
+		requireNoError(t, err)
+		return progress
+	}
+
+	if p := progress(); p.VoteCount != 0 || p.QuorumReached || p.RemainingForQuorum != 3 || p.Status != VoteStatusPending {
+		t.Fatalf("empty tally %+v", p)
+	}
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", false)
+	if p := progress(); p.ValidVotes != 1 || p.InvalidVotes != 1 || p.QuorumReached || p.RemainingForQuorum != 1 {
+		t.Fatalf("partial tally %+v", p)
+	}
+	e.cast(vote.VoteId, "voter-3", true)
+	if p := progress(); p.VoteCount != 3 || !p.QuorumReached || p.RemainingForQuorum != 0 || p.Status != VoteStatusApproved {
+		t.Fatalf("decided tally %+v", p)
+	}
+
+	_, err := e.dr.GetVoteProgress(e.admin(), "vote-missing")
+	requireError(t, err)
+}
+
+func TestVoteResultProofReferencesFinalizingTransaction(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "proof")
+	_, err := e.dr.GetVoteResultProof(e.admin(), vote.VoteId)
+	requireError(t, err)
+
+	e.cast(vote.VoteId, "voter-1", true)
+	finalizingTx := fmt.Sprintf("tx-%d", e.txs)
+	proof, err := e.dr.GetVoteResultProof(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if proof.FinalizedTxId != finalizingTx || proof.ResultHash != e.vote(vote.VoteId).ResultHash {
+		t.Fatalf("proof %+v, expected finalizing transaction %s", proof, finalizingTx)
+	}
+	if hash := fmt.Sprintf("%x", sha256.Sum256([]byte(proof.CanonicalResult))); hash != proof.ResultHash {
+		t.Fatalf("canonical result hashes to %s, proof carries %s", hash, proof.ResultHash)
+	}
+}
+
+func TestFinalizeVoteFlagsRemovedOrAlteredPhotos(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	removed := e.startVoteWithOptions(device, `{"autoFinalize": false}`, "kept", "removed")
+	altered := e.startVoteWithOptions(device, `{"autoFinalize": false}`, "altered")
+	e.cast(removed.VoteId, "voter-1", true)
+	e.cast(altered.VoteId, "voter-1", true)
+
+	e.delState("Photo", testCID("removed"))
+	photo := device.photo("altered")
+	photo.TimeStamp = "2025-01-02T00:00:00Z"
+	e.putState("Photo", []string{photo.IPFSHash}, photo)
+
+	for _, voteId := range []string{removed.VoteId, altered.VoteId} {
+		_, err := e.dr.FinalizeVote(e.admin(), voteId)
+		requireNoError(t, err)
+		vote := e.vote(voteId)
+		if vote.Status != VoteStatusFlagged || vote.FlagReason == "" || vote.ClosureReason != "" {
+			t.Fatalf("vote %s finalized over a changed photo: status %s, flag reason %q", voteId, vote.Status, vote.FlagReason)
+		}
+	}
+	if status := e.deviceKey(device.hash).Status; status == DeviceStatusVerified {
+		t.Fatal("device verified through a vote over a changed photo")
+	}
+}
+
+func TestReevaluateAllPendingSummarizesLoweredThreshold(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	approved := e.startVote(newTestDevice(t, 0), "approved")
+	e.cast(approved.VoteId, "voter-1", true)
+	e.cast(approved.VoteId, "voter-2", true)
+	rejected := e.startVote(newTestDevice(t, 1), "rejected")
+	e.cast(rejected.VoteId, "voter-1", false)
+	e.cast(rejected.VoteId, "voter-2", false)
+	short := e.startVote(newTestDevice(t, 2), "short")
+	e.cast(short.VoteId, "voter-1", true)
+
+	_, err := e.dr.ReevaluateAllPending(e.ctx("voter-1", "Org2MSP"))
+	requireError(t, err)
+
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING", "rejectOnRatio": true}}`)
+	summary, err := e.dr.ReevaluateAllPending(e.admin())
+	requireNoError(t, err)
+	if summary.Evaluated != 3 || summary.Changed != 2 || summary.StatusCounts[string(VoteStatusApproved)] != 1 || summary.StatusCounts[string(VoteStatusRejected)] != 1 {
+		t.Fatalf("re-evaluation summary %+v", summary)
+	}
+	if !slices.Contains(summary.ChangedVoteIds, approved.VoteId) || !slices.Contains(summary.ChangedVoteIds, rejected.VoteId) {
+		t.Fatalf("changed votes %v", summary.ChangedVoteIds)
+	}
+	if got := e.vote(short.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("vote below the lowered quorum moved to %s", got)
+	}
+}
+
+func TestMinValidVotesKeepsMajorityPending(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"minValidVotes": 3}`, "min-valid")
+
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", true)
+	e.cast(vote.VoteId, "voter-3", false)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("status with a majority but two of three valid votes %s", got)
+	}
+	e.cast(vote.VoteId, "voter-4", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("status at the minimum valid votes %s", got)
+	}
+
+	_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 1).photo("unreachable")}, newTestDevice(t, 1).publicKey, `{"eligibleVoters": ["voter-1", "voter-2"], "minValidVotes": 3}`)
+	requireError(t, err)
+}
+
+func TestMinValidVotesBoundedByBallotCap(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxVotersPerVote": 5}`)
+	device := newTestDevice(t, 0)
+	start := func(name string, optionsJSON string) error {
+		_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo(name)}, device.publicKey, optionsJSON)
+		return err
+	}
+
+	err := start("over-cap", `{"minValidVotes": 10}`)
+	if err == nil || !strings.Contains(err.Error(), "cap of 5 ballots") {
+		t.Fatalf("minValidVotes above the ballot cap: %v", err)
+	}
+	// A quorum fraction resolves the voter ceiling to the eligible voters
+	requireError(t, start("over-eligible", `{"eligibleVoters": ["voter-1", "voter-2", "voter-3"], "quorumFraction": 0.5, "minValidVotes": 4}`))
+	requireNoError(t, start("at-cap", `{"minValidVotes": 5}`))
+}
+
+func TestDeviceVerifiedEventCarriesResultHash(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "verified-event")
+	e.lastChaincodeEvent()
+
+	e.cast(vote.VoteId, "voter-1", true)
+	event := e.lastChaincodeEvent()
+	if event == nil || event.EventName != "DeviceVerified" {
+		t.Fatalf("last event %v, want DeviceVerified", event)
+	}
+	var payload DeviceVerifiedEvent
+	requireNoError(t, json.Unmarshal(event.Payload, &payload))
+	if payload.ResultHash != e.vote(vote.VoteId).ResultHash || payload.VoteId != vote.VoteId || payload.PublicKeyHash != device.hash {
+		t.Fatalf("event payload %+v", payload)
+	}
+	if hash := fmt.Sprintf("%x", sha256.Sum256([]byte(payload.CanonicalResult))); hash != payload.ResultHash {
+		t.Fatalf("canonical result hashes to %s, event carries %s", hash, payload.ResultHash)
+	}
+	proof, err := e.dr.GetVoteResultProof(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if proof.CanonicalResult != payload.CanonicalResult {
+		t.Fatal("event and proof carry different canonical results")
+	}
+}
+
+func TestGetEffectiveThresholdsReflectsOverridesAndDefaults(t *testing.T) {
+	e := newTestEnv(t)
+	thresholds := func(voteId string) *EffectiveThresholds {
+		effective, err := e.dr.GetEffectiveThresholds(e.admin(), voteId)
+		requireNoError(t, err)
+		return effective
+	}
+
+	plain := e.startVote(newTestDevice(t, 0), "defaults")
+	if got := thresholds(plain.VoteId); got.Source != "CONFIG" || got.Thresholds != defaultConfig().Thresholds || got.ConsensusRule != ConsensusRuleRatio || got.MinValidVotes != 0 {
+		t.Fatalf("thresholds of a vote under the defaults %+v", got)
+	}
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.6, "tieBreak": "REJECT"}}`)
+	if got := thresholds(plain.VoteId); got.Thresholds.MinVoters != 3 || got.Thresholds.ApprovalRatio != 0.6 || got.Thresholds.TieBreak != "REJECT" {
+		t.Fatalf("thresholds after updating the configuration %+v", got)
+	}
+
+	overridden := e.startVoteWithOptions(newTestDevice(t, 1), `{"eligibleVoters": ["voter-1", "voter-2", "voter-3", "voter-4"], "quorumFraction": 0.5, "minValidVotes": 2, "graceVotes": 1}`, "overridden")
+	got := thresholds(overridden.VoteId)
+	if got.Source != "QUORUM_FRACTION" || got.Thresholds.MinVoters != 2 || got.Thresholds.ApprovalRatio != 0.6 || got.MinValidVotes != 2 || got.GraceVotes != 1 || got.ConsensusRule != ConsensusRuleRatioMinValid {
+		t.Fatalf("thresholds of a vote with per-vote overrides %+v", got)
+	}
+
+	e.cast(plain.VoteId, "voter-1", true)
+	e.cast(plain.VoteId, "voter-2", true)
+	e.cast(plain.VoteId, "voter-3", true)
+	e.setConfig(`{"thresholds": {"minVoters": 1, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	if got := thresholds(plain.VoteId); got.Source != "FINALIZED" || got.Thresholds.MinVoters != 3 {
+		t.Fatalf("thresholds of a finalized vote %+v", got)
+	}
+}
+
+func TestGetVoteByResultHash(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVote(newTestDevice(t, 0), "result-hash")
+	e.cast(vote.VoteId, "voter-1", true)
+	resultHash := e.vote(vote.VoteId).ResultHash
+
+	for _, hash := range []string{resultHash, strings.ToUpper(resultHash)} {
+		found, err := e.dr.GetVoteByResultHash(e.admin(), hash)
+		requireNoError(t, err)
+		if found.VoteId != vote.VoteId {
+			t.Fatalf("result hash %s resolved to %s", hash, found.VoteId)
+		}
+	}
+	_, err := e.dr.GetVoteByResultHash(e.admin(), fmt.Sprintf("%x", sha256.Sum256([]byte("unknown"))))
+	requireError(t, err)
+
+	// A vote finalized before the index existed is found once the index is rebuilt
+	e.delState("VoteByResultHash", resultHash)
+	_, err = e.dr.GetVoteByResultHash(e.admin(), resultHash)
+	requireError(t, err)
+	indexed, err := e.dr.RebuildResultHashIndex(e.admin())
+	requireNoError(t, err)
+	if indexed != 1 {
+		t.Fatalf("rebuild indexed %d votes", indexed)
+	}
+	_, err = e.dr.GetVoteByResultHash(e.admin(), resultHash)
+	requireNoError(t, err)
+}
+
+func TestMissingDeviceKeyAtApproval(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "missing-key")
+	e.delState("DeviceKey", device.hash)
+
+	err := e.dr.CastVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, true)
+	if err == nil || !strings.Contains(err.Error(), "no longer exists") {
+		t.Fatalf("CastVote with the device key missing: %v", err)
+	}
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("status after the refused approval %s", got)
+	}
+
+	flagged := newTestEnv(t)
+	flagged.setConfig(`{"missingDeviceKeyPolicy": "FLAG"}`)
+	vote = flagged.startVote(device, "missing-key")
+	flagged.delState("DeviceKey", device.hash)
+	flagged.cast(vote.VoteId, "voter-1", true)
+	if got := flagged.vote(vote.VoteId); got.Status != VoteStatusFlagged || !strings.Contains(got.FlagReason, "no longer exists") {
+		t.Fatalf("vote under the FLAG policy: status %s, flag reason %q", got.Status, got.FlagReason)
+	}
+	if flagged.getState("DeviceKey", device.hash) != nil {
+		t.Fatal("flagging recreated the missing device key")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DelegateVote lets the caller hand their ballot on a pending vote to another identity (refused while
+// voting is paused)
+func (dr *DeviceRegistration) DelegateVote(ctx contractapi.TransactionContextInterface, voteId string, delegateID string) error {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	err = requireVotingOpen(config)
+	if err != nil {
+		return err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return err
+	}
+	if vote.Status != VoteStatusPending {
+		return fmt.Errorf("voting for this photo set has ended")
+	}
+
+	delegatorID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	if !isEligibleVoter(vote, delegatorID) {
+		return fmt.Errorf("voter is not eligible to vote on %s", voteId)
+	}
+	if delegateID == "" || delegateID == delegatorID {
+		return fmt.Errorf("cannot delegate a vote to yourself")
+	}
+	if slices.Contains(vote.Voters, delegatorID) {
+		return fmt.Errorf("voter has already cast a vote")
+	}
+	if _, delegated := vote.Delegations[delegatorID]; delegated {
+		return fmt.Errorf("vote has already been delegated to %s", vote.Delegations[delegatorID])
+	}
+	// Delegation chains are not followed, so refuse to create one
+	if _, delegated := vote.Delegations[delegateID]; delegated {
+		return fmt.Errorf("delegate %s has delegated their own vote", delegateID)
+	}
+	for _, delegate := range vote.Delegations {
+		if delegate == delegatorID {
+			return fmt.Errorf("cannot delegate a vote while acting as a delegate")
+		}
+	}
+
+	if vote.Delegations == nil {
+		vote.Delegations = make(map[string]string)
+	}
+	vote.Delegations[delegatorID] = delegateID
+
+	return putVote(ctx, vote, vote.Status)
+}
+
+// RevokeDelegation withdraws the caller's delegation while the vote is pending and the delegate has not voted for
+// them (refused while voting is paused)
+func (dr *DeviceRegistration) RevokeDelegation(ctx contractapi.TransactionContextInterface, voteId string) error {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	err = requireVotingOpen(config)
+	if err != nil {
+		return err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return err
+	}
+	if vote.Status != VoteStatusPending {
+		return fmt.Errorf("voting for this photo set has ended")
+	}
+
+	delegatorID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	if _, delegated := vote.Delegations[delegatorID]; !delegated {
+		return fmt.Errorf("no delegation to revoke")
+	}
+	if slices.Contains(vote.Voters, delegatorID) {
+		return fmt.Errorf("delegate has already voted on your behalf")
+	}
+
+	delete(vote.Delegations, delegatorID)
+
+	return putVote(ctx, vote, vote.Status)
+}
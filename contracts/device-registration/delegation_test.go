@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDelegatedBallotCountsOnce(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 5, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "delegated")
+
+	requireNoError(t, e.dr.DelegateVote(e.ctx("delegator", "Org1MSP"), vote.VoteId, "proxy"))
+	requireError(t, e.dr.CastVote(e.ctx("delegator", "Org1MSP"), vote.VoteId, true))
+
+	e.cast(vote.VoteId, "proxy", true)
+	stored := e.vote(vote.VoteId)
+	if stored.VoteCount != 2 || stored.ValidVotes != 2 {
+		t.Fatalf("tally after the proxy voted %d/%d, expected 2/2", stored.ValidVotes, stored.VoteCount)
+	}
+
+	// Neither identity can add the delegated ballot a second time
+	requireError(t, e.dr.CastVote(e.ctx("proxy", "Org1MSP"), vote.VoteId, true))
+	requireError(t, e.dr.CastVote(e.ctx("delegator", "Org1MSP"), vote.VoteId, true))
+	requireError(t, e.dr.RevokeDelegation(e.ctx("delegator", "Org1MSP"), vote.VoteId))
+	if stored := e.vote(vote.VoteId); stored.VoteCount != 2 {
+		t.Fatalf("tally changed to %d", stored.VoteCount)
+	}
+}
+
+func TestRevokedDelegationIsNotHonoured(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 5, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "revoked")
+
+	requireNoError(t, e.dr.DelegateVote(e.ctx("delegator", "Org1MSP"), vote.VoteId, "proxy"))
+	requireNoError(t, e.dr.RevokeDelegation(e.ctx("delegator", "Org1MSP"), vote.VoteId))
+	requireError(t, e.dr.RevokeDelegation(e.ctx("delegator", "Org1MSP"), vote.VoteId))
+
+	e.cast(vote.VoteId, "proxy", true)
+	if stored := e.vote(vote.VoteId); stored.VoteCount != 1 {
+		t.Fatalf("proxy cast %d ballots after the delegation was revoked", stored.VoteCount)
+	}
+	e.cast(vote.VoteId, "delegator", false)
+	if stored := e.vote(vote.VoteId); stored.VoteCount != 2 || stored.InvalidVotes != 1 {
+		t.Fatalf("delegator's own ballot was not counted: %+v", stored)
+	}
+}
+
+func TestDelegationRefusedWhilePaused(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVote(newTestDevice(t, 0), "paused-delegation")
+	requireNoError(t, e.dr.DelegateVote(e.ctx("revoker", "Org1MSP"), vote.VoteId, "proxy"))
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), true))
+	err := e.dr.DelegateVote(e.ctx("delegator", "Org1MSP"), vote.VoteId, "proxy")
+	if err == nil || !strings.Contains(err.Error(), "voting paused") {
+		t.Fatalf("DelegateVote while paused: %v", err)
+	}
+	err = e.dr.RevokeDelegation(e.ctx("revoker", "Org1MSP"), vote.VoteId)
+	if err == nil || !strings.Contains(err.Error(), "voting paused") {
+		t.Fatalf("RevokeDelegation while paused: %v", err)
+	}
+	if delegations := e.vote(vote.VoteId).Delegations; len(delegations) != 1 || delegations["revoker"] != "proxy" {
+		t.Fatalf("delegations changed while paused: %v", delegations)
+	}
+}
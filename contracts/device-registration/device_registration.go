@@ -2,6 +2,9 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -9,76 +12,365 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"maps"
+	"math"
+	"math/big"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
+// contractVersion is reported by Ping to identify the deployed chaincode
+const contractVersion = "1.0.0"
+
+// pingToken is the fixed liveness token returned by Ping
+const pingToken = "PONG"
+
+// voteIdPrefix is prepended to the first photo hash to form a vote ID
+const voteIdPrefix = "vote-"
+
 type DeviceRegistration struct {
 	contractapi.Contract
 }
 
 // PhotoVote represents a vote on a set of photos
 type PhotoVote struct {
-	VoteId          string   `json:"voteId"`          // Unique identifier for the vote
-	PhotoIPFSHashes []string `json:"photoIPFSHashes"` // IPFS hashes of the photos
-	VoteCount       int      `json:"voteCount"`
-	ValidVotes      int      `json:"validVotes"`
-	InvalidVotes    int      `json:"invalidVotes"`
-	Status          string   `json:"status"`          // "PENDING", "APPROVED", "REJECTED"
-	Voters          []string `json:"voters"`          // List of voters who have already voted
-	DevicePublicKey string   `json:"devicePublicKey"` // Public key hash of device being registered
+	VoteId          string             `json:"voteId"`          // Unique identifier for the vote
+	PhotoIPFSHashes []string           `json:"photoIPFSHashes"` // IPFS hashes of the photos
+	VoteCount       int                `json:"voteCount"`
+	ValidVotes      int                `json:"validVotes"`
+	InvalidVotes    int                `json:"invalidVotes"`
+	Status          VoteStatus         `json:"status"`                                        // "PENDING", "READY", "APPROVED", "REJECTED", "FLAGGED"
+	Voters          []string           `json:"voters"`                                        // List of voters who have already voted
+	DevicePublicKey string             `json:"devicePublicKey"`                               // Public key hash of device being registered
+	CreatedAt       string             `json:"createdAt"`                                     // RFC3339 timestamp of the transaction that started the vote
+	Outcome         *VoteOutcome       `json:"outcome,omitempty" metadata:",optional"`        // Consensus explanation recorded at finalization
+	Delegations     map[string]string  `json:"delegations,omitempty" metadata:",optional"`    // Delegator identity -> delegate identity
+	EligibleVoters  []string           `json:"eligibleVoters,omitempty" metadata:",optional"` // Identities allowed to vote; empty allows anyone
+	QuorumFraction  float64            `json:"quorumFraction,omitempty" metadata:",optional"` // Quorum as a share of EligibleVoters, 0 to use the minimum voter count
+	ResultHash      string             `json:"resultHash,omitempty" metadata:",optional"`     // SHA-256 of the canonical vote result, set at finalization
+	FinalizedTxId   string             `json:"finalizedTxId,omitempty" metadata:",optional"`  // Transaction that finalized the vote
+	FinalizedAt     string             `json:"finalizedAt,omitempty" metadata:",optional"`    // RFC3339 timestamp of finalization
+	FinalizedBy     string             `json:"finalizedBy,omitempty" metadata:",optional"`    // Identity whose transaction finalized the vote, empty for votes finalized before it was recorded
+	FlagReason      string             `json:"flagReason,omitempty" metadata:",optional"`     // Why finalization was refused for a FLAGGED vote
+	ClosureReason   string             `json:"closureReason,omitempty" metadata:",optional"`  // How the vote ended: "QUORUM" or "ADMIN", empty while open or FLAGGED
+	Timeline        []TimelineEntry    `json:"timeline,omitempty" metadata:",optional"`       // Most recent casts and rounds, capped at maxTimelineEntries; choices are revealed by GetVoteTimeline once the vote ends
+	CommitReveal    bool               `json:"commitReveal,omitempty" metadata:",optional"`   // Ballots are committed as hashes and counted only when revealed
+	RevealOpensAt   string             `json:"revealOpensAt,omitempty" metadata:",optional"`  // RFC3339 time commits close and reveals open
+	Commitments     map[string]string  `json:"commitments,omitempty" metadata:",optional"`    // Voter identity -> hex SHA-256 of choice and nonce
+	MinValidVotes   int                `json:"minValidVotes,omitempty" metadata:",optional"`  // Valid votes required for approval in addition to the ratio, 0 for none
+	AutoFinalize    bool               `json:"autoFinalize"`                                  // Finalize once decided; otherwise a decided vote waits as READY for FinalizeVote
+	Rounds          []RoundResult      `json:"rounds,omitempty" metadata:",optional"`         // Tallies of earlier inconclusive rounds, oldest first; the current round is len(Rounds)+1
+	SkippedPhotos   []PhotoCheckResult `json:"skippedPhotos,omitempty" metadata:",optional"`  // Photos dropped at start under skipInvalidPhotos, with their rejection reasons
+	GraceVotes      int                `json:"graceVotes,omitempty" metadata:",optional"`     // Votes accepted after quorum before the decision is settled, 0 to decide at quorum
+	ConsensusRule   ConsensusRule      `json:"consensusRule,omitempty" metadata:",optional"`  // Approval rule the vote was opened under, empty for votes started before it was recorded
 }
 
 // IPFSPhoto represents a photo stored in IPFS
 type IPFSPhoto struct {
-	IPFSHash    string `json:"ipfsHash"`
-	Signature   string `json:"signature"`   // Digital signature of the photo
-	UploadedBy  string `json:"uploadedBy"`  // Identity of the uploader
-	TimeStamp   string `json:"timestamp"`   // Upload timestamp
-	Description string `json:"description"` // Optional photo description
+	IPFSHash            string `json:"ipfsHash"`
+	Signature           string `json:"signature"`                                          // Digital signature of the photo
+	UploadedBy          string `json:"uploadedBy"`                                         // Identity of the uploader
+	TimeStamp           string `json:"timestamp"`                                          // Upload timestamp
+	Description         string `json:"description"`                                        // Optional photo description
+	MimeType            string `json:"mimeType,omitempty" metadata:",optional"`            // Optional MIME type of the image
+	Width               int    `json:"width,omitempty" metadata:",optional"`               // Optional image width in pixels
+	Height              int    `json:"height,omitempty" metadata:",optional"`              // Optional image height in pixels
+	SignatureFormat     int    `json:"signatureFormat,omitempty" metadata:",optional"`     // Version of the signed payload, defaults to photoSignatureFormat
+	Status              string `json:"status,omitempty" metadata:",optional"`              // "FLAGGED" once an admin flags the photo through FlagPhoto, empty otherwise
+	FlagReason          string `json:"flagReason,omitempty" metadata:",optional"`          // Why the photo was flagged
+	OperatorPublicKey   string `json:"operatorPublicKey,omitempty" metadata:",optional"`   // PEM public key of the operator who uploaded the photo
+	OperatorSignature   string `json:"operatorSignature,omitempty" metadata:",optional"`   // Operator signature over the upload, see operatorSigningPayload
+	SignatureMode       string `json:"signatureMode,omitempty" metadata:",optional"`       // Signature mode in force when the photo was stored; empty for photos stored before modes existed, which were checked strictly
+	SignatureUnverified bool   `json:"signatureUnverified,omitempty" metadata:",optional"` // Whether the photo was accepted without a verified device signature under the WARN or OFF mode
+	ThumbnailIPFSHash   string `json:"thumbnailIpfsHash,omitempty" metadata:",optional"`   // Optional IPFS hash of a lightweight preview of the photo, signed under format 2
+	SessionChallenge    string `json:"sessionChallenge,omitempty" metadata:",optional"`    // Challenge of the enrollment session the photo was signed for, covered by the signature in every format
+	SignedPayloadDigest string `json:"signedPayloadDigest,omitempty" metadata:",optional"` // Hex SHA-256 of the signed payload, kept by compact records in place of the signed fields they drop
+	HashAlgorithm       string `json:"hashAlgorithm,omitempty" metadata:",optional"`       // Multihash algorithm of the CID detected on upload, such as "sha2-256"; empty for photos stored before detection
 }
 
 // DeviceKey represents a device's public key registration
 type DeviceKey struct {
-	PublicKeyHash string `json:"publicKeyHash"` // Hash of the public key for shorter reference
-	PublicKey     string `json:"publicKey"`     // Full public key in PEM format
-	Status        string `json:"status"`        // "UNVERIFIED" or "VERIFIED"
+	PublicKeyHash            string       `json:"publicKeyHash"`                                    // Hash of the public key for shorter reference
+	PublicKey                string       `json:"publicKey"`                                        // Full public key in PEM format
+	Status                   DeviceStatus `json:"status"`                                           // "UNVERIFIED", "VERIFIED", "REVOKED" or "ROTATED"
+	LastVoteAt               string       `json:"lastVoteAt"`                                       // RFC3339 timestamp of the last vote started for this key
+	ForceVerifiedBy          string       `json:"forceVerifiedBy"`                                  // Admin identity that verified the key without a vote
+	ForceVerifyJustification string       `json:"forceVerifyJustification"`                         // Reason recorded for a forced verification
+	CertificateChain         []string     `json:"certificateChain,omitempty" metadata:",optional"`  // Leaf-first PEM certificates when the key was presented as a verified chain
+	VerifiedSigCount         int          `json:"verifiedSigCount"`                                 // Photo signatures that verified against this key
+	FailedSigCount           int          `json:"failedSigCount"`                                   // Photo signatures that failed against this key in votes that were opened, through skipped photos or the WARN mode
+	RotatedFrom              string       `json:"rotatedFrom,omitempty" metadata:",optional"`       // Hash of the key this one replaced through RotateDeviceKey
+	RotatedTo                string       `json:"rotatedTo,omitempty" metadata:",optional"`         // Hash of the key that replaced this one through RotateDeviceKey
+	VerifiedAt               string       `json:"verifiedAt,omitempty" metadata:",optional"`        // RFC3339 timestamp of the transaction that last made the key VERIFIED
+	RevokedBy                string       `json:"revokedBy,omitempty" metadata:",optional"`         // Admin identity that revoked the key
+	RevocationReason         string       `json:"revocationReason,omitempty" metadata:",optional"`  // Reason recorded for the revocation
+	RevokedAt                string       `json:"revokedAt,omitempty" metadata:",optional"`         // RFC3339 timestamp of the revoking transaction
+	SignatureEncoding        string       `json:"signatureEncoding,omitempty" metadata:",optional"` // How an ECDSA key's signatures are encoded: "DER" (ASN.1, the default) or "RAW" (r||s)
 }
 
-// verifyPhotoSignature validates the digital signature of a photo
-func verifyPhotoSignature(photo IPFSPhoto, devicePublicKey string) bool {
-	block, _ := pem.Decode([]byte(devicePublicKey))
+// getTxTime returns the transaction timestamp as a UTC time
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	return time.Unix(ts.GetSeconds(), int64(ts.GetNanos())).UTC(), nil
+}
+
+// publicKeyTypeName returns a human-readable algorithm name for a parsed public key
+func publicKeyTypeName(pubKey crypto.PublicKey) string {
+	switch pubKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	case ed25519.PublicKey:
+		return "Ed25519"
+	case *ecdh.PublicKey:
+		return "ECDH"
+	default:
+		return fmt.Sprintf("%T", pubKey)
+	}
+}
+
+// publicKeyPEMType is the only PEM block type accepted for device public keys
+const publicKeyPEMType = "PUBLIC KEY"
+
+// parsePublicKey decodes a PEM-encoded PKIX public key
+func parsePublicKey(publicKeyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
 	if block == nil {
-		return false
+		return nil, fmt.Errorf("failed to decode public key")
+	}
+	// Reject certificates, private keys and anything else that is not a bare PKIX public key
+	if block.Type != publicKeyPEMType {
+		return nil, fmt.Errorf("unsupported PEM block type %q: expected %q", block.Type, publicKeyPEMType)
 	}
 
 	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	return pubKey, nil
+}
+
+// verifyPhotoSignature validates the digital signature of a photo
+func verifyPhotoSignature(photo IPFSPhoto, devicePublicKey string, encoding string, opts *rsa.PSSOptions) bool {
+	pubKey, err := parsePublicKey(devicePublicKey)
 	if err != nil {
 		return false
 	}
 
+	return verifyPhotoSignatureWithKey(photo, pubKey, encoding, opts)
+}
+
+// Encodings of ECDSA signatures a device key can declare
+const (
+	signatureEncodingDER = "DER" // ASN.1 DER sequence of r and s
+	signatureEncodingRaw = "RAW" // Fixed-width big-endian r followed by s
+)
+
+// verifyDeviceSignature checks a hex signature over the SHA-256 of a message: RSA keys use PSS, ECDSA
+// keys use the declared encoding
+func verifyDeviceSignature(pubKey crypto.PublicKey, encoding string, message []byte, signatureHex string, opts *rsa.PSSOptions) bool {
+	hashed := sha256.Sum256(message)
+	return verifyDeviceSignatureDigest(pubKey, encoding, hashed[:], signatureHex, opts)
+}
+
+// verifyDeviceSignatureDigest checks a hex signature over an already computed SHA-256 digest
+func verifyDeviceSignatureDigest(pubKey crypto.PublicKey, encoding string, hashed []byte, signatureHex string, opts *rsa.PSSOptions) bool {
+	sigBytes, err := hex.DecodeString(signatureHex)
+	if err != nil || len(hashed) != sha256.Size {
+		return false
+	}
+
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(key, crypto.SHA256, hashed, sigBytes, opts) == nil
+	case *ecdsa.PublicKey:
+		if encoding != signatureEncodingRaw {
+			return ecdsa.VerifyASN1(key, hashed, sigBytes)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sigBytes) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sigBytes[:size])
+		s := new(big.Int).SetBytes(sigBytes[size:])
+		return ecdsa.Verify(key, hashed, r, s)
+	default:
+		return false
+	}
+}
+
+// Versions of the signed photo payload. Version 1 covers only the hash, uploader and timestamp;
+// description, MIME type, dimensions and thumbnail hash are unsigned metadata. Version 2 covers all of them.
+// Both cover the enrollment session challenge when the photo carries one.
+const (
+	photoSignatureFormatV1 = 1
+	photoSignatureFormatV2 = 2
+)
+
+// photoSignatureFormat is the payload version assumed for photos that do not declare one
+const photoSignatureFormat = photoSignatureFormatV1
+
+// signedPhotoV2 is the canonical encoding signed under photoSignatureFormatV2; field order is fixed
+type signedPhotoV2 struct {
+	Format            int    `json:"format"`
+	IPFSHash          string `json:"ipfsHash"`
+	UploadedBy        string `json:"uploadedBy"`
+	TimeStamp         string `json:"timestamp"`
+	Description       string `json:"description"`
+	MimeType          string `json:"mimeType"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	ThumbnailIPFSHash string `json:"thumbnailIpfsHash,omitempty"` // Omitted when empty so payloads of photos without a thumbnail are unchanged
+	SessionChallenge  string `json:"sessionChallenge,omitempty"`  // Omitted when empty for the same reason
+}
+
+// photoSigningPayload returns the exact message a device signs for a photo under its signature format
+func photoSigningPayload(photo IPFSPhoto) string {
+	if photo.SignatureFormat == photoSignatureFormatV2 {
+		payload, _ := json.Marshal(signedPhotoV2{
+			Format:            photoSignatureFormatV2,
+			IPFSHash:          photo.IPFSHash,
+			UploadedBy:        photo.UploadedBy,
+			TimeStamp:         photo.TimeStamp,
+			Description:       photo.Description,
+			MimeType:          photo.MimeType,
+			Width:             photo.Width,
+			Height:            photo.Height,
+			ThumbnailIPFSHash: photo.ThumbnailIPFSHash,
+			SessionChallenge:  photo.SessionChallenge,
+		})
+		return string(payload)
+	}
+	return photo.IPFSHash + photo.UploadedBy + photo.TimeStamp + photo.SessionChallenge
+}
+
+// signedUpload is the canonical encoding an operator signs to vouch for uploading a photo; field order is fixed
+type signedUpload struct {
+	Action     string `json:"action"`
+	IPFSHash   string `json:"ipfsHash"`
+	UploadedBy string `json:"uploadedBy"`
+	TimeStamp  string `json:"timestamp"`
+}
+
+// operatorSigningPayload returns the exact message an operator signs for a photo upload
+func operatorSigningPayload(photo IPFSPhoto) string {
+	payload, _ := json.Marshal(signedUpload{
+		Action:     "UPLOAD",
+		IPFSHash:   photo.IPFSHash,
+		UploadedBy: photo.UploadedBy,
+		TimeStamp:  photo.TimeStamp,
+	})
+	return string(payload)
+}
+
+// verifyOperatorSignature validates a photo's operator signature against its operator public key
+func verifyOperatorSignature(photo IPFSPhoto, opts *rsa.PSSOptions) bool {
+	pubKey, err := parsePublicKey(photo.OperatorPublicKey)
+	if err != nil {
+		return false
+	}
 	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
 	if !ok {
 		return false
 	}
 
-	message := photo.IPFSHash + photo.UploadedBy + photo.TimeStamp
-	hashed := sha256.Sum256([]byte(message))
-
-	sigBytes, err := hex.DecodeString(photo.Signature)
+	hashed := sha256.Sum256([]byte(operatorSigningPayload(photo)))
+	sigBytes, err := hex.DecodeString(photo.OperatorSignature)
 	if err != nil {
 		return false
 	}
 
-	err = rsa.VerifyPSS(rsaPubKey, crypto.SHA256, hashed[:], sigBytes, nil)
-	return err == nil
+	return rsa.VerifyPSS(rsaPubKey, crypto.SHA256, hashed[:], sigBytes, opts) == nil
+}
+
+// verifyPhotoSignatureWithKey validates the digital signature of a photo against an already parsed key;
+// a compact record no longer holds the signed fields, so its recorded payload digest is checked instead
+func verifyPhotoSignatureWithKey(photo IPFSPhoto, pubKey crypto.PublicKey, encoding string, opts *rsa.PSSOptions) bool {
+	if photo.SignedPayloadDigest != "" {
+		hashed, err := hex.DecodeString(photo.SignedPayloadDigest)
+		if err != nil {
+			return false
+		}
+		return verifyDeviceSignatureDigest(pubKey, encoding, hashed, photo.Signature, opts)
+	}
+	return verifyDeviceSignature(pubKey, encoding, []byte(photoSigningPayload(photo)), photo.Signature, opts)
 }
 
 // StartPhotoVote initiates a new voting session for a set of IPFS photos
 func (dr *DeviceRegistration) StartPhotoVote(ctx contractapi.TransactionContextInterface, ipfsPhotos []IPFSPhoto, devicePublicKey string) (*PhotoVote, error) {
-	if len(ipfsPhotos) == 0 {
-		return nil, fmt.Errorf("IPFS photos array cannot be empty")
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStrictPhotosArg(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return startPhotoVote(ctx, ipfsPhotos, devicePublicKey, VoteOptions{}, newVoteBatch())
+}
+
+// voteBatch tracks the photo hashes and device keys used by votes already opened in the current
+// transaction, since those writes are not visible to reads until commit
+type voteBatch struct {
+	photos  map[string]bool
+	devices map[string]bool
+}
+
+// newVoteBatch returns an empty voteBatch
+func newVoteBatch() *voteBatch {
+	return &voteBatch{photos: make(map[string]bool), devices: make(map[string]bool)}
+}
+
+// startPhotoVote validates and stores a photo set and opens a vote on it; nothing is written
+// unless every check passes
+func startPhotoVote(ctx contractapi.TransactionContextInterface, ipfsPhotos []IPFSPhoto, devicePublicKey string, options VoteOptions, batch *voteBatch) (*PhotoVote, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireVotingOpen(config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateVoteOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vote options: %v", err)
+	}
+
+	quorum := config.Thresholds.MinVoters
+	if options.QuorumFraction > 0 {
+		quorum = fractionQuorum(options.QuorumFraction, len(options.EligibleVoters))
+
+		// A per-vote quorum must stay within the global bounds, so an uploader cannot open a vote one ballot approves
+		if quorum < config.MinPerVoteQuorum {
+			return nil, fmt.Errorf("quorum fraction %.2f of %d eligible voters resolves to %d voters, below the minimum of %d", options.QuorumFraction, len(options.EligibleVoters), quorum, config.MinPerVoteQuorum)
+		}
+		if config.MaxPerVoteQuorum > 0 && quorum > config.MaxPerVoteQuorum {
+			return nil, fmt.Errorf("quorum fraction %.2f of %d eligible voters resolves to %d voters, above the maximum of %d", options.QuorumFraction, len(options.EligibleVoters), quorum, config.MaxPerVoteQuorum)
+		}
+	}
+	// Quorum and the grace votes after it must all be castable, or the vote can never settle
+	if len(options.EligibleVoters) > 0 && quorum+options.GraceVotes > len(options.EligibleVoters) {
+		return nil, fmt.Errorf("quorum of %d voters and %d grace votes exceed the %d eligible voters", quorum, options.GraceVotes, len(options.EligibleVoters))
+	}
+	if config.MaxVotersPerVote > 0 && quorum+options.GraceVotes > config.MaxVotersPerVote {
+		return nil, fmt.Errorf("quorum of %d voters and %d grace votes exceed the cap of %d ballots per vote", quorum, options.GraceVotes, config.MaxVotersPerVote)
+	}
+	// Approval needs the minimum valid votes on top of quorum, so they must fit within the ballots the vote can count
+	if config.MaxVotersPerVote > 0 && options.MinValidVotes > config.MaxVotersPerVote {
+		return nil, fmt.Errorf("minimum valid votes %d exceed the cap of %d ballots per vote", options.MinValidVotes, config.MaxVotersPerVote)
 	}
 
 	// Get the identity of the caller
@@ -87,64 +379,170 @@ func (dr *DeviceRegistration) StartPhotoVote(ctx contractapi.TransactionContextI
 	// 	return nil, fmt.Errorf("failed to get client identity: %v", err)
 	// }
 
+	// A device presenting a certificate chain is identified by its verified leaf key
+	devicePublicKey, certificateChain, err := resolveDevicePublicKey(ctx, devicePublicKey, config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate public key hash
 	pubKeyHash := fmt.Sprintf("%x", sha256.Sum256([]byte(devicePublicKey)))
 
-	// Store device public key in unverified state
-	deviceKey := DeviceKey{
-		PublicKeyHash: pubKeyHash,
-		PublicKey:     devicePublicKey,
-		Status:        "UNVERIFIED",
-	}
-	deviceKeyJSON, err := json.Marshal(deviceKey)
+	txTime, err := getTxTime(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal device key data: %v", err)
+		return nil, err
 	}
 
-	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{pubKeyHash})
+	err = checkPhotoSet(ipfsPhotos, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create composite key for device: %v", err)
+		return nil, err
+	}
+	if options.ExpectedPhotoCount > 0 && len(ipfsPhotos) != options.ExpectedPhotoCount {
+		return nil, fmt.Errorf("expected %d photos, got %d", options.ExpectedPhotoCount, len(ipfsPhotos))
 	}
 
-	err = ctx.GetStub().PutState(deviceKeyCompositeKey, deviceKeyJSON)
+	existingDeviceKey, err := findDeviceKey(ctx, pubKeyHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to store device key: %v", err)
+		return nil, err
 	}
 
-	// Extract IPFS hashes and verify photos
-	ipfsHashes := make([]string, len(ipfsPhotos))
-	for i, photo := range ipfsPhotos {
-		ipfsHashes[i] = photo.IPFSHash
+	// Enforce the cooldown between votes for the same device key
+	var previousStatus DeviceStatus
+	if existingDeviceKey != nil {
+		previousStatus = existingDeviceKey.Status
+		if existingDeviceKey.Status == DeviceStatusRotated {
+			return nil, fmt.Errorf("device key %s was rotated to %s", pubKeyHash, existingDeviceKey.RotatedTo)
+		}
+		if existingDeviceKey.Status == DeviceStatusRevoked {
+			return nil, fmt.Errorf("device key %s has been revoked", pubKeyHash)
+		}
+		if config.VoteCooldownSeconds > 0 && existingDeviceKey.LastVoteAt != "" {
+			lastVoteAt, err := time.Parse(time.RFC3339, existingDeviceKey.LastVoteAt)
+			if err != nil {
+				return nil, fmt.Errorf("device key has invalid last vote time: %v", err)
+			}
+			nextAllowed := lastVoteAt.Add(time.Duration(config.VoteCooldownSeconds) * time.Second)
+			if txTime.Before(nextAllowed) {
+				return nil, fmt.Errorf("device key %s cannot start a new vote until %s", pubKeyHash, nextAllowed.Format(time.RFC3339))
+			}
+		}
+	}
+
+	// Throttle devices with too many votes still in flight
+	if config.MaxPendingVotesPerDevice > 0 && existingDeviceKey != nil {
+		inFlight, err := countInFlightDeviceVotes(ctx, pubKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		if inFlight >= config.MaxPendingVotesPerDevice {
+			return nil, fmt.Errorf("device key %s already has %d votes in progress, the limit is %d", pubKeyHash, inFlight, config.MaxPendingVotesPerDevice)
+		}
+	}
+
+	// Refuse a device key that already opened a vote earlier in this transaction
+	if batch.devices[pubKeyHash] {
+		return nil, fmt.Errorf("device key %s already started a vote in this transaction", pubKeyHash)
+	}
 
+	// Parse the device key once for all photo verifications; an unparsable key fails every signature
+	devicePubKey, _ := parsePublicKey(devicePublicKey)
+
+	// An ECDSA key keeps its declared signature encoding unless the vote declares a new one
+	signatureEncoding := options.SignatureEncoding
+	if signatureEncoding == "" && existingDeviceKey != nil {
+		signatureEncoding = existingDeviceKey.SignatureEncoding
+	}
+	if _, isECDSA := devicePubKey.(*ecdsa.PublicKey); signatureEncoding != "" && !isECDSA {
+		return nil, fmt.Errorf("signature encoding applies to ECDSA device keys only")
+	}
+
+	// Extract IPFS hashes and verify every photo before writing anything
+	ipfsHashes := make([]string, 0, len(ipfsPhotos))
+	checkedPhotos := make([]IPFSPhoto, 0, len(ipfsPhotos))
+	skippedPhotos := make([]PhotoCheckResult, 0)
+	seen := maps.Clone(batch.photos)
+	tally := &signatureTally{}
+	sessionPhotos := make([]IPFSPhoto, 0, len(ipfsPhotos))
+	for i, photo := range ipfsPhotos {
 		// Verify the uploader matches the transaction submitter
 		// if photo.UploadedBy != clientID {
 		// 	return nil, fmt.Errorf("photo uploader does not match transaction submitter %s != %s", photo.UploadedBy, clientID)
 		// }
 
-		// Verify digital signature
-		if !verifyPhotoSignature(photo, devicePublicKey) {
-			fmt.Println("Invalid digital signature for photo with hash: ", photo.IPFSHash)
-			return nil, fmt.Errorf("invalid digital signature for photo with hash: %s", photo.IPFSHash)
-		} else {
-			fmt.Println("Valid digital signature for photo with hash: ", photo.IPFSHash)
+		// Validate hash, uniqueness, signature and description
+		applyDefaultDescription(&photo, i+1, config)
+		photoErr, err := checkPhoto(ctx, &photo, devicePubKey, signatureEncoding, config, seen, tally)
+		if err != nil {
+			return nil, err
+		}
+		if photoErr != nil {
+			if !options.SkipInvalidPhotos {
+				return nil, photoErr
+			}
+			skippedPhotos = append(skippedPhotos, PhotoCheckResult{
+				IPFSHash: photo.IPFSHash,
+				Reason:   photoErr.Reason,
+				Message:  photoErr.Message,
+			})
+			continue
 		}
+		ipfsHashes = append(ipfsHashes, photo.IPFSHash)
+		checkedPhotos = append(checkedPhotos, photo)
+		sessionPhotos = append(sessionPhotos, ipfsPhotos[i])
+	}
 
-		// Store individual photo metadata
-		photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{photo.IPFSHash})
+	// A reused photo is replaced by its stored record, so the session is checked against the photos as submitted
+	session, err := checkEnrollmentSession(ctx, sessionPhotos, options.SessionChallenge, config)
+	if err != nil {
+		return nil, err
+	}
+	if minPhotos := max(options.MinPhotoCount, 1); len(checkedPhotos) < minPhotos {
+		return nil, fmt.Errorf("only %d of %d photos are valid, at least %d required", len(checkedPhotos), len(ipfsPhotos), minPhotos)
+	}
+	if len(skippedPhotos) > 0 {
+		err = checkDistinctUploaders(checkedPhotos, config)
 		if err != nil {
 			return nil, err
 		}
+	}
+	batch.photos = seen
+	batch.devices[pubKeyHash] = true
 
-		// Check if photo already exists
-		existing, err := ctx.GetStub().GetState(photoKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read from world state: %v", err)
+	// Reusing stored photos proves nothing new about a key that has already been verified
+	if tally.reused > 0 && existingDeviceKey != nil && existingDeviceKey.Status == DeviceStatusVerified {
+		return nil, fmt.Errorf("device key %s is already verified and cannot open a vote on reused photos", pubKeyHash)
+	}
+
+	// Store a new device public key in unverified state; an existing record keeps its status and
+	// verification history and only tracks the new vote
+	deviceKey := existingDeviceKey
+	if deviceKey == nil {
+		deviceKey = &DeviceKey{
+			PublicKeyHash: pubKeyHash,
+			PublicKey:     devicePublicKey,
+			Status:        DeviceStatusUnverified,
 		}
-		if existing != nil {
-			return nil, fmt.Errorf("photo with hash %s already exists", photo.IPFSHash)
+	}
+	if len(deviceKey.CertificateChain) == 0 {
+		deviceKey.CertificateChain = certificateChain
+	}
+	deviceKey.LastVoteAt = txTime.Format(time.RFC3339)
+	deviceKey.SignatureEncoding = signatureEncoding
+	deviceKey.VerifiedSigCount += tally.verified
+	deviceKey.FailedSigCount += tally.failed
+	err = putDeviceKey(ctx, deviceKey, previousStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, photo := range checkedPhotos {
+		// Store individual photo metadata
+		photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{photo.IPFSHash})
+		if err != nil {
+			return nil, err
 		}
 
-		photoJSON, err := json.Marshal(photo)
+		photoJSON, err := photoRecordJSON(photo, config)
 		if err != nil {
 			return nil, err
 		}
@@ -155,7 +553,20 @@ func (dr *DeviceRegistration) StartPhotoVote(ctx contractapi.TransactionContextI
 		}
 	}
 
-	voteId := "vote-" + ipfsHashes[0] // Use first photo hash as ID instead of uuid
+	voteId := voteIdPrefix + ipfsHashes[0] // Use first photo hash as ID instead of uuid
+
+	// A reused first photo may already name an earlier vote, so disambiguate with the transaction ID
+	existingVoteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{voteId})
+	if err != nil {
+		return nil, err
+	}
+	existingVote, err := ctx.GetStub().GetState(existingVoteKey)
+	if err != nil {
+		return nil, err
+	}
+	if existingVote != nil {
+		voteId += "-" + ctx.GetStub().GetTxID()
+	}
 	// Create new vote record
 	vote := PhotoVote{
 		VoteId:          voteId,
@@ -163,57 +574,74 @@ func (dr *DeviceRegistration) StartPhotoVote(ctx contractapi.TransactionContextI
 		VoteCount:       0,
 		ValidVotes:      0,
 		InvalidVotes:    0,
-		Status:          "PENDING",
+		Status:          VoteStatusPending,
 		Voters:          make([]string, 0),
 		DevicePublicKey: pubKeyHash,
+		CreatedAt:       txTime.Format(time.RFC3339),
+		EligibleVoters:  options.EligibleVoters,
+		QuorumFraction:  options.QuorumFraction,
+		CommitReveal:    options.CommitReveal,
+		MinValidVotes:   options.MinValidVotes,
+		GraceVotes:      options.GraceVotes,
+		AutoFinalize:    options.AutoFinalize == nil || *options.AutoFinalize,
+		ConsensusRule:   consensusRuleFor(options.MinValidVotes),
+	}
+	if len(skippedPhotos) > 0 {
+		vote.SkippedPhotos = skippedPhotos
+	}
+	if options.CommitReveal {
+		vote.RevealOpensAt = txTime.Add(time.Duration(options.RevealDelaySeconds) * time.Second).Format(time.RFC3339)
 	}
 
-	// Convert to JSON
-	voteJSON, err := json.Marshal(vote)
+	fmt.Println("PUT vote '", voteId, "'")
+
+	// Store on blockchain
+	err = putVote(ctx, &vote, "")
 	if err != nil {
 		return nil, err
 	}
 
-	// Create composite key using voteId as identifier
-	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{voteId})
+	err = addDeviceVote(ctx, &vote)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("PUT voteKey '", voteKey, "'")
 
-	// Store on blockchain
-	err = ctx.GetStub().PutState(voteKey, voteJSON)
-	if err != nil {
-		return nil, err
+	for _, ipfsHash := range ipfsHashes {
+		err = putPhotoVoteRef(ctx, ipfsHash, voteId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if session != nil {
+		err = consumeEnrollmentSession(ctx, session, voteId)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &vote, nil
 }
 
 // CastVote allows a participant to vote on photo validity
 func (dr *DeviceRegistration) CastVote(ctx contractapi.TransactionContextInterface, voteId string, isValid bool) error {
-	// Get vote key
-	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{voteId})
+	config, err := getConfig(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Get current vote state
-	voteJSON, err := ctx.GetStub().GetState(voteKey)
+	err = requireVotingOpen(config)
 	if err != nil {
 		return err
 	}
-	if voteJSON == nil {
-		return fmt.Errorf("vote for IPFS photo %s does not exist", voteId)
-	}
 
-	var vote PhotoVote
-	err = json.Unmarshal(voteJSON, &vote)
+	// Get current vote state
+	vote, err := getVote(ctx, voteId)
 	if err != nil {
 		return err
 	}
 
 	// Check if vote is still pending
-	if vote.Status != "PENDING" {
+	if vote.Status != VoteStatusPending {
 		return fmt.Errorf("voting for this photo set has ended")
 	}
 
@@ -223,77 +651,144 @@ func (dr *DeviceRegistration) CastVote(ctx contractapi.TransactionContextInterfa
 		return err
 	}
 
-	// Check if voter has already voted
-	if slices.Contains(vote.Voters, voterID) {
+	// The device under registration must not approve itself through a voting identity
+	if config.BlockDeviceSelfVote {
+		err = rejectDeviceSelfVote(ctx, vote)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hidden ballots are only counted through RevealVote
+	if vote.CommitReveal {
+		return fmt.Errorf("vote %s uses commit-reveal: submit CommitVote and RevealVote instead", voteId)
+	}
+
+	return castBallots(ctx, vote, voterID, isValid)
+}
+
+// castBallots counts the voter's ballot and those delegated to them, finalizing the vote once
+// it is decided, and stores it
+func castBallots(ctx contractapi.TransactionContextInterface, vote *PhotoVote, voterID string, isValid bool) error {
+	voteId := vote.VoteId
+
+	// Collect the ballots this cast covers: the caller's own and any delegated to the caller
+	ballots := make([]string, 0, 1)
+	if delegate, delegated := vote.Delegations[voterID]; delegated && !slices.Contains(vote.Voters, voterID) {
+		return fmt.Errorf("vote has been delegated to %s", delegate)
+	}
+	if !slices.Contains(vote.Voters, voterID) && isEligibleVoter(vote, voterID) {
+		ballots = append(ballots, voterID)
+	}
+	for _, delegator := range slices.Sorted(maps.Keys(vote.Delegations)) {
+		if vote.Delegations[delegator] == voterID && !slices.Contains(vote.Voters, delegator) && isEligibleVoter(vote, delegator) {
+			ballots = append(ballots, delegator)
+		}
+	}
+
+	// Check if voter has already voted or may not vote at all
+	if len(ballots) == 0 {
+		if !slices.Contains(vote.Voters, voterID) {
+			return fmt.Errorf("voter is not eligible to vote on %s", voteId)
+		}
 		return fmt.Errorf("voter has already cast a vote")
 	}
 
-	// Update vote counts
-	vote.VoteCount++
-	if isValid {
-		vote.ValidVotes++
-	} else {
-		vote.InvalidVotes++
-	}
-	vote.Voters = append(vote.Voters, voterID)
-
-	// Check if we have reached a consensus (simple majority for this example)
-	if vote.VoteCount >= 1 { // Minimum 1 votes required
-		if vote.ValidVotes > vote.InvalidVotes {
-			vote.Status = "APPROVED"
-			// Update device key status to VERIFIED using the hash stored in vote
-			deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{vote.DevicePublicKey})
-			if err != nil {
-				return fmt.Errorf("failed to create composite key for device: %v", err)
-			}
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkTallyCapacity(vote, len(ballots), config)
+	if err != nil {
+		return err
+	}
 
-			deviceKeyJSON, err := ctx.GetStub().GetState(deviceKeyCompositeKey)
-			if err != nil {
-				return fmt.Errorf("failed to get device key: %v", err)
-			}
+	// Update vote counts
+	for _, ballot := range ballots {
+		vote.VoteCount++
+		if isValid {
+			vote.ValidVotes++
+		} else {
+			vote.InvalidVotes++
+		}
+		vote.Voters = append(vote.Voters, ballot)
 
-			var deviceKey DeviceKey
-			err = json.Unmarshal(deviceKeyJSON, &deviceKey)
-			if err != nil {
-				return fmt.Errorf("failed to unmarshal device key: %v", err)
-			}
+		err := putVoterBallot(ctx, vote, ballot, voterID, isValid)
+		if err != nil {
+			return err
+		}
+	}
 
-			deviceKey.Status = "VERIFIED"
-			updatedDeviceKeyJSON, err := json.Marshal(deviceKey)
-			if err != nil {
-				return fmt.Errorf("failed to marshal updated device key: %v", err)
-			}
+	// Check if we have reached a consensus under the configured thresholds
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return err
+	}
 
-			err = ctx.GetStub().PutState(deviceKeyCompositeKey, updatedDeviceKeyJSON)
-			if err != nil {
-				return fmt.Errorf("failed to update device key status: %v", err)
-			}
+	outcome := evaluateVote(vote, thresholds)
+	if outcome.Status != VoteStatusPending {
+		err = settleVote(ctx, vote, outcome, ClosureQuorum)
+		if err != nil {
+			return err
 		}
 	}
 
-	// Store updated vote
-	updatedVoteJSON, err := json.Marshal(vote)
+	err = appendTimelineEntry(ctx, vote, "CAST", len(ballots))
+	if err != nil {
+		return err
+	}
+
+	// Update device key status to VERIFIED using the hash stored in vote
+	err = verifyApprovedDevice(ctx, vote)
 	if err != nil {
 		return err
 	}
 
-	return ctx.GetStub().PutState(voteKey, updatedVoteJSON)
+	// Store updated vote
+	return putVote(ctx, vote, VoteStatusPending)
 }
 
-// GetVoteStatus returns the current status of a photo vote
-func (dr *DeviceRegistration) GetVoteStatus(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
+// checkTallyCapacity refuses ballots that would take a vote past the configured cap or wrap its counters;
+// the valid and invalid counts never exceed the total, so guarding the total guards all three
+func checkTallyCapacity(vote *PhotoVote, ballots int, config *ContractConfig) error {
+	if ballots > math.MaxInt-vote.VoteCount {
+		return fmt.Errorf("vote %s cannot count %d more ballots without overflowing its tally", vote.VoteId, ballots)
+	}
+	if config.MaxVotersPerVote > 0 && vote.VoteCount+ballots > config.MaxVotersPerVote {
+		return fmt.Errorf("vote %s is capped at %d ballots and has counted %d", vote.VoteId, config.MaxVotersPerVote, vote.VoteCount)
+	}
+
+	return nil
+}
+
+// UnmarshalJSON decodes a vote, treating votes stored before AutoFinalize existed as finalizing automatically
+// and rejecting an unknown status
+func (v *PhotoVote) UnmarshalJSON(data []byte) error {
+	type plainPhotoVote PhotoVote
+	decoded := plainPhotoVote{AutoFinalize: true}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := validateVoteStatus(decoded.Status); err != nil {
+		return fmt.Errorf("vote %s: %v", decoded.VoteId, err)
+	}
+	*v = PhotoVote(decoded)
+	return nil
+}
+
+// findVote reads a vote record by its exact ID, returning nil if it does not exist
+func findVote(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
 	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{voteId})
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("GET voteKey'", voteKey, "'")
 
 	voteJSON, err := ctx.GetStub().GetState(voteKey)
 	if err != nil {
 		return nil, err
 	}
 	if voteJSON == nil {
-		return nil, fmt.Errorf("vote for IPFS photo %s does not exist", voteId)
+		return nil, nil
 	}
 
 	var vote PhotoVote
@@ -305,6 +800,76 @@ func (dr *DeviceRegistration) GetVoteStatus(ctx contractapi.TransactionContextIn
 	return &vote, nil
 }
 
+// getVote reads a vote record by its ID, also accepting the bare first photo hash the ID is built from
+func getVote(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
+	vote, err := findVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+	if vote == nil && !strings.HasPrefix(voteId, voteIdPrefix) {
+		vote, err = findVote(ctx, voteIdPrefix+voteId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vote == nil {
+		return nil, fmt.Errorf("vote for IPFS photo %s does not exist: expected a vote ID (%s<hash>) or the hash of its first photo", voteId, voteIdPrefix)
+	}
+
+	return vote, nil
+}
+
+// putVote stores a vote record under its ID and moves its status index entry when the status changed
+func putVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote, previousStatus VoteStatus) error {
+	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{vote.VoteId})
+	if err != nil {
+		return err
+	}
+
+	err = validateVoteStatus(vote.Status)
+	if err != nil {
+		return err
+	}
+
+	voteJSON, err := json.Marshal(vote)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(voteKey, voteJSON)
+	if err != nil {
+		return err
+	}
+
+	if previousStatus == vote.Status {
+		return nil
+	}
+
+	if previousStatus != "" {
+		previousIndexKey, err := ctx.GetStub().CreateCompositeKey("VoteByStatus", []string{string(previousStatus), vote.VoteId})
+		if err != nil {
+			return fmt.Errorf("failed to create composite key for vote status index: %v", err)
+		}
+		err = ctx.GetStub().DelState(previousIndexKey)
+		if err != nil {
+			return fmt.Errorf("failed to remove vote status index entry: %v", err)
+		}
+	}
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("VoteByStatus", []string{string(vote.Status), vote.VoteId})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for vote status index: %v", err)
+	}
+
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// GetVoteStatus returns the current status of a photo vote
+func (dr *DeviceRegistration) GetVoteStatus(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
+	fmt.Println("GET vote '", voteId, "'")
+	return getVote(ctx, voteId)
+}
+
 // GetPhotoMetadata returns the metadata for a specific photo
 func (dr *DeviceRegistration) GetPhotoMetadata(ctx contractapi.TransactionContextInterface, ipfsHash string) (*IPFSPhoto, error) {
 	photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{ipfsHash})
@@ -329,8 +894,14 @@ func (dr *DeviceRegistration) GetPhotoMetadata(ctx contractapi.TransactionContex
 	return &photo, nil
 }
 
-// StoreHelperData stores helper data after verifying the signature with the device's public key
-func (dr *DeviceRegistration) StoreHelperData(ctx contractapi.TransactionContextInterface, helper_data string, pub_key_hash string, signature string, nickname string) error {
+// StoreHelperData stores helper data for a VERIFIED device key after verifying the signature with its
+// public key; expectedVersion must match the stored record's version, 0 when none exists yet
+func (dr *DeviceRegistration) StoreHelperData(ctx contractapi.TransactionContextInterface, helper_data string, pub_key_hash string, signature string, nickname string, expectedVersion int) error {
+	return storeHelperData(ctx, helper_data, pub_key_hash, signature, nickname, expectedVersion)
+}
+
+// storeHelperData validates and stores one helper data record, writing nothing unless every check passes
+func storeHelperData(ctx contractapi.TransactionContextInterface, helper_data string, pub_key_hash string, signature string, nickname string, expectedVersion int) error {
 	// Get device key from state
 	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{pub_key_hash})
 	if err != nil {
@@ -351,20 +922,24 @@ func (dr *DeviceRegistration) StoreHelperData(ctx contractapi.TransactionContext
 		return fmt.Errorf("failed to unmarshal device key: %v", err)
 	}
 
-	// Verify signature
-	block, _ := pem.Decode([]byte(deviceKey.PublicKey))
-	if block == nil {
-		return fmt.Errorf("failed to decode public key")
+	// The hash must be the one StartPhotoVote derived from the stored PEM, and the key must be trusted
+	storedHash := fmt.Sprintf("%x", sha256.Sum256([]byte(deviceKey.PublicKey)))
+	if storedHash != pub_key_hash || deviceKey.PublicKeyHash != pub_key_hash {
+		return fmt.Errorf("device key %s does not match the hash of its stored public key", pub_key_hash)
+	}
+	if deviceKey.Status != DeviceStatusVerified {
+		return fmt.Errorf("device key %s is %s, helper data can only be stored for a VERIFIED device key", pub_key_hash, deviceKey.Status)
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	// Verify signature
+	pubKey, err := parsePublicKey(deviceKey.PublicKey)
 	if err != nil {
-		return fmt.Errorf("failed to parse public key: %v", err)
+		return err
 	}
 
 	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
 	if !ok {
-		return fmt.Errorf("public key is not RSA")
+		return fmt.Errorf("unsupported public key type %s: supported types are RSA", publicKeyTypeName(pubKey))
 	}
 
 	hashed := sha256.Sum256([]byte(helper_data))
@@ -373,41 +948,89 @@ func (dr *DeviceRegistration) StoreHelperData(ctx contractapi.TransactionContext
 		return fmt.Errorf("failed to decode signature: %v", err)
 	}
 
-	err = rsa.VerifyPSS(rsaPubKey, crypto.SHA256, hashed[:], sigBytes, nil)
+	config, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = validateNickname(nickname, config)
+	if err != nil {
+		return err
+	}
+
+	err = rsa.VerifyPSS(rsaPubKey, crypto.SHA256, hashed[:], sigBytes, pssOptions(config))
 	if err != nil {
 		return fmt.Errorf("invalid signature")
 	}
 
+	// A nickname stays bound to the first device key that registers it
+	nicknameOwnerKey, err := ctx.GetStub().CreateCompositeKey("NicknameOwner", []string{nickname})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for nickname owner: %v", err)
+	}
+
+	nicknameOwner, err := ctx.GetStub().GetState(nicknameOwnerKey)
+	if err != nil {
+		return fmt.Errorf("failed to read nickname owner from state: %v", err)
+	}
+	if nicknameOwner != nil && string(nicknameOwner) != pub_key_hash {
+		return fmt.Errorf("nickname %s is bound to a different device key", nickname)
+	}
+
 	// Store helper data using nickname as key
-	helperDataKey, err := ctx.GetStub().CreateCompositeKey("HelperData", []string{nickname})
+	current, err := findHelperDataRecord(ctx, nickname)
 	if err != nil {
-		return fmt.Errorf("failed to create composite key for helper data: %v", err)
+		return err
 	}
 
-	err = ctx.GetStub().PutState(helperDataKey, []byte(helper_data))
+	record, err := nextHelperDataRecord(ctx, current, nickname, expectedVersion, config)
 	if err != nil {
-		return fmt.Errorf("failed to store helper data: %v", err)
+		return err
 	}
 
-	return nil
+	// Bind the nickname only once the version check has passed, so a refused store writes nothing
+	if nicknameOwner == nil {
+		err = ctx.GetStub().PutState(nicknameOwnerKey, []byte(pub_key_hash))
+		if err != nil {
+			return fmt.Errorf("failed to bind nickname: %v", err)
+		}
+	}
+	record.DevicePublicKeyHash = pub_key_hash
+	record.Data = helper_data
+	record.Signature = strings.ToLower(signature)
+
+	return putHelperDataRecord(ctx, record)
 }
 
-// GetHelperData retrieves helper data for a device from the world state
-func (dr *DeviceRegistration) GetHelperData(ctx contractapi.TransactionContextInterface, nickname string) (string, error) {
-	helperDataKey, err := ctx.GetStub().CreateCompositeKey("HelperData", []string{nickname})
+// GetHelperData retrieves the helper data record for a nickname from the world state, refusing expired records
+func (dr *DeviceRegistration) GetHelperData(ctx contractapi.TransactionContextInterface, nickname string) (*HelperDataRecord, error) {
+	record, err := findHelperDataRecord(ctx, nickname)
 	if err != nil {
-		return "", fmt.Errorf("failed to create composite key for helper data: %v", err)
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("helper data for nickname %s does not exist", nickname)
 	}
 
-	helperData, err := ctx.GetStub().GetState(helperDataKey)
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expired, err := helperDataExpired(record, now)
 	if err != nil {
-		return "", fmt.Errorf("failed to read helper data from world state: %v", err)
+		return nil, err
 	}
-	if helperData == nil {
-		return "", fmt.Errorf("helper data for nickname %s does not exist", nickname)
+	// A refusal fails the transaction and would discard a delete, so expired records are removed by PurgeExpiredHelperData
+	if expired {
+		return nil, fmt.Errorf("helper data for nickname %s expired at %s", nickname, record.ExpiresAt)
 	}
 
-	return string(helperData), nil
+	return record, nil
+}
+
+// Ping is a liveness check that does not touch the world state
+func (dr *DeviceRegistration) Ping(ctx contractapi.TransactionContextInterface) (string, error) {
+	return pingToken + " " + contractVersion, nil
 }
 
 func main() {
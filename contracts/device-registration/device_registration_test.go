@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestContractMetadataBuilds(t *testing.T) {
+	if _, err := contractapi.NewChaincode(new(DeviceRegistration)); err != nil {
+		t.Fatalf("NewChaincode: %v", err)
+	}
+}
+
+func TestPingAnswersThroughTheChaincode(t *testing.T) {
+	e := newTestEnv(t)
+	response := e.invoke("Ping")
+	if response.Status != 200 || string(response.Payload) != "PONG "+contractVersion {
+		t.Fatalf("Ping answered %d %q %s", response.Status, response.Payload, response.Message)
+	}
+	if len(e.stub.State) != 0 {
+		t.Fatalf("Ping wrote %d records", len(e.stub.State))
+	}
+}
+
+func TestVoteCooldownPerDevice(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"voteCooldownSeconds": 3600}`)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "first")
+	if lastVoteAt := e.deviceKey(device.hash).LastVoteAt; lastVoteAt != "2025-01-01T00:00:00Z" {
+		t.Fatalf("LastVoteAt %s", lastVoteAt)
+	}
+
+	e.advance(59 * time.Minute)
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("too-soon")}, device.publicKey)
+	requireError(t, err)
+
+	e.advance(time.Minute)
+	e.startVote(device, "after-window")
+	if lastVoteAt := e.deviceKey(device.hash).LastVoteAt; lastVoteAt != "2025-01-01T01:00:00Z" {
+		t.Fatalf("LastVoteAt after the second vote %s", lastVoteAt)
+	}
+}
+
+func TestStartPhotoVoteVerifiesEveryPhotoWithOneKey(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "one", "two", "three", "four")
+	if len(vote.PhotoIPFSHashes) != 4 || e.deviceKey(device.hash).VerifiedSigCount != 4 {
+		t.Fatalf("vote %+v", vote)
+	}
+
+	// A bad signature anywhere in the set still fails the whole vote
+	photos := []IPFSPhoto{device.photo("five"), device.photo("six"), device.photo("seven")}
+	photos[2].Signature = newTestDevice(t, 1).sign("seven")
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), photos, device.publicKey)
+	requireError(t, err)
+}
+
+// benchmarkPhotos returns a device and a signed set of photos
+func benchmarkPhotos(b *testing.B, count int) (*testDevice, []IPFSPhoto) {
+	device := newTestDevice(b, 0)
+	photos := make([]IPFSPhoto, 0, count)
+	for i := 0; i < count; i++ {
+		photos = append(photos, device.photo(fmt.Sprintf("bench-%d", i)))
+	}
+	return device, photos
+}
+
+// BenchmarkPhotoSetVerificationParsedKey verifies a photo set against a key parsed once, as StartPhotoVote does
+func BenchmarkPhotoSetVerificationParsedKey(b *testing.B) {
+	config := defaultConfig()
+	device, photos := benchmarkPhotos(b, 10)
+	for i := 0; i < b.N; i++ {
+		pubKey, err := parsePublicKey(device.publicKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, photo := range photos {
+			if !verifyPhotoSignatureWithKey(photo, pubKey, "", pssOptions(&config)) {
+				b.Fatal("signature did not verify")
+			}
+		}
+	}
+}
+
+// BenchmarkPhotoSetVerificationReparsedKey verifies a photo set re-parsing the PEM key for every photo
+func BenchmarkPhotoSetVerificationReparsedKey(b *testing.B) {
+	config := defaultConfig()
+	device, photos := benchmarkPhotos(b, 10)
+	for i := 0; i < b.N; i++ {
+		for _, photo := range photos {
+			if !verifyPhotoSignature(photo, device.publicKey, "", pssOptions(&config)) {
+				b.Fatal("signature did not verify")
+			}
+		}
+	}
+}
+
+func TestPublicKeyPEMMustBePublicKeyBlock(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(device.key)}))
+	certificate, _ := device.certificateChain(t, "device-0")
+
+	for _, keyPEM := range []string{privateKey, certificate} {
+		_, err := parsePublicKey(keyPEM)
+		if err == nil || !strings.Contains(err.Error(), "unsupported PEM block type") {
+			t.Fatalf("parsePublicKey accepted %q: %v", keyPEM[:30], err)
+		}
+	}
+
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("private")}, privateKey)
+	requireError(t, err)
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("certificate")}, certificate)
+	requireError(t, err)
+
+	// Helper data is verified against the stored key with the same check
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(privateKey)))
+	e.putState("DeviceKey", []string{hash}, DeviceKey{PublicKeyHash: hash, PublicKey: privateKey, Status: DeviceStatusVerified})
+	err = e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", hash, device.sign("data"), "private-key", 0)
+	if err == nil || !strings.Contains(err.Error(), "unsupported PEM block type") {
+		t.Fatalf("StoreHelperData with a private key PEM: %v", err)
+	}
+}
+
+func TestDeviceCannotVoteOnItsOwnRegistration(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "self-approval")
+
+	requireError(t, e.dr.CastVote(e.ctxWithCertificate("device-peer", "Org1MSP", device), vote.VoteId, true))
+	if got := e.vote(vote.VoteId); got.Status != VoteStatusPending || len(got.Voters) != 0 {
+		t.Fatalf("self-vote was counted: %+v", got)
+	}
+	requireNoError(t, e.dr.CastVote(e.ctxWithCertificate("other-peer", "Org1MSP", newTestDevice(t, 1)), vote.VoteId, true))
+
+	e.setConfig(`{"blockDeviceSelfVote": false}`)
+	other := e.startVote(newTestDevice(t, 2), "allowed")
+	requireNoError(t, e.dr.CastVote(e.ctxWithCertificate("device-peer", "Org1MSP", newTestDevice(t, 2)), other.VoteId, true))
+}
+
+func TestVoteLookupAcceptsBareFirstPhotoHash(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVote(newTestDevice(t, 0), "lookup", "second")
+
+	for _, id := range []string{vote.VoteId, testCID("lookup")} {
+		got, err := e.dr.GetVoteStatus(e.admin(), id)
+		requireNoError(t, err)
+		if got.VoteId != vote.VoteId {
+			t.Fatalf("lookup by %s returned %s", id, got.VoteId)
+		}
+	}
+	requireNoError(t, e.dr.CastVote(e.ctx("voter-1", "Org1MSP"), testCID("lookup"), true))
+
+	for _, id := range []string{testCID("second"), "vote-" + testCID("second"), "unknown"} {
+		_, err := e.dr.GetVoteStatus(e.admin(), id)
+		if err == nil || !strings.Contains(err.Error(), "expected a vote ID") {
+			t.Fatalf("lookup by %s: %v", id, err)
+		}
+	}
+}
+
+func TestMaxPendingVotesPerDevice(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxPendingVotesPerDevice": 2, "thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING", "rejectOnRatio": true}}`)
+	device := newTestDevice(t, 0)
+	start := func(name string) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo(name)}, device.publicKey)
+		return err
+	}
+
+	first := e.startVote(device, "in-flight-1")
+	requireNoError(t, start("in-flight-2"))
+	err := start("over-cap")
+	if err == nil || !strings.Contains(err.Error(), "the limit is 2") {
+		t.Fatalf("StartPhotoVote over the cap: %v", err)
+	}
+	e.startVote(newTestDevice(t, 1), "other-device")
+
+	// A decided vote no longer counts towards the cap
+	e.cast(first.VoteId, "voter-1", false)
+	e.cast(first.VoteId, "voter-2", false)
+	if got := e.vote(first.VoteId).Status; got != VoteStatusRejected {
+		t.Fatalf("status after two invalid ballots %s", got)
+	}
+	requireNoError(t, start("after-rejection"))
+}
+
+func TestECDSASignatureEncodings(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	requireNoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	requireNoError(t, err)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: der}))
+
+	photo := newTestDevice(t, 0).photo("ecdsa")
+	hashed := sha256.Sum256([]byte(photoSigningPayload(photo)))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hashed[:])
+	requireNoError(t, err)
+	derSignature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	requireNoError(t, err)
+	rawSignature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	cases := []struct {
+		optionsJSON string
+		signature   []byte
+		valid       bool
+	}{
+		{`{}`, derSignature, true},
+		{`{"signatureEncoding": "DER"}`, derSignature, true},
+		{`{"signatureEncoding": "RAW"}`, rawSignature, true},
+		{`{}`, rawSignature, false},
+		{`{"signatureEncoding": "RAW"}`, derSignature, false},
+	}
+	for _, c := range cases {
+		e := newTestEnv(t)
+		signed := photo
+		signed.Signature = hex.EncodeToString(c.signature)
+		_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{signed}, publicKey, c.optionsJSON)
+		if (err == nil) != c.valid {
+			t.Errorf("options %s with a %d-byte signature: error %v, expected valid %v", c.optionsJSON, len(c.signature), err, c.valid)
+		}
+	}
+
+	e := newTestEnv(t)
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 0).photo("rsa")}, newTestDevice(t, 0).publicKey, `{"signatureEncoding": "RAW"}`)
+	requireError(t, err)
+}
+
+func TestTallyCappedAndGuardedAgainstOverflow(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxVotersPerVote": 3, "thresholds": {"minVoters": 3, "approvalRatio": 0.7, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "capped")
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", true)
+	e.cast(vote.VoteId, "voter-3", false)
+
+	err := e.dr.CastVote(e.ctx("voter-4", "Org1MSP"), vote.VoteId, true)
+	if err == nil || !strings.Contains(err.Error(), "capped at 3 ballots") {
+		t.Fatalf("CastVote past the cap: %v", err)
+	}
+	if got := e.vote(vote.VoteId); got.VoteCount != 3 || got.Status != VoteStatusPending {
+		t.Fatalf("tally after a refused ballot: %d votes, status %s", got.VoteCount, got.Status)
+	}
+
+	config := defaultConfig()
+	nearMax := &PhotoVote{VoteId: "near-max", VoteCount: math.MaxInt - 1}
+	requireNoError(t, checkTallyCapacity(nearMax, 1, &config))
+	requireError(t, checkTallyCapacity(nearMax, 2, &config))
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// DeviceKeyPage is one page of device keys with the bookmark for the next page
+type DeviceKeyPage struct {
+	DeviceKeys   []*DeviceKey `json:"deviceKeys"`
+	Bookmark     string       `json:"bookmark"`
+	FetchedCount int32        `json:"fetchedCount"`
+}
+
+// findDeviceKey reads a device key record by its public key hash, returning nil if it does not exist
+func findDeviceKey(ctx contractapi.TransactionContextInterface, pubKeyHash string) (*DeviceKey, error) {
+	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{pubKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device: %v", err)
+	}
+
+	deviceKeyJSON, err := ctx.GetStub().GetState(deviceKeyCompositeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device key from state: %v", err)
+	}
+	if deviceKeyJSON == nil {
+		return nil, nil
+	}
+
+	var deviceKey DeviceKey
+	err = json.Unmarshal(deviceKeyJSON, &deviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal device key: %v", err)
+	}
+
+	return &deviceKey, nil
+}
+
+// getDeviceKey reads a device key record by its public key hash
+func getDeviceKey(ctx contractapi.TransactionContextInterface, pubKeyHash string) (*DeviceKey, error) {
+	deviceKey, err := findDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if deviceKey == nil {
+		return nil, fmt.Errorf("device key %s does not exist", pubKeyHash)
+	}
+
+	return deviceKey, nil
+}
+
+// putDeviceKey stores a device key and moves its status index entry from previousStatus (empty for new keys)
+func putDeviceKey(ctx contractapi.TransactionContextInterface, deviceKey *DeviceKey, previousStatus DeviceStatus) error {
+	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{deviceKey.PublicKeyHash})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for device: %v", err)
+	}
+
+	err = validateDeviceStatus(deviceKey.Status)
+	if err != nil {
+		return err
+	}
+
+	deviceKeyJSON, err := json.Marshal(deviceKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal device key data: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(deviceKeyCompositeKey, deviceKeyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to store device key: %v", err)
+	}
+
+	if previousStatus == deviceKey.Status {
+		return nil
+	}
+
+	if previousStatus != "" {
+		previousIndexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByStatus", []string{string(previousStatus), deviceKey.PublicKeyHash})
+		if err != nil {
+			return fmt.Errorf("failed to create composite key for device status index: %v", err)
+		}
+		err = ctx.GetStub().DelState(previousIndexKey)
+		if err != nil {
+			return fmt.Errorf("failed to remove device status index entry: %v", err)
+		}
+	}
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByStatus", []string{string(deviceKey.Status), deviceKey.PublicKeyHash})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for device status index: %v", err)
+	}
+
+	// Only the key is needed; a nil value would delete the entry, so store a null byte
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// verifiedAtIndexKey builds the DeviceByVerifiedAt index key; the timestamp is inverted so the
+// ascending key order of range queries lists the most recent verification first
+func verifiedAtIndexKey(ctx contractapi.TransactionContextInterface, verifiedAt time.Time, pubKeyHash string) (string, error) {
+	inverted := fmt.Sprintf("%019d", math.MaxInt64-verifiedAt.Unix())
+	indexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByVerifiedAt", []string{inverted, pubKeyHash})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key for device verification index: %v", err)
+	}
+	return indexKey, nil
+}
+
+// deleteVerifiedAtIndexEntry removes a device key's verification index entry, if it was ever verified
+func deleteVerifiedAtIndexEntry(ctx contractapi.TransactionContextInterface, deviceKey *DeviceKey) error {
+	if deviceKey.VerifiedAt == "" {
+		return nil
+	}
+
+	previous, err := time.Parse(time.RFC3339, deviceKey.VerifiedAt)
+	if err != nil {
+		return fmt.Errorf("device key has invalid verification time: %v", err)
+	}
+	previousIndexKey, err := verifiedAtIndexKey(ctx, previous, deviceKey.PublicKeyHash)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelState(previousIndexKey)
+	if err != nil {
+		return fmt.Errorf("failed to remove device verification index entry: %v", err)
+	}
+
+	return nil
+}
+
+// setDeviceVerified marks a device key VERIFIED at the transaction time and moves its verification
+// index entry; the caller stores the key
+func setDeviceVerified(ctx contractapi.TransactionContextInterface, deviceKey *DeviceKey) error {
+	err := deleteVerifiedAtIndexEntry(ctx, deviceKey)
+	if err != nil {
+		return err
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+	deviceKey.Status = DeviceStatusVerified
+	deviceKey.VerifiedAt = txTime.Format(time.RFC3339)
+
+	indexKey, err := verifiedAtIndexKey(ctx, txTime, deviceKey.PublicKeyHash)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// RebuildDeviceIndexes indexes every stored device key under its status, and every VERIFIED key with a
+// recorded verification time by that time, for keys stored before those indexes existed (admin only);
+// it returns the number of device keys indexed
+func (dr *DeviceRegistration) RebuildDeviceIndexes(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	deviceKeys, err := getAllDeviceKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, deviceKey := range deviceKeys {
+		statusIndexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByStatus", []string{string(deviceKey.Status), deviceKey.PublicKeyHash})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create composite key for device status index: %v", err)
+		}
+		err = ctx.GetStub().PutState(statusIndexKey, []byte{0x00})
+		if err != nil {
+			return 0, fmt.Errorf("failed to store device status index entry: %v", err)
+		}
+
+		if deviceKey.Status != DeviceStatusVerified || deviceKey.VerifiedAt == "" {
+			continue
+		}
+		verifiedAt, err := time.Parse(time.RFC3339, deviceKey.VerifiedAt)
+		if err != nil {
+			return 0, fmt.Errorf("device key %s has invalid verification time: %v", deviceKey.PublicKeyHash, err)
+		}
+		verifiedAtKey, err := verifiedAtIndexKey(ctx, verifiedAt, deviceKey.PublicKeyHash)
+		if err != nil {
+			return 0, err
+		}
+		err = ctx.GetStub().PutState(verifiedAtKey, []byte{0x00})
+		if err != nil {
+			return 0, fmt.Errorf("failed to store device verification index entry: %v", err)
+		}
+	}
+
+	return len(deviceKeys), nil
+}
+
+// GetRecentlyVerifiedDevices returns up to limit VERIFIED device keys, most recently verified first.
+// It reads the verification index in order; entries left behind by keys that have since lost their
+// verification are skipped, and keys stored before the index existed are listed only once
+// RebuildDeviceIndexes has run and only when their verification time was recorded.
+func (dr *DeviceRegistration) GetRecentlyVerifiedDevices(ctx contractapi.TransactionContextInterface, limit int) ([]*DeviceKey, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceByVerifiedAt", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device verification index: %v", err)
+	}
+	defer iterator.Close()
+
+	deviceKeys := make([]*DeviceKey, 0, limit)
+	for iterator.HasNext() && len(deviceKeys) < limit {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device verification index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split device verification index key: %v", err)
+		}
+
+		deviceKey, err := findDeviceKey(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		if deviceKey == nil || deviceKey.Status != DeviceStatusVerified || deviceKey.VerifiedAt == "" {
+			continue
+		}
+		verifiedAt, err := time.Parse(time.RFC3339, deviceKey.VerifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("device key %s has invalid verification time: %v", deviceKey.PublicKeyHash, err)
+		}
+		currentIndexKey, err := verifiedAtIndexKey(ctx, verifiedAt, deviceKey.PublicKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		if currentIndexKey != entry.Key {
+			continue
+		}
+		deviceKeys = append(deviceKeys, deviceKey)
+	}
+
+	return deviceKeys, nil
+}
+
+// GetVerifiedDevices pages through VERIFIED device keys using the status index
+func (dr *DeviceRegistration) GetVerifiedDevices(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*DeviceKeyPage, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive")
+	}
+
+	iterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination("DeviceByStatus", []string{string(DeviceStatusVerified)}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device status index: %v", err)
+	}
+	defer iterator.Close()
+
+	page := &DeviceKeyPage{
+		DeviceKeys: make([]*DeviceKey, 0),
+	}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device status index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split device status index key: %v", err)
+		}
+
+		deviceKey, err := getDeviceKey(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		page.DeviceKeys = append(page.DeviceKeys, deviceKey)
+	}
+
+	page.Bookmark = metadata.GetBookmark()
+	page.FetchedCount = metadata.GetFetchedRecordsCount()
+
+	return page, nil
+}
+
+// GetDevicesPendingReverification returns the VERIFIED device keys whose verification is older than
+// the configured max age at the transaction time, oldest first. Keys verified before verification
+// times were recorded have no known age and are listed first.
+func (dr *DeviceRegistration) GetDevicesPendingReverification(ctx contractapi.TransactionContextInterface) ([]*DeviceKey, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config.VerificationMaxAgeSeconds == 0 {
+		return nil, fmt.Errorf("no verification max age is configured")
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := txTime.Add(-time.Duration(config.VerificationMaxAgeSeconds) * time.Second)
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceByStatus", []string{string(DeviceStatusVerified)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device status index: %v", err)
+	}
+	defer iterator.Close()
+
+	deviceKeys := make([]*DeviceKey, 0)
+	verifiedTimes := make(map[string]time.Time)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device status index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split device status index key: %v", err)
+		}
+
+		deviceKey, err := getDeviceKey(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+
+		var verifiedAt time.Time
+		if deviceKey.VerifiedAt != "" {
+			verifiedAt, err = time.Parse(time.RFC3339, deviceKey.VerifiedAt)
+			if err != nil {
+				return nil, fmt.Errorf("device key %s has invalid verification time: %v", deviceKey.PublicKeyHash, err)
+			}
+			if !verifiedAt.Before(cutoff) {
+				continue
+			}
+		}
+		verifiedTimes[deviceKey.PublicKeyHash] = verifiedAt
+		deviceKeys = append(deviceKeys, deviceKey)
+	}
+
+	// The index is ordered by key hash; a stable sort keeps that order among equally old keys
+	slices.SortStableFunc(deviceKeys, func(a, b *DeviceKey) int {
+		return verifiedTimes[a.PublicKeyHash].Compare(verifiedTimes[b.PublicKeyHash])
+	})
+
+	return deviceKeys, nil
+}
+
+// DeviceTrust is the trust decision for a device key
+type DeviceTrust struct {
+	PublicKeyHash string `json:"publicKeyHash"`
+	Trusted       bool   `json:"trusted"`
+	Reason        string `json:"reason"` // Why the key is or is not trusted
+}
+
+// IsDeviceTrusted decides whether a device key is currently trusted: it must exist, be VERIFIED and,
+// when a verification max age is configured, have been verified within it at the transaction time
+func (dr *DeviceRegistration) IsDeviceTrusted(ctx contractapi.TransactionContextInterface, pubKeyHash string) (*DeviceTrust, error) {
+	trust := &DeviceTrust{PublicKeyHash: pubKeyHash}
+
+	deviceKey, err := findDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if deviceKey == nil {
+		trust.Reason = "device key is not registered"
+		return trust, nil
+	}
+
+	switch deviceKey.Status {
+	case DeviceStatusVerified:
+	case DeviceStatusRevoked:
+		trust.Reason = "device key has been revoked"
+		return trust, nil
+	case DeviceStatusRotated:
+		trust.Reason = "device key has been rotated to a newer key"
+		return trust, nil
+	default:
+		trust.Reason = fmt.Sprintf("device key is %s", deviceKey.Status)
+		return trust, nil
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config.VerificationMaxAgeSeconds > 0 {
+		if deviceKey.VerifiedAt == "" {
+			trust.Reason = "device key verification time is unknown and due for re-verification"
+			return trust, nil
+		}
+		verifiedAt, err := time.Parse(time.RFC3339, deviceKey.VerifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("device key %s has invalid verification time: %v", deviceKey.PublicKeyHash, err)
+		}
+		txTime, err := getTxTime(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cutoff := txTime.Add(-time.Duration(config.VerificationMaxAgeSeconds) * time.Second)
+		if verifiedAt.Before(cutoff) {
+			trust.Reason = fmt.Sprintf("device key verification from %s has expired", deviceKey.VerifiedAt)
+			return trust, nil
+		}
+	}
+
+	trust.Trusted = true
+	trust.Reason = "device key is verified"
+	return trust, nil
+}
+
+// addDeviceVote appends a vote to the device's vote history index, ordered by creation time
+func addDeviceVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote) error {
+	indexKey, err := ctx.GetStub().CreateCompositeKey("DeviceVotes", []string{vote.DevicePublicKey, vote.CreatedAt, vote.VoteId})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for device vote index: %v", err)
+	}
+
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+// getDeviceVoteIds reads the IDs of all votes started for a device, oldest first
+func getDeviceVoteIds(ctx contractapi.TransactionContextInterface, pubKeyHash string) ([]string, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceVotes", []string{pubKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device vote index: %v", err)
+	}
+	defer iterator.Close()
+
+	voteIds := make([]string, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device vote index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split device vote index key: %v", err)
+		}
+		voteIds = append(voteIds, attributes[2])
+	}
+
+	return voteIds, nil
+}
+
+// RebuildDeviceVotesIndex indexes every stored vote under its device key, for votes started before the
+// index existed (admin only); it returns the number of votes indexed
+func (dr *DeviceRegistration) RebuildDeviceVotesIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, vote := range votes {
+		err = addDeviceVote(ctx, vote)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(votes), nil
+}
+
+// countInFlightDeviceVotes counts the device's votes that are PENDING or READY, using the device vote index
+func countInFlightDeviceVotes(ctx contractapi.TransactionContextInterface, pubKeyHash string) (int, error) {
+	voteIds, err := getDeviceVoteIds(ctx, pubKeyHash)
+	if err != nil {
+		return 0, err
+	}
+
+	inFlight := 0
+	for _, voteId := range voteIds {
+		vote, err := getVote(ctx, voteId)
+		if err != nil {
+			return 0, err
+		}
+		if vote.Status == VoteStatusPending || vote.Status == VoteStatusReady {
+			inFlight++
+		}
+	}
+
+	return inFlight, nil
+}
+
+// GetDeviceVoteIds returns the IDs of all votes started for a device, oldest first
+func (dr *DeviceRegistration) GetDeviceVoteIds(ctx contractapi.TransactionContextInterface, pubKeyHash string) ([]string, error) {
+	return getDeviceVoteIds(ctx, pubKeyHash)
+}
+
+// GetApprovingVotes returns the APPROVED votes started for a device, oldest first
+func (dr *DeviceRegistration) GetApprovingVotes(ctx contractapi.TransactionContextInterface, pubKeyHash string) ([]*PhotoVote, error) {
+	voteIds, err := getDeviceVoteIds(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	approving := make([]*PhotoVote, 0)
+	for _, voteId := range voteIds {
+		vote, err := getVote(ctx, voteId)
+		if err != nil {
+			return nil, err
+		}
+		if vote.Status == VoteStatusApproved {
+			approving = append(approving, vote)
+		}
+	}
+
+	return approving, nil
+}
+
+// GetVotesForRevokedDevices returns every vote started for a REVOKED device key, grouped by key in
+// hash order and oldest first within a key, by joining the device status and device vote indexes
+func (dr *DeviceRegistration) GetVotesForRevokedDevices(ctx contractapi.TransactionContextInterface) ([]*PhotoVote, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceByStatus", []string{string(DeviceStatusRevoked)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device status index: %v", err)
+	}
+	defer iterator.Close()
+
+	votes := make([]*PhotoVote, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device status index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split device status index key: %v", err)
+		}
+
+		voteIds, err := getDeviceVoteIds(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, voteId := range voteIds {
+			vote, err := getVote(ctx, voteId)
+			if err != nil {
+				return nil, err
+			}
+			votes = append(votes, vote)
+		}
+	}
+
+	return votes, nil
+}
+
+// DeviceForceVerifiedEvent is the payload of the DeviceForceVerified chaincode event
+type DeviceForceVerifiedEvent struct {
+	PublicKeyHash string `json:"publicKeyHash"`
+	AdminID       string `json:"adminId"`
+	Justification string `json:"justification"`
+}
+
+// ForceVerifyDevice marks a device key VERIFIED without a vote, recording who did it and why; REVOKED and
+// ROTATED keys are refused (admin only)
+func (dr *DeviceRegistration) ForceVerifyDevice(ctx contractapi.TransactionContextInterface, pubKeyHash string, justification string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if justification == "" {
+		return fmt.Errorf("a justification is required to force-verify a device")
+	}
+
+	adminID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	deviceKey, err := getDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return err
+	}
+	// A forced verification must neither undo a revocation nor verify a key its device rotated away from
+	if deviceKey.Status == DeviceStatusRevoked || deviceKey.Status == DeviceStatusRotated {
+		return fmt.Errorf("device key %s is %s and cannot be force-verified", pubKeyHash, deviceKey.Status)
+	}
+
+	previousStatus := deviceKey.Status
+	err = setDeviceVerified(ctx, deviceKey)
+	if err != nil {
+		return err
+	}
+	deviceKey.ForceVerifiedBy = adminID
+	deviceKey.ForceVerifyJustification = justification
+	err = putDeviceKey(ctx, deviceKey, previousStatus)
+	if err != nil {
+		return err
+	}
+
+	eventJSON, err := json.Marshal(DeviceForceVerifiedEvent{
+		PublicKeyHash: pubKeyHash,
+		AdminID:       adminID,
+		Justification: justification,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	return setEvent(ctx, "DeviceForceVerified", eventJSON)
+}
+
+// DeviceRevokedEvent is the payload of the DeviceRevoked chaincode event
+type DeviceRevokedEvent struct {
+	PublicKeyHash string `json:"publicKeyHash"`
+	AdminID       string `json:"adminId"`
+	Reason        string `json:"reason"`
+}
+
+// RevokeDevice marks a device key REVOKED so it is no longer trusted and cannot start votes, recording
+// who did it and why (admin only)
+func (dr *DeviceRegistration) RevokeDevice(ctx contractapi.TransactionContextInterface, pubKeyHash string, reason string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if reason == "" {
+		return fmt.Errorf("a reason is required to revoke a device")
+	}
+
+	adminID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	deviceKey, err := getDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return err
+	}
+	if deviceKey.Status == DeviceStatusRevoked {
+		return fmt.Errorf("device key %s is already revoked", pubKeyHash)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	previousStatus := deviceKey.Status
+	deviceKey.Status = DeviceStatusRevoked
+	deviceKey.RevokedBy = adminID
+	deviceKey.RevocationReason = reason
+	deviceKey.RevokedAt = txTime.Format(time.RFC3339)
+	err = putDeviceKey(ctx, deviceKey, previousStatus)
+	if err != nil {
+		return err
+	}
+
+	eventJSON, err := json.Marshal(DeviceRevokedEvent{
+		PublicKeyHash: pubKeyHash,
+		AdminID:       adminID,
+		Reason:        reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	return setEvent(ctx, "DeviceRevoked", eventJSON)
+}
+
+// rejectDeviceSelfVote returns an error if the caller's certificate carries the public key of the device under vote
+func rejectDeviceSelfVote(ctx contractapi.TransactionContextInterface, vote *PhotoVote) error {
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return fmt.Errorf("failed to get client certificate: %v", err)
+	}
+	if cert == nil {
+		return nil
+	}
+
+	deviceKey, err := findDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil || deviceKey == nil {
+		return err
+	}
+	devicePubKey, err := parsePublicKey(deviceKey.PublicKey)
+	if err != nil {
+		// A key that cannot be parsed cannot match any certificate
+		return nil
+	}
+
+	// Compare DER encodings so PEM formatting differences do not matter
+	voterDER, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil
+	}
+	deviceDER, err := x509.MarshalPKIXPublicKey(devicePubKey)
+	if err != nil {
+		return nil
+	}
+	if bytes.Equal(voterDER, deviceDER) {
+		return fmt.Errorf("device %s cannot vote on its own registration", vote.DevicePublicKey)
+	}
+
+	return nil
+}
+
+// rsaJWK is the JSON Web Key representation of an RSA public key (RFC 7517)
+type rsaJWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// GetDeviceKeyPEM returns a device's public key as "PEM", base64 "DER" or "JWK"
+func (dr *DeviceRegistration) GetDeviceKeyPEM(ctx contractapi.TransactionContextInterface, pubKeyHash string, format string) (string, error) {
+	if format != "PEM" && format != "DER" && format != "JWK" {
+		return "", fmt.Errorf("unsupported key format %s: supported formats are PEM, DER and JWK", format)
+	}
+
+	deviceKey, err := getDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return "", err
+	}
+	if format == "PEM" {
+		return deviceKey.PublicKey, nil
+	}
+
+	pubKey, err := parsePublicKey(deviceKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if format == "DER" {
+		der, err := x509.MarshalPKIXPublicKey(pubKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode public key: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(der), nil
+	}
+
+	rsaPubKey, ok := pubKey.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("JWK export supports RSA keys only, got %s", publicKeyTypeName(pubKey))
+	}
+
+	jwk, err := json.Marshal(rsaJWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(rsaPubKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaPubKey.E)).Bytes()),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JWK: %v", err)
+	}
+	return string(jwk), nil
+}
+
+// DeviceKeyRotatedEvent is the payload of the DeviceKeyRotated chaincode event
+type DeviceKeyRotatedEvent struct {
+	OldPublicKeyHash string   `json:"oldPublicKeyHash"`
+	NewPublicKeyHash string   `json:"newPublicKeyHash"`
+	Nicknames        []string `json:"nicknames"` // Nicknames whose binding moved to the new key
+}
+
+// RotateDeviceKey replaces a VERIFIED device key with a new one without a vote; the old key must sign
+// the new public key, the new key inherits VERIFIED and the old key's nicknames, and both records keep
+// a link to each other
+func (dr *DeviceRegistration) RotateDeviceKey(ctx contractapi.TransactionContextInterface, oldPubKeyHash string, newPublicKey string, signature string) (*DeviceKey, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oldDeviceKey, err := getDeviceKey(ctx, oldPubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if oldDeviceKey.Status != DeviceStatusVerified {
+		return nil, fmt.Errorf("device key %s is %s, only VERIFIED keys can be rotated", oldPubKeyHash, oldDeviceKey.Status)
+	}
+
+	// The rotation is authorised by the old key signing the new key exactly as submitted
+	oldPubKey, err := parsePublicKey(oldDeviceKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	rsaOldPubKey, ok := oldPubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %s: supported types are RSA", publicKeyTypeName(oldPubKey))
+	}
+
+	hashed := sha256.Sum256([]byte(newPublicKey))
+	sigBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %v", err)
+	}
+	err = rsa.VerifyPSS(rsaOldPubKey, crypto.SHA256, hashed[:], sigBytes, pssOptions(config))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation signature")
+	}
+
+	newPublicKey, certificateChain, err := resolveDevicePublicKey(ctx, newPublicKey, config)
+	if err != nil {
+		return nil, err
+	}
+	newPubKey, err := parsePublicKey(newPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := newPubKey.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %s: supported types are RSA", publicKeyTypeName(newPubKey))
+	}
+
+	newPubKeyHash := fmt.Sprintf("%x", sha256.Sum256([]byte(newPublicKey)))
+	existing, err := findDeviceKey(ctx, newPubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("device key %s already exists", newPubKeyHash)
+	}
+
+	newDeviceKey := &DeviceKey{
+		PublicKeyHash:    newPubKeyHash,
+		PublicKey:        newPublicKey,
+		LastVoteAt:       oldDeviceKey.LastVoteAt,
+		CertificateChain: certificateChain,
+		RotatedFrom:      oldPubKeyHash,
+	}
+	err = setDeviceVerified(ctx, newDeviceKey)
+	if err != nil {
+		return nil, err
+	}
+	err = putDeviceKey(ctx, newDeviceKey, "")
+	if err != nil {
+		return nil, err
+	}
+
+	oldDeviceKey.Status = DeviceStatusRotated
+	oldDeviceKey.RotatedTo = newPubKeyHash
+	err = putDeviceKey(ctx, oldDeviceKey, DeviceStatusVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	nicknames, err := rebindDeviceNicknames(ctx, oldPubKeyHash, newPubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	eventJSON, err := json.Marshal(DeviceKeyRotatedEvent{
+		OldPublicKeyHash: oldPubKeyHash,
+		NewPublicKeyHash: newPubKeyHash,
+		Nicknames:        nicknames,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = setEvent(ctx, "DeviceKeyRotated", eventJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return newDeviceKey, nil
+}
+
+// DeviceDeregistration summarizes the state DeregisterDevice removed; it is also the payload of the
+// DeviceDeregistered chaincode event
+type DeviceDeregistration struct {
+	PublicKeyHash       string   `json:"publicKeyHash"`
+	DeviceVoteEntries   int      `json:"deviceVoteEntries"`   // Device vote index entries removed; the votes themselves are kept
+	HelperDataNicknames []string `json:"helperDataNicknames"` // Nicknames whose helper data and binding were removed
+}
+
+// DeregisterDevice removes a device key with its status, verification and vote index entries and the helper
+// data bound to it; a device with votes still PENDING or READY cannot be deregistered (admin only)
+func (dr *DeviceRegistration) DeregisterDevice(ctx contractapi.TransactionContextInterface, pubKeyHash string) (*DeviceDeregistration, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	deviceKey, err := getDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	inFlight, err := countInFlightDeviceVotes(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if inFlight > 0 {
+		return nil, fmt.Errorf("device key %s has %d votes in progress", pubKeyHash, inFlight)
+	}
+
+	deviceKeyCompositeKey, err := ctx.GetStub().CreateCompositeKey("DeviceKey", []string{pubKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device: %v", err)
+	}
+	err = ctx.GetStub().DelState(deviceKeyCompositeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete device key: %v", err)
+	}
+
+	statusIndexKey, err := ctx.GetStub().CreateCompositeKey("DeviceByStatus", []string{string(deviceKey.Status), pubKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for device status index: %v", err)
+	}
+	err = ctx.GetStub().DelState(statusIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove device status index entry: %v", err)
+	}
+
+	err = deleteVerifiedAtIndexEntry(ctx, deviceKey)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &DeviceDeregistration{PublicKeyHash: pubKeyHash}
+
+	// Deletes are not visible to reads within the transaction, so the iterator still sees every entry
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceVotes", []string{pubKeyHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device vote index: %v", err)
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device vote index: %v", err)
+		}
+		err = ctx.GetStub().DelState(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove device vote index entry: %v", err)
+		}
+		summary.DeviceVoteEntries++
+	}
+
+	summary.HelperDataNicknames, err = deleteDeviceHelperData(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	eventJSON, err := json.Marshal(summary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+	err = setEvent(ctx, "DeviceDeregistered", eventJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRevokeDeviceRecordsAdminAndReason(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "revoked")
+
+	requireError(t, e.dr.RevokeDevice(e.ctx("user", "Org2MSP"), device.hash, "compromised"))
+	requireError(t, e.dr.RevokeDevice(e.admin(), device.hash, ""))
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+	if event := e.lastEvent(); event != "DeviceRevoked" {
+		t.Fatalf("last event = %q, want DeviceRevoked", event)
+	}
+
+	deviceKey := e.deviceKey(device.hash)
+	if deviceKey.Status != DeviceStatusRevoked || deviceKey.RevokedBy != "admin" || deviceKey.RevocationReason != "compromised" || deviceKey.RevokedAt == "" {
+		t.Fatalf("revoked device key = %+v", deviceKey)
+	}
+	requireError(t, e.dr.RevokeDevice(e.admin(), device.hash, "again"))
+
+	trust, err := e.dr.IsDeviceTrusted(e.admin(), device.hash)
+	requireNoError(t, err)
+	if trust.Trusted {
+		t.Fatal("revoked device key is trusted")
+	}
+}
+
+func TestRevokedDeviceCannotStartVote(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "first")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("second")}, device.publicKey)
+	requireError(t, err)
+}
+
+func TestApprovalDoesNotRestoreRevokedDevice(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "pending")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusFlagged {
+		t.Fatalf("vote status = %s, want FLAGGED", got)
+	}
+	if got := e.deviceKey(device.hash).Status; got != DeviceStatusRevoked {
+		t.Fatalf("device status = %s, want REVOKED", got)
+	}
+
+	votes, err := e.dr.GetVotesForRevokedDevices(e.admin())
+	requireNoError(t, err)
+	if len(votes) != 1 || votes[0].VoteId != vote.VoteId {
+		t.Fatalf("votes for revoked devices = %v, want %s", votes, vote.VoteId)
+	}
+}
+
+func TestRotateDeviceKeyMovesNicknameBindings(t *testing.T) {
+	e := newTestEnv(t)
+	oldDevice := newTestDevice(t, 0)
+	newDevice := newTestDevice(t, 1)
+	e.startVote(oldDevice, "rotation")
+	e.verifyDevice(oldDevice.hash)
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("user", "Org1MSP"), "helper-v1", oldDevice.hash, oldDevice.sign("helper-v1"), "alice", 0))
+
+	_, err := e.dr.RotateDeviceKey(e.ctx("user", "Org1MSP"), oldDevice.hash, newDevice.publicKey, oldDevice.sign(newDevice.publicKey))
+	requireNoError(t, err)
+
+	if owner := string(e.getState("NicknameOwner", "alice")); owner != newDevice.hash {
+		t.Fatalf("nickname bound to %s, want the new key %s", owner, newDevice.hash)
+	}
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("user", "Org1MSP"), "helper-v2", newDevice.hash, newDevice.sign("helper-v2"), "alice", 1))
+}
+
+func TestGetVerifiedDevicesPagesThroughVerifiedKeysOnly(t *testing.T) {
+	e := newTestEnv(t)
+	verified := make([]string, 0)
+	for n := 0; n < 6; n++ {
+		device := newTestDevice(t, n)
+		e.startVote(device, fmt.Sprintf("device-%d", n))
+		if n%2 == 0 {
+			e.verifyDevice(device.hash)
+			verified = append(verified, device.hash)
+		}
+	}
+
+	listed := make([]string, 0)
+	bookmark := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("pagination did not end")
+		}
+		page, err := e.dr.GetVerifiedDevices(e.admin(), 2, bookmark)
+		requireNoError(t, err)
+		for _, deviceKey := range page.DeviceKeys {
+			if deviceKey.Status != DeviceStatusVerified {
+				t.Fatalf("listed %s device %s", deviceKey.Status, deviceKey.PublicKeyHash)
+			}
+			listed = append(listed, deviceKey.PublicKeyHash)
+		}
+		if page.FetchedCount < 2 {
+			break
+		}
+		bookmark = page.Bookmark
+	}
+
+	slices.Sort(verified)
+	slices.Sort(listed)
+	if !slices.Equal(listed, verified) {
+		t.Fatalf("listed %v, expected %v", listed, verified)
+	}
+
+	_, err := e.dr.GetVerifiedDevices(e.admin(), 0, "")
+	requireError(t, err)
+}
+
+func TestDeviceVoteIndexGrowsInOrder(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	expected := make([]string, 0)
+	for _, name := range []string{"c-first", "a-second", "b-third"} {
+		expected = append(expected, e.startVote(device, name).VoteId)
+		e.advance(time.Minute)
+
+		voteIds, err := e.dr.GetDeviceVoteIds(e.admin(), device.hash)
+		requireNoError(t, err)
+		if !slices.Equal(voteIds, expected) {
+			t.Fatalf("device votes %v, expected %v", voteIds, expected)
+		}
+	}
+
+	voteIds, err := e.dr.GetDeviceVoteIds(e.admin(), newTestDevice(t, 1).hash)
+	requireNoError(t, err)
+	if len(voteIds) != 0 {
+		t.Fatalf("unknown device has votes %v", voteIds)
+	}
+}
+
+func TestForceVerifyDeviceRecordsAdminAndJustification(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "bootstrap")
+
+	requireError(t, e.dr.ForceVerifyDevice(e.ctx("user", "Org2MSP"), device.hash, "migration"))
+	if got := e.deviceKey(device.hash).Status; got == DeviceStatusVerified {
+		t.Fatal("non-admin force-verified a device key")
+	}
+	requireError(t, e.dr.ForceVerifyDevice(e.admin(), device.hash, ""))
+
+	requireNoError(t, e.dr.ForceVerifyDevice(e.admin(), device.hash, "migration"))
+	if event := e.lastEvent(); event != "DeviceForceVerified" {
+		t.Fatalf("last event = %q, want DeviceForceVerified", event)
+	}
+	deviceKey := e.deviceKey(device.hash)
+	if deviceKey.Status != DeviceStatusVerified || deviceKey.ForceVerifiedBy != "admin" || deviceKey.ForceVerifyJustification != "migration" {
+		t.Fatalf("force-verified device key = %+v", deviceKey)
+	}
+}
+
+func TestForceVerifyDeviceRefusesRevokedAndRotatedKeys(t *testing.T) {
+	e := newTestEnv(t)
+	revoked := newTestDevice(t, 0)
+	e.startVote(revoked, "revoked")
+	e.verifyDevice(revoked.hash)
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), revoked.hash, "compromised"))
+	err := e.dr.ForceVerifyDevice(e.admin(), revoked.hash, "restore")
+	if err == nil || !strings.Contains(err.Error(), "REVOKED") {
+		t.Fatalf("ForceVerifyDevice on a revoked key: %v", err)
+	}
+
+	e = newTestEnv(t)
+	rotated, replacement := newTestDevice(t, 1), newTestDevice(t, 2)
+	e.startVote(rotated, "rotated")
+	e.verifyDevice(rotated.hash)
+	_, err = e.dr.RotateDeviceKey(e.ctx("user", "Org1MSP"), rotated.hash, replacement.publicKey, rotated.sign(replacement.publicKey))
+	requireNoError(t, err)
+	err = e.dr.ForceVerifyDevice(e.admin(), rotated.hash, "restore")
+	if err == nil || !strings.Contains(err.Error(), "ROTATED") {
+		t.Fatalf("ForceVerifyDevice on a rotated key: %v", err)
+	}
+	if got := e.deviceKey(rotated.hash).Status; got != DeviceStatusRotated {
+		t.Fatalf("rotated key is %s after the refused verification", got)
+	}
+}
+
+func TestGetApprovingVotesSkipsRejectedVotes(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 1, "approvalRatio": 0.5, "tieBreak": "PENDING", "rejectOnRatio": true}}`)
+	device := newTestDevice(t, 0)
+	for _, name := range []string{"rejected-1", "rejected-2", "rejected-3"} {
+		rejected := e.startVote(device, name)
+		e.cast(rejected.VoteId, "voter-1", false)
+	}
+	approved := e.startVote(device, "approved")
+	e.cast(approved.VoteId, "voter-2", true)
+
+	votes, err := e.dr.GetApprovingVotes(e.admin(), device.hash)
+	requireNoError(t, err)
+	if len(votes) != 1 || votes[0].VoteId != approved.VoteId || !slices.Equal(votes[0].Voters, []string{"voter-2"}) {
+		t.Fatalf("approving votes %v, expected only %s with its voter", voteIds(votes), approved.VoteId)
+	}
+}
+
+func TestGetDeviceKeyPEMConvertsFormats(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "key-formats")
+
+	keyPEM, err := e.dr.GetDeviceKeyPEM(e.admin(), device.hash, "PEM")
+	requireNoError(t, err)
+	if keyPEM != device.publicKey {
+		t.Fatalf("PEM output %q, expected the stored key", keyPEM)
+	}
+
+	keyDER, err := e.dr.GetDeviceKeyPEM(e.admin(), device.hash, "DER")
+	requireNoError(t, err)
+	expectedDER, err := x509.MarshalPKIXPublicKey(&device.key.PublicKey)
+	requireNoError(t, err)
+	if keyDER != base64.StdEncoding.EncodeToString(expectedDER) {
+		t.Fatalf("DER output %q", keyDER)
+	}
+
+	keyJWK, err := e.dr.GetDeviceKeyPEM(e.admin(), device.hash, "JWK")
+	requireNoError(t, err)
+	var jwk map[string]string
+	requireNoError(t, json.Unmarshal([]byte(keyJWK), &jwk))
+	if jwk["kty"] != "RSA" || jwk["n"] != base64.RawURLEncoding.EncodeToString(device.key.N.Bytes()) || jwk["e"] != "AQAB" {
+		t.Fatalf("JWK output %s", keyJWK)
+	}
+
+	_, err = e.dr.GetDeviceKeyPEM(e.admin(), device.hash, "SSH")
+	if err == nil || !strings.Contains(err.Error(), "unsupported key format SSH") {
+		t.Fatalf("GetDeviceKeyPEM with an unsupported format: %v", err)
+	}
+}
+
+func TestGetRecentlyVerifiedDevicesNewestFirst(t *testing.T) {
+	e := newTestEnv(t)
+	devices := []*testDevice{newTestDevice(t, 0), newTestDevice(t, 1), newTestDevice(t, 2), newTestDevice(t, 3)}
+	for i, device := range devices {
+		e.startVote(device, fmt.Sprintf("recent-%d", i))
+	}
+	for _, device := range devices[:3] {
+		e.verifyDevice(device.hash)
+		e.advance(time.Minute)
+	}
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), devices[1].hash, "compromised"))
+
+	recent, err := e.dr.GetRecentlyVerifiedDevices(e.admin(), 5)
+	requireNoError(t, err)
+	hashes := make([]string, 0, len(recent))
+	for _, deviceKey := range recent {
+		hashes = append(hashes, deviceKey.PublicKeyHash)
+	}
+	if !slices.Equal(hashes, []string{devices[2].hash, devices[0].hash}) {
+		t.Fatalf("recently verified devices %v, expected device 2 then device 0", hashes)
+	}
+
+	recent, err = e.dr.GetRecentlyVerifiedDevices(e.admin(), 1)
+	requireNoError(t, err)
+	if len(recent) != 1 || recent[0].PublicKeyHash != devices[2].hash {
+		t.Fatalf("limit 1 returned %d devices", len(recent))
+	}
+	_, err = e.dr.GetRecentlyVerifiedDevices(e.admin(), 0)
+	requireError(t, err)
+}
+
+func TestRebuildDeviceVotesIndexRestoresLegacyVotes(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxPendingVotesPerDevice": 2}`)
+	device := newTestDevice(t, 0)
+	first := e.startVote(device, "legacy-1")
+	e.advance(time.Minute)
+	second := e.startVote(device, "legacy-2")
+
+	// Votes started before the index existed have no entries in it
+	for _, vote := range []*PhotoVote{first, second} {
+		e.delState("DeviceVotes", device.hash, vote.CreatedAt, vote.VoteId)
+	}
+	ids, err := e.dr.GetDeviceVoteIds(e.admin(), device.hash)
+	requireNoError(t, err)
+	if len(ids) != 0 {
+		t.Fatalf("device votes before the rebuild %v", ids)
+	}
+
+	_, err = e.dr.RebuildDeviceVotesIndex(e.ctx("user", "Org2MSP"))
+	requireError(t, err)
+	indexed, err := e.dr.RebuildDeviceVotesIndex(e.admin())
+	requireNoError(t, err)
+	if indexed != 2 {
+		t.Fatalf("rebuild indexed %d votes", indexed)
+	}
+	ids, err = e.dr.GetDeviceVoteIds(e.admin(), device.hash)
+	requireNoError(t, err)
+	if !slices.Equal(ids, []string{first.VoteId, second.VoteId}) {
+		t.Fatalf("device votes after the rebuild %v", ids)
+	}
+
+	// The in-flight cap counts the restored votes again
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("legacy-3")}, device.publicKey)
+	if err == nil || !strings.Contains(err.Error(), "already has 2 votes in progress") {
+		t.Fatalf("StartPhotoVote over the in-flight cap: %v", err)
+	}
+}
+
+func TestRebuildDeviceIndexesBackfillsLegacyKeys(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"verificationMaxAgeSeconds": 86400}`)
+	dated, undated, revoked := newTestDevice(t, 0), newTestDevice(t, 1), newTestDevice(t, 2)
+	// Raw device keys as stored before the status and verification indexes existed
+	e.putState("DeviceKey", []string{dated.hash}, DeviceKey{PublicKeyHash: dated.hash, PublicKey: dated.publicKey, Status: DeviceStatusVerified, VerifiedAt: "2024-06-01T00:00:00Z"})
+	e.putState("DeviceKey", []string{undated.hash}, DeviceKey{PublicKeyHash: undated.hash, PublicKey: undated.publicKey, Status: DeviceStatusVerified})
+	vote := e.startVote(revoked, "legacy-revoked")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), revoked.hash, "compromised"))
+	e.delState("DeviceByStatus", string(DeviceStatusRevoked), revoked.hash)
+
+	listed := func() (verified []string, recent []string, pending []string, revokedVotes []string) {
+		t.Helper()
+		page, err := e.dr.GetVerifiedDevices(e.admin(), 10, "")
+		requireNoError(t, err)
+		for _, deviceKey := range page.DeviceKeys {
+			verified = append(verified, deviceKey.PublicKeyHash)
+		}
+		recentKeys, err := e.dr.GetRecentlyVerifiedDevices(e.admin(), 10)
+		requireNoError(t, err)
+		for _, deviceKey := range recentKeys {
+			recent = append(recent, deviceKey.PublicKeyHash)
+		}
+		pendingKeys, err := e.dr.GetDevicesPendingReverification(e.admin())
+		requireNoError(t, err)
+		for _, deviceKey := range pendingKeys {
+			pending = append(pending, deviceKey.PublicKeyHash)
+		}
+		votes, err := e.dr.GetVotesForRevokedDevices(e.admin())
+		requireNoError(t, err)
+		return verified, recent, pending, voteIds(votes)
+	}
+	if verified, recent, pending, revokedVotes := listed(); len(verified)+len(recent)+len(pending)+len(revokedVotes) != 0 {
+		t.Fatalf("legacy keys listed before the rebuild: %v %v %v %v", verified, recent, pending, revokedVotes)
+	}
+
+	_, err := e.dr.RebuildDeviceIndexes(e.ctx("user", "Org2MSP"))
+	requireError(t, err)
+	indexed, err := e.dr.RebuildDeviceIndexes(e.admin())
+	requireNoError(t, err)
+	if indexed != 3 {
+		t.Fatalf("rebuild indexed %d device keys", indexed)
+	}
+
+	verified, recent, pending, revokedVotes := listed()
+	expected := []string{dated.hash, undated.hash}
+	slices.Sort(expected)
+	if !slices.Equal(verified, expected) {
+		t.Fatalf("verified devices after the rebuild %v, want %v", verified, expected)
+	}
+	// Only a recorded verification time can be indexed; an unknown age is due for re-verification first
+	if !slices.Equal(recent, []string{dated.hash}) {
+		t.Fatalf("recently verified devices after the rebuild %v", recent)
+	}
+	if !slices.Equal(pending, []string{undated.hash, dated.hash}) {
+		t.Fatalf("devices pending re-verification after the rebuild %v", pending)
+	}
+	if !slices.Equal(revokedVotes, []string{vote.VoteId}) {
+		t.Fatalf("votes for revoked devices after the rebuild %v", revokedVotes)
+	}
+}
+
+func TestDeregisterDeviceRemovesLinkedStateOnly(t *testing.T) {
+	e := newTestEnv(t)
+	removed := newTestDevice(t, 0)
+	kept := newTestDevice(t, 1)
+	var votes []*PhotoVote
+	for _, device := range []*testDevice{removed, kept} {
+		vote := e.startVote(device, "deregister-"+device.hash[:8])
+		e.cast(vote.VoteId, "voter-1", true)
+		votes = append(votes, vote)
+		requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), "nick-"+device.hash[:8], 0))
+	}
+	pending := e.startVote(removed, "deregister-pending")
+
+	_, err := e.dr.DeregisterDevice(e.ctx("user", "Org2MSP"), removed.hash)
+	requireError(t, err)
+	_, err = e.dr.DeregisterDevice(e.admin(), removed.hash)
+	requireError(t, err)
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), removed.hash, "decommissioned"))
+	e.cast(pending.VoteId, "voter-1", true)
+
+	summary, err := e.dr.DeregisterDevice(e.admin(), removed.hash)
+	requireNoError(t, err)
+	if summary.DeviceVoteEntries != 2 || !slices.Equal(summary.HelperDataNicknames, []string{"nick-" + removed.hash[:8]}) {
+		t.Fatalf("deregistration summary %+v", summary)
+	}
+	if e.getState("DeviceKey", removed.hash) != nil || e.getState("DeviceByStatus", string(DeviceStatusRevoked), removed.hash) != nil {
+		t.Fatal("device key or its status index entry left behind")
+	}
+	if e.getState("HelperData", "nick-"+removed.hash[:8]) != nil || e.getState("NicknameOwner", "nick-"+removed.hash[:8]) != nil {
+		t.Fatal("helper data or nickname binding left behind")
+	}
+	if ids, err := getDeviceVoteIds(e.admin(), removed.hash); err != nil || len(ids) != 0 {
+		t.Fatalf("device vote index entries left behind: %v, %v", ids, err)
+	}
+	if e.getState("PhotoVote", votes[0].VoteId) == nil {
+		t.Fatal("the deregistered device's votes were deleted")
+	}
+
+	if e.deviceKey(kept.hash).Status != DeviceStatusVerified || e.getState("HelperData", "nick-"+kept.hash[:8]) == nil {
+		t.Fatal("unrelated device state changed")
+	}
+	if ids, err := getDeviceVoteIds(e.admin(), kept.hash); err != nil || !slices.Equal(ids, []string{votes[1].VoteId}) {
+		t.Fatalf("unrelated device vote index %v, %v", ids, err)
+	}
+}
+
+func TestGetDevicesPendingReverificationByAge(t *testing.T) {
+	e := newTestEnv(t)
+	devices := []*testDevice{newTestDevice(t, 0), newTestDevice(t, 1), newTestDevice(t, 2), newTestDevice(t, 3)}
+	for i, device := range devices {
+		e.startVote(device, fmt.Sprintf("reverify-%d", i))
+	}
+	_, err := e.dr.GetDevicesPendingReverification(e.admin())
+	requireError(t, err)
+	e.setConfig(`{"verificationMaxAgeSeconds": 10800}`)
+
+	// Verified 5h, 4h and 1h before the query; the last key predates recorded verification times
+	for _, device := range devices[:2] {
+		e.verifyDevice(device.hash)
+		e.advance(time.Hour)
+	}
+	e.advance(2 * time.Hour)
+	e.verifyDevice(devices[2].hash)
+	e.verifyDevice(devices[3].hash)
+	legacy := e.deviceKey(devices[3].hash)
+	legacy.VerifiedAt = ""
+	requireNoError(t, putDeviceKey(e.admin(), legacy, legacy.Status))
+	e.advance(time.Hour)
+
+	due, err := e.dr.GetDevicesPendingReverification(e.admin())
+	requireNoError(t, err)
+	hashes := make([]string, 0, len(due))
+	for _, deviceKey := range due {
+		hashes = append(hashes, deviceKey.PublicKeyHash)
+	}
+	if !slices.Equal(hashes, []string{devices[3].hash, devices[0].hash, devices[1].hash}) {
+		t.Fatalf("devices due for re-verification %v, expected the legacy key, then the 5h and 4h old keys", hashes)
+	}
+}
+
+func TestIsDeviceTrustedDecisions(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"verificationMaxAgeSeconds": 3600}`)
+	verified, revoked, expired, unverified := newTestDevice(t, 0), newTestDevice(t, 1), newTestDevice(t, 2), newTestDevice(t, 3)
+	for i, device := range []*testDevice{verified, revoked, expired, unverified} {
+		e.startVote(device, fmt.Sprintf("trust-%d", i))
+	}
+	e.verifyDevice(expired.hash)
+	e.advance(2 * time.Hour)
+	e.verifyDevice(verified.hash)
+	e.verifyDevice(revoked.hash)
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), revoked.hash, "compromised"))
+
+	cases := []struct {
+		hash    string
+		trusted bool
+		reason  string
+	}{
+		{verified.hash, true, "is verified"},
+		{revoked.hash, false, "revoked"},
+		{expired.hash, false, "has expired"},
+		{unverified.hash, false, "is UNVERIFIED"},
+		{"unknown", false, "not registered"},
+	}
+	for _, c := range cases {
+		trust, err := e.dr.IsDeviceTrusted(e.admin(), c.hash)
+		requireNoError(t, err)
+		if trust.Trusted != c.trusted || !strings.Contains(trust.Reason, c.reason) {
+			t.Errorf("trust of %s: %+v, expected trusted %v with reason %q", c.hash, trust, c.trusted, c.reason)
+		}
+	}
+}
+
+func TestGetVotesForRevokedDevices(t *testing.T) {
+	e := newTestEnv(t)
+	none, err := e.dr.GetVotesForRevokedDevices(e.admin())
+	requireNoError(t, err)
+	if len(none) != 0 {
+		t.Fatalf("%d votes before any revocation", len(none))
+	}
+
+	revoked, active, revokedPending := newTestDevice(t, 0), newTestDevice(t, 1), newTestDevice(t, 2)
+	first := e.startVote(revoked, "revoked-1")
+	e.cast(first.VoteId, "voter-1", true)
+	e.advance(time.Minute)
+	second := e.startVote(revoked, "revoked-2")
+	approved := e.startVote(active, "active")
+	e.cast(approved.VoteId, "voter-1", true)
+	pending := e.startVote(revokedPending, "revoked-pending")
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), revoked.hash, "compromised"))
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), revokedPending.hash, "compromised"))
+
+	groups := map[string][]string{revoked.hash: {first.VoteId, second.VoteId}, revokedPending.hash: {pending.VoteId}}
+	hashes := []string{revoked.hash, revokedPending.hash}
+	slices.Sort(hashes)
+	var expected []string
+	for _, hash := range hashes {
+		expected = append(expected, groups[hash]...)
+	}
+
+	votes, err := e.dr.GetVotesForRevokedDevices(e.admin())
+	requireNoError(t, err)
+	if got := voteIds(votes); !slices.Equal(got, expected) {
+		t.Fatalf("votes for revoked devices %v, want %v", got, expected)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// HelperDataRecord is the fuzzy extractor helper data stored for a nickname
+type HelperDataRecord struct {
+	Nickname            string `json:"nickname"`
+	DevicePublicKeyHash string `json:"devicePublicKeyHash"`
+	Data                string `json:"data"`
+	Signature           string `json:"signature"` // Lowercase hex PSS signature of Data by the device key
+	Version             int    `json:"version"`   // Incremented on every store, starting at 1
+	CreatedAt           string `json:"createdAt"`
+	UpdatedAt           string `json:"updatedAt"`
+	ExpiresAt           string `json:"expiresAt,omitempty" metadata:",optional"` // RFC3339 time after which the record is refused and may be purged, empty to keep it indefinitely
+}
+
+// HelperDataMetadata is a helper data record without its payload
+type HelperDataMetadata struct {
+	Nickname            string `json:"nickname"`
+	DevicePublicKeyHash string `json:"devicePublicKeyHash"`
+	DataSize            int    `json:"dataSize"` // Length of the omitted payload in bytes
+	Signature           string `json:"signature"`
+	Version             int    `json:"version"`
+	CreatedAt           string `json:"createdAt"`
+	UpdatedAt           string `json:"updatedAt"`
+	ExpiresAt           string `json:"expiresAt,omitempty" metadata:",optional"`
+}
+
+// GetHelperDataMetadata returns a helper data record's metadata without the payload; unlike GetHelperData
+// it also describes expired records, whose ExpiresAt tells them apart
+func (dr *DeviceRegistration) GetHelperDataMetadata(ctx contractapi.TransactionContextInterface, nickname string) (*HelperDataMetadata, error) {
+	record, err := findHelperDataRecord(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("helper data for nickname %s does not exist", nickname)
+	}
+
+	return &HelperDataMetadata{
+		Nickname:            record.Nickname,
+		DevicePublicKeyHash: record.DevicePublicKeyHash,
+		DataSize:            len(record.Data),
+		Signature:           record.Signature,
+		Version:             record.Version,
+		CreatedAt:           record.CreatedAt,
+		UpdatedAt:           record.UpdatedAt,
+		ExpiresAt:           record.ExpiresAt,
+	}, nil
+}
+
+// validateNickname rejects nicknames that are not valid UTF-8, contain control characters such as the
+// composite key separator, or do not match the configured pattern
+func validateNickname(nickname string, config *ContractConfig) error {
+	if !utf8.ValidString(nickname) {
+		return fmt.Errorf("nickname is not valid UTF-8")
+	}
+	for _, r := range nickname {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("nickname contains control character %U", r)
+		}
+	}
+
+	if config.NicknamePattern != "" {
+		pattern, err := regexp.Compile(config.NicknamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid nickname pattern: %v", err)
+		}
+		if !pattern.MatchString(nickname) {
+			return fmt.Errorf("nickname %q does not match the required pattern %s", nickname, config.NicknamePattern)
+		}
+	}
+
+	return nil
+}
+
+// findHelperDataRecord reads the helper data record for a nickname, returning nil when absent
+func findHelperDataRecord(ctx contractapi.TransactionContextInterface, nickname string) (*HelperDataRecord, error) {
+	helperDataKey, err := ctx.GetStub().CreateCompositeKey("HelperData", []string{nickname})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for helper data: %v", err)
+	}
+
+	helperData, err := ctx.GetStub().GetState(helperDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read helper data from world state: %v", err)
+	}
+	if helperData == nil {
+		return nil, nil
+	}
+
+	return decodeHelperDataRecord(nickname, helperData), nil
+}
+
+// decodeHelperDataRecord decodes a stored helper data value into a record
+func decodeHelperDataRecord(nickname string, helperData []byte) *HelperDataRecord {
+	var record HelperDataRecord
+	if err := json.Unmarshal(helperData, &record); err != nil || record.Version == 0 {
+		// Helper data stored before records were introduced is the raw payload
+		record = HelperDataRecord{Nickname: nickname, Data: string(helperData)}
+	}
+
+	return &record
+}
+
+// helperDataExpired reports whether a record's retention period has passed at the given time
+func helperDataExpired(record *HelperDataRecord, now time.Time) (bool, error) {
+	if record.ExpiresAt == "" {
+		return false, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, record.ExpiresAt)
+	if err != nil {
+		return false, fmt.Errorf("helper data for nickname %s has invalid expiry time: %v", record.Nickname, err)
+	}
+	return !now.Before(expiresAt), nil
+}
+
+// deleteHelperDataRecord removes the helper data stored for a nickname; the nickname stays bound to its device key
+func deleteHelperDataRecord(ctx contractapi.TransactionContextInterface, nickname string) error {
+	helperDataKey, err := ctx.GetStub().CreateCompositeKey("HelperData", []string{nickname})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for helper data: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(helperDataKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete helper data: %v", err)
+	}
+
+	return nil
+}
+
+// deleteDeviceHelperData removes the helper data records of a device key and releases their nicknames,
+// returning the nicknames in order; records stored before key hashes were recorded are found through
+// their nickname binding
+func deleteDeviceHelperData(ctx contractapi.TransactionContextInterface, pubKeyHash string) ([]string, error) {
+	nicknames := make(map[string]bool)
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("HelperData", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read helper data from world state: %v", err)
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate helper data: %v", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split helper data key: %v", err)
+		}
+		if decodeHelperDataRecord(attributes[0], entry.Value).DevicePublicKeyHash == pubKeyHash {
+			nicknames[attributes[0]] = true
+		}
+	}
+
+	owners, err := ctx.GetStub().GetStateByPartialCompositeKey("NicknameOwner", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nickname owners from world state: %v", err)
+	}
+	defer owners.Close()
+	for owners.HasNext() {
+		entry, err := owners.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate nickname owners: %v", err)
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split nickname owner key: %v", err)
+		}
+		if string(entry.Value) == pubKeyHash {
+			nicknames[attributes[0]] = true
+		}
+	}
+
+	sorted := slices.Sorted(maps.Keys(nicknames))
+	for _, nickname := range sorted {
+		err = deleteHelperDataRecord(ctx, nickname)
+		if err != nil {
+			return nil, err
+		}
+
+		nicknameOwnerKey, err := ctx.GetStub().CreateCompositeKey("NicknameOwner", []string{nickname})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for nickname owner: %v", err)
+		}
+		err = ctx.GetStub().DelState(nicknameOwnerKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to release nickname %s: %v", nickname, err)
+		}
+	}
+
+	return sorted, nil
+}
+
+// rebindDeviceNicknames moves every nickname bound to a device key over to its replacement key,
+// returning the moved nicknames in order
+func rebindDeviceNicknames(ctx contractapi.TransactionContextInterface, oldPubKeyHash string, newPubKeyHash string) ([]string, error) {
+	owners, err := ctx.GetStub().GetStateByPartialCompositeKey("NicknameOwner", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nickname owners from world state: %v", err)
+	}
+	defer owners.Close()
+
+	nicknames := make([]string, 0)
+	for owners.HasNext() {
+		entry, err := owners.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate nickname owners: %v", err)
+		}
+		if string(entry.Value) != oldPubKeyHash {
+			continue
+		}
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split nickname owner key: %v", err)
+		}
+
+		err = ctx.GetStub().PutState(entry.Key, []byte(newPubKeyHash))
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebind nickname %s: %v", attributes[0], err)
+		}
+		nicknames = append(nicknames, attributes[0])
+	}
+
+	return nicknames, nil
+}
+
+// putHelperDataRecord stores a helper data record under its nickname
+func putHelperDataRecord(ctx contractapi.TransactionContextInterface, record *HelperDataRecord) error {
+	helperDataKey, err := ctx.GetStub().CreateCompositeKey("HelperData", []string{record.Nickname})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for helper data: %v", err)
+	}
+
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal helper data: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(helperDataKey, recordJSON)
+	if err != nil {
+		return fmt.Errorf("failed to store helper data: %v", err)
+	}
+
+	return nil
+}
+
+// nextHelperDataRecord checks the expected version against the stored record and returns its successor,
+// expiring after the configured retention period
+func nextHelperDataRecord(ctx contractapi.TransactionContextInterface, current *HelperDataRecord, nickname string, expectedVersion int, config *ContractConfig) (*HelperDataRecord, error) {
+	currentVersion := 0
+	if current != nil {
+		currentVersion = current.Version
+	}
+	if expectedVersion != currentVersion {
+		return nil, fmt.Errorf("helper data for nickname %s is at version %d, expected %d", nickname, currentVersion, expectedVersion)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := now.Format(time.RFC3339)
+
+	next := &HelperDataRecord{Nickname: nickname, Version: currentVersion + 1, CreatedAt: timestamp, UpdatedAt: timestamp}
+	if current != nil && current.CreatedAt != "" {
+		next.CreatedAt = current.CreatedAt
+	}
+	if config.HelperDataRetentionSeconds > 0 {
+		next.ExpiresAt = now.Add(time.Duration(config.HelperDataRetentionSeconds) * time.Second).Format(time.RFC3339)
+	}
+
+	return next, nil
+}
+
+// PurgeExpiredHelperData deletes every helper data record whose retention period has passed and
+// returns how many were deleted (admin only)
+func (dr *DeviceRegistration) PurgeExpiredHelperData(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("HelperData", []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read helper data from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	expired := make([]string, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to iterate helper data: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to split helper data key: %v", err)
+		}
+
+		isExpired, err := helperDataExpired(decodeHelperDataRecord(attributes[0], entry.Value), now)
+		if err != nil {
+			return 0, err
+		}
+		if isExpired {
+			expired = append(expired, attributes[0])
+		}
+	}
+
+	for _, nickname := range expired {
+		err = deleteHelperDataRecord(ctx, nickname)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// Enrollment states reported by GetEnrollmentByNickname
+const (
+	EnrollmentMissingHelperData = "MISSING_HELPER_DATA"
+	EnrollmentMissingDevice     = "MISSING_DEVICE"
+	EnrollmentUnverified        = "UNVERIFIED"
+	EnrollmentVerified          = "VERIFIED"
+)
+
+// Enrollment is everything recorded for a nickname: its helper data, the bound device key and the
+// most recent vote that approved it; parts that do not exist are omitted and State says which
+type Enrollment struct {
+	Nickname      string            `json:"nickname"`
+	State         string            `json:"state"` // One of the Enrollment* states
+	HelperData    *HelperDataRecord `json:"helperData,omitempty" metadata:",optional"`
+	DeviceKey     *DeviceKey        `json:"deviceKey,omitempty" metadata:",optional"`
+	ApprovingVote *PhotoVote        `json:"approvingVote,omitempty" metadata:",optional"`
+}
+
+// GetEnrollmentByNickname resolves a nickname to its helper data, device key and approving vote
+func (dr *DeviceRegistration) GetEnrollmentByNickname(ctx contractapi.TransactionContextInterface, nickname string) (*Enrollment, error) {
+	enrollment := &Enrollment{Nickname: nickname, State: EnrollmentMissingHelperData}
+
+	record, err := findHelperDataRecord(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return enrollment, nil
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expired, err := helperDataExpired(record, now)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return enrollment, nil
+	}
+	enrollment.HelperData = record
+
+	// Helper data stored before records were introduced carries no key hash, so fall back to the nickname binding
+	pubKeyHash := record.DevicePublicKeyHash
+	if pubKeyHash == "" {
+		nicknameOwnerKey, err := ctx.GetStub().CreateCompositeKey("NicknameOwner", []string{nickname})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key for nickname owner: %v", err)
+		}
+		nicknameOwner, err := ctx.GetStub().GetState(nicknameOwnerKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read nickname owner from state: %v", err)
+		}
+		pubKeyHash = string(nicknameOwner)
+	}
+
+	enrollment.State = EnrollmentMissingDevice
+	if pubKeyHash == "" {
+		return enrollment, nil
+	}
+	enrollment.DeviceKey, err = findDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.DeviceKey == nil {
+		return enrollment, nil
+	}
+
+	enrollment.State = EnrollmentUnverified
+	if enrollment.DeviceKey.Status != DeviceStatusVerified {
+		return enrollment, nil
+	}
+	enrollment.State = EnrollmentVerified
+
+	approving, err := dr.GetApprovingVotes(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(approving) > 0 {
+		enrollment.ApprovingVote = approving[len(approving)-1]
+	}
+
+	return enrollment, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHelperDataDevice opens a vote for a device and force-verifies it so it may store helper data
+func newHelperDataDevice(e *testEnv) *testDevice {
+	e.t.Helper()
+	device := newTestDevice(e.t, 0)
+	e.startVote(device, "helper")
+	e.verifyDevice(device.hash)
+	return device
+}
+
+func TestDefaultNicknameRejectsOnlyControlCharacters(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	store := func(nickname string) error {
+		return e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), nickname, 0)
+	}
+
+	requireNoError(t, store("alice_01"))
+	requireNoError(t, store("Zoë (phone #2)"))
+	requireError(t, store("null\x00byte"))
+	requireError(t, store("bad\xffutf8"))
+}
+
+func TestConfiguredNicknamePatternRejectsSymbols(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	e.setConfig(`{"nicknamePattern": "^[A-Za-z0-9_.-]{1,64}$"}`)
+	store := func(nickname string) error {
+		return e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), nickname, 0)
+	}
+
+	requireNoError(t, store("alice_01"))
+	requireError(t, store("Zoë (phone #2)"))
+}
+
+func TestStoreHelperDataNamesUnsupportedKeyType(t *testing.T) {
+	e := newTestEnv(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	requireNoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	requireNoError(t, err)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: der}))
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(publicKey)))
+	e.putState("DeviceKey", []string{hash}, DeviceKey{PublicKeyHash: hash, PublicKey: publicKey, Status: DeviceStatusVerified})
+
+	err = e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", hash, "00", "ecdsa-device", 0)
+	requireError(t, err)
+	if !strings.Contains(err.Error(), "ECDSA") || !strings.Contains(err.Error(), "supported types are RSA") {
+		t.Fatalf("error does not name the key type and the supported types: %v", err)
+	}
+}
+
+func TestNicknameBindsToFirstDeviceKey(t *testing.T) {
+	e := newTestEnv(t)
+	first := newHelperDataDevice(e)
+	second := newTestDevice(t, 1)
+	e.startVote(second, "second")
+	e.verifyDevice(second.hash)
+	store := func(device *testDevice, data string, expectedVersion int) error {
+		return e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), data, device.hash, device.sign(data), "shared", expectedVersion)
+	}
+
+	requireNoError(t, store(first, "data", 0))
+	if owner := e.getState("NicknameOwner", "shared"); string(owner) != first.hash {
+		t.Fatalf("nickname bound to %s", owner)
+	}
+	requireNoError(t, store(first, "updated", 1))
+
+	requireError(t, store(second, "taken", 2))
+	if owner := e.getState("NicknameOwner", "shared"); string(owner) != first.hash {
+		t.Fatalf("nickname rebound to %s", owner)
+	}
+}
+
+func TestHelperDataVersionGuardsConcurrentUpdates(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	store := func(data string, expectedVersion int) error {
+		return e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), data, device.hash, device.sign(data), "versioned", expectedVersion)
+	}
+
+	requireError(t, store("early", 1))
+	requireNoError(t, store("first", 0))
+	record, err := e.dr.GetHelperData(e.ctx("uploader", "Org1MSP"), "versioned")
+	requireNoError(t, err)
+	if record.Version != 1 {
+		t.Fatalf("version after the first store %d", record.Version)
+	}
+
+	requireNoError(t, store("second", record.Version))
+	requireError(t, store("stale", record.Version))
+	record, err = e.dr.GetHelperData(e.ctx("uploader", "Org1MSP"), "versioned")
+	requireNoError(t, err)
+	if record.Version != 2 || record.Data != "second" {
+		t.Fatalf("record after a stale update: version %d, data %q", record.Version, record.Data)
+	}
+}
+
+func TestExpiredHelperDataRefusedAndPurged(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	e.setConfig(`{"helperDataRetentionSeconds": 60}`)
+	store := func(nickname string) {
+		requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), nickname, 0))
+	}
+
+	store("expiring")
+	e.advance(45 * time.Second)
+	store("fresh")
+	if _, err := e.dr.GetHelperData(e.ctx("uploader", "Org1MSP"), "expiring"); err != nil {
+		t.Fatalf("record refused within its retention period: %v", err)
+	}
+
+	e.advance(30 * time.Second)
+	_, err := e.dr.GetHelperData(e.ctx("uploader", "Org1MSP"), "expiring")
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("GetHelperData on an expired record: %v", err)
+	}
+
+	_, err = e.dr.PurgeExpiredHelperData(e.ctx("user", "Org2MSP"))
+	requireError(t, err)
+	purged, err := e.dr.PurgeExpiredHelperData(e.admin())
+	requireNoError(t, err)
+	if purged != 1 || e.getState("HelperData", "expiring") != nil || e.getState("HelperData", "fresh") == nil {
+		t.Fatalf("purge deleted %d records", purged)
+	}
+}
+
+func TestGetEnrollmentByNicknameBranches(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "enrolled")
+	e.cast(vote.VoteId, "voter-1", true)
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), "enrolled", 0))
+	enrollment := func(nickname string) *Enrollment {
+		enrollment, err := e.dr.GetEnrollmentByNickname(e.ctx("uploader", "Org1MSP"), nickname)
+		requireNoError(t, err)
+		return enrollment
+	}
+
+	if got := enrollment("enrolled"); got.State != EnrollmentVerified || got.HelperData == nil || got.DeviceKey.PublicKeyHash != device.hash || got.ApprovingVote == nil || got.ApprovingVote.VoteId != vote.VoteId {
+		t.Fatalf("verified enrollment %+v", got)
+	}
+	if got := enrollment("unknown"); got.State != EnrollmentMissingHelperData || got.HelperData != nil || got.DeviceKey != nil {
+		t.Fatalf("enrollment without helper data %+v", got)
+	}
+
+	e.putState("HelperData", []string{"orphaned"}, HelperDataRecord{Nickname: "orphaned", DevicePublicKeyHash: "missing-device", Data: "data", Version: 1})
+	if got := enrollment("orphaned"); got.State != EnrollmentMissingDevice || got.HelperData == nil || got.DeviceKey != nil {
+		t.Fatalf("enrollment without a device key %+v", got)
+	}
+
+	requireNoError(t, e.dr.RevokeDevice(e.admin(), device.hash, "compromised"))
+	if got := enrollment("enrolled"); got.State != EnrollmentUnverified || got.DeviceKey == nil || got.ApprovingVote != nil {
+		t.Fatalf("enrollment of a revoked device %+v", got)
+	}
+}
+
+func TestGetHelperDataMetadataOmitsPayload(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	data := strings.Repeat("payload-", 64)
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), data, device.hash, device.sign(data), "described", 0))
+
+	metadata, err := e.dr.GetHelperDataMetadata(e.ctx("uploader", "Org1MSP"), "described")
+	requireNoError(t, err)
+	if metadata.Nickname != "described" || metadata.DevicePublicKeyHash != device.hash || metadata.DataSize != len(data) || metadata.Version != 1 || metadata.CreatedAt == "" || metadata.UpdatedAt == "" {
+		t.Fatalf("helper data metadata %+v", metadata)
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	requireNoError(t, err)
+	if strings.Contains(string(metadataJSON), "payload-") || strings.Contains(string(metadataJSON), `"data"`) {
+		t.Fatalf("metadata carries the payload: %s", metadataJSON)
+	}
+
+	_, err = e.dr.GetHelperDataMetadata(e.ctx("uploader", "Org1MSP"), "unknown")
+	requireError(t, err)
+}
+
+func TestStoreHelperDataRequiresHashOfStoredKey(t *testing.T) {
+	e := newTestEnv(t)
+	device := newHelperDataDevice(e)
+	other := newTestDevice(t, 1)
+	store := func() error {
+		return e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", device.hash, device.sign("data"), "mismatch", 0)
+	}
+
+	// A stored PEM that no longer hashes to the record's key is refused even though it is VERIFIED
+	key := e.deviceKey(device.hash)
+	key.PublicKey = other.publicKey
+	e.putState("DeviceKey", []string{device.hash}, key)
+	err := store()
+	if err == nil || !strings.Contains(err.Error(), "does not match the hash of its stored public key") {
+		t.Fatalf("StoreHelperData with a swapped stored key: %v", err)
+	}
+
+	key.PublicKey = device.publicKey
+	key.PublicKeyHash = other.hash
+	e.putState("DeviceKey", []string{device.hash}, key)
+	requireError(t, store())
+
+	key.PublicKeyHash = device.hash
+	e.putState("DeviceKey", []string{device.hash}, key)
+	requireNoError(t, store())
+
+	requireError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "data", other.hash, other.sign("data"), "unknown", 0))
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// testIdentity is a client identity with a fixed ID, MSP and optional certificate
+type testIdentity struct {
+	id   string
+	msp  string
+	cert *x509.Certificate
+}
+
+func (i *testIdentity) GetID() (string, error)                         { return i.id, nil }
+func (i *testIdentity) GetMSPID() (string, error)                      { return i.msp, nil }
+func (i *testIdentity) GetAttributeValue(string) (string, bool, error) { return "", false, nil }
+func (i *testIdentity) AssertAttributeValue(string, string) error      { return nil }
+func (i *testIdentity) GetX509Certificate() (*x509.Certificate, error) { return i.cert, nil }
+
+// testStub adds the paginated partial composite key query and the key history the mock stub lacks,
+// and raw transaction arguments for contract methods that re-read them
+type testStub struct {
+	*shimtest.MockStub
+	args    [][]byte
+	history map[string][]*queryresult.KeyModification
+}
+
+// GetArgs returns the raw arguments of the current transaction, function name first
+func (s *testStub) GetArgs() [][]byte { return s.args }
+
+// PutState writes a value and records it in the key's history under the current transaction
+func (s *testStub) PutState(key string, value []byte) error {
+	if err := s.MockStub.PutState(key, value); err != nil {
+		return err
+	}
+	s.history[key] = append(s.history[key], &queryresult.KeyModification{TxId: s.TxID, Value: value})
+	return nil
+}
+
+// DelState deletes a value and records the deletion in the key's history under the current transaction
+func (s *testStub) DelState(key string) error {
+	if err := s.MockStub.DelState(key); err != nil {
+		return err
+	}
+	s.history[key] = append(s.history[key], &queryresult.KeyModification{TxId: s.TxID, IsDelete: true})
+	return nil
+}
+
+// testHistoryIterator iterates the recorded modifications of one key, oldest first
+type testHistoryIterator struct {
+	entries []*queryresult.KeyModification
+	next    int
+}
+
+func (it *testHistoryIterator) HasNext() bool { return it.next < len(it.entries) }
+func (it *testHistoryIterator) Close() error  { return nil }
+func (it *testHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	it.next++
+	return it.entries[it.next-1], nil
+}
+
+// GetHistoryForKey returns the modifications recorded for a key
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &testHistoryIterator{entries: s.history[key]}, nil
+}
+
+// testIterator iterates a fixed slice of query results
+type testIterator struct {
+	entries []*queryresult.KV
+	next    int
+}
+
+func (it *testIterator) HasNext() bool { return it.next < len(it.entries) }
+func (it *testIterator) Close() error  { return nil }
+func (it *testIterator) Next() (*queryresult.KV, error) {
+	it.next++
+	return it.entries[it.next-1], nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination returns up to pageSize entries after the bookmark key
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iterator, err := s.MockStub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	page := &testIterator{}
+	last := ""
+	for iterator.HasNext() && int32(len(page.entries)) < pageSize {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bookmark != "" && entry.Key <= bookmark {
+			continue
+		}
+		page.entries = append(page.entries, entry)
+		last = entry.Key
+	}
+	return page, &pb.QueryResponseMetadata{Bookmark: last, FetchedRecordsCount: int32(len(page.entries))}, nil
+}
+
+// testContext is a transaction context for one caller
+type testContext struct {
+	stub     *testStub
+	identity *testIdentity
+}
+
+func (c *testContext) GetStub() shim.ChaincodeStubInterface  { return c.stub }
+func (c *testContext) GetClientIdentity() cid.ClientIdentity { return c.identity }
+
+// testEnv is a mock world state with a controllable transaction clock
+type testEnv struct {
+	t    testing.TB
+	stub *testStub
+	now  time.Time
+	txs  int
+	dr   *DeviceRegistration
+}
+
+// newTestEnv returns an empty world state whose clock starts at 2025-01-01T00:00:00Z
+func newTestEnv(t testing.TB) *testEnv {
+	t.Helper()
+	return &testEnv{
+		t:    t,
+		stub: &testStub{MockStub: shimtest.NewMockStub("device-registration", nil), history: make(map[string][]*queryresult.KeyModification)},
+		now:  time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		dr:   new(DeviceRegistration),
+	}
+}
+
+// ctx opens a new transaction submitted by the given identity at the current clock
+func (e *testEnv) ctx(id string, msp string) *testContext {
+	e.txs++
+	txID := fmt.Sprintf("tx-%d", e.txs)
+	e.stub.MockTransactionStart(txID)
+	e.stub.TxTimestamp.Seconds = e.now.Unix()
+	e.stub.TxTimestamp.Nanos = int32(e.now.Nanosecond())
+	e.stub.args = nil
+	return &testContext{stub: e.stub, identity: &testIdentity{id: id, msp: msp}}
+}
+
+// ctxWithArgs opens a transaction whose raw arguments are the function name and the given JSON arguments
+func (e *testEnv) ctxWithArgs(id string, msp string, function string, args ...string) *testContext {
+	ctx := e.ctx(id, msp)
+	e.stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		e.stub.args = append(e.stub.args, []byte(arg))
+	}
+	return ctx
+}
+
+// ctxWithCertificate opens a transaction submitted by an identity enrolled with a certificate for the device's key
+func (e *testEnv) ctxWithCertificate(id string, msp string, device *testDevice) *testContext {
+	e.t.Helper()
+	leaf, _ := device.certificateChain(e.t, id)
+	block, _ := pem.Decode([]byte(leaf))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	ctx := e.ctx(id, msp)
+	ctx.identity.cert = cert
+	return ctx
+}
+
+// admin opens a transaction submitted by an admin of the default configuration
+func (e *testEnv) admin() *testContext {
+	return e.ctx("admin", "Org1MSP")
+}
+
+// advance moves the transaction clock forward
+func (e *testEnv) advance(d time.Duration) {
+	e.now = e.now.Add(d)
+}
+
+// setConfig merges a partial JSON configuration as an admin, failing the test on error
+func (e *testEnv) setConfig(configJSON string) {
+	e.t.Helper()
+	if err := e.dr.SetConfig(e.admin(), configJSON); err != nil {
+		e.t.Fatalf("SetConfig(%s): %v", configJSON, err)
+	}
+}
+
+// putState writes a raw world state value outside any contract transaction
+func (e *testEnv) putState(objectType string, attributes []string, value interface{}) {
+	e.t.Helper()
+	key, err := e.stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	valueJSON, ok := value.([]byte)
+	if !ok {
+		valueJSON, err = json.Marshal(value)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+	}
+	e.stub.MockTransactionStart("raw-write")
+	if err := e.stub.PutState(key, valueJSON); err != nil {
+		e.t.Fatal(err)
+	}
+	e.stub.MockTransactionEnd("raw-write")
+}
+
+// delState deletes a raw world state value outside any contract transaction
+func (e *testEnv) delState(objectType string, attributes ...string) {
+	e.t.Helper()
+	key, err := e.stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	e.stub.MockTransactionStart("raw-delete")
+	if err := e.stub.DelState(key); err != nil {
+		e.t.Fatal(err)
+	}
+	e.stub.MockTransactionEnd("raw-delete")
+}
+
+// getState reads a raw world state value, nil when absent
+func (e *testEnv) getState(objectType string, attributes ...string) []byte {
+	e.t.Helper()
+	key, err := e.stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	value, err := e.stub.GetState(key)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return value
+}
+
+// vote reads a vote, failing the test when it cannot
+func (e *testEnv) vote(voteId string) *PhotoVote {
+	e.t.Helper()
+	vote, err := getVote(e.admin(), voteId)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return vote
+}
+
+// deviceKey reads a device key, failing the test when it cannot
+func (e *testEnv) deviceKey(pubKeyHash string) *DeviceKey {
+	e.t.Helper()
+	deviceKey, err := getDeviceKey(e.admin(), pubKeyHash)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return deviceKey
+}
+
+// setDeviceStatus rewrites a device key's status, keeping the status index consistent
+func (e *testEnv) setDeviceStatus(pubKeyHash string, status DeviceStatus) {
+	e.t.Helper()
+	deviceKey := e.deviceKey(pubKeyHash)
+	previous := deviceKey.Status
+	deviceKey.Status = status
+	if err := putDeviceKey(e.admin(), deviceKey, previous); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// testDevice is a device key pair that signs photos and helper data
+type testDevice struct {
+	key       *rsa.PrivateKey
+	publicKey string // PEM public key
+	hash      string // Hex SHA-256 of publicKey, as the contract stores it
+}
+
+var (
+	testKeysMu sync.Mutex
+	testKeys   []*rsa.PrivateKey
+)
+
+// newTestDevice returns the n-th device of a process-wide pool, generating keys on first use
+func newTestDevice(t testing.TB, n int) *testDevice {
+	t.Helper()
+	testKeysMu.Lock()
+	defer testKeysMu.Unlock()
+	for len(testKeys) <= n {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKeys = append(testKeys, key)
+	}
+
+	key := testKeys[n]
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: der}))
+	return &testDevice{
+		key:       key,
+		publicKey: publicKey,
+		hash:      fmt.Sprintf("%x", sha256.Sum256([]byte(publicKey))),
+	}
+}
+
+// sign returns the hex PSS signature of a message, as device clients produce it
+func (d *testDevice) sign(message string) string {
+	hashed := sha256.Sum256([]byte(message))
+	signature, err := rsa.SignPSS(rand.Reader, d.key, crypto.SHA256, hashed[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(signature)
+}
+
+// photo returns a signed format 1 photo whose CIDv0 hash is derived from name
+func (d *testDevice) photo(name string) IPFSPhoto {
+	return d.signPhoto(IPFSPhoto{
+		IPFSHash:    testCID(name),
+		UploadedBy:  "uploader",
+		TimeStamp:   "2025-01-01T00:00:00Z",
+		Description: "photo " + name,
+	})
+}
+
+// signPhoto signs a photo's payload under its signature format
+func (d *testDevice) signPhoto(photo IPFSPhoto) IPFSPhoto {
+	photo.Signature = d.sign(photoSigningPayload(photo))
+	return photo
+}
+
+// testCID derives a well-formed CIDv0 from a name
+func testCID(name string) string {
+	hashed := sha256.Sum256([]byte(name))
+	cid := []byte("Qm")
+	for i := 0; i < 44; i++ {
+		cid = append(cid, base58Alphabet[int(hashed[i%32]+byte(i))%58])
+	}
+	return string(cid)
+}
+
+// certificateChain issues the device a leaf certificate under a new root, returning the leaf-first chain
+// and the root as PEM
+func (d *testDevice) certificateChain(t testing.TB, name string) (string, string) {
+	t.Helper()
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root"},
+		NotBefore:             time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootKey := newTestDevice(t, 9).key
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    root.NotBefore,
+		NotAfter:     root.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, root, &d.key.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: certificatePEMType, Bytes: leafDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: certificatePEMType, Bytes: rootDER}))
+}
+
+// startVote opens a vote for the device's photos as the given caller, failing the test on error
+func (e *testEnv) startVote(device *testDevice, names ...string) *PhotoVote {
+	e.t.Helper()
+	return e.startVoteWithOptions(device, "{}", names...)
+}
+
+// startVoteWithOptions opens a vote with per-vote options JSON, failing the test on error
+func (e *testEnv) startVoteWithOptions(device *testDevice, optionsJSON string, names ...string) *PhotoVote {
+	e.t.Helper()
+	photos := make([]IPFSPhoto, 0, len(names))
+	for _, name := range names {
+		photos = append(photos, device.photo(name))
+	}
+	vote, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, optionsJSON)
+	if err != nil {
+		e.t.Fatalf("StartPhotoVoteWithOptions: %v", err)
+	}
+	return vote
+}
+
+// cast casts a ballot as the given voter, failing the test on error
+func (e *testEnv) cast(voteId string, voter string, isValid bool) {
+	e.t.Helper()
+	if err := e.dr.CastVote(e.ctx(voter, "Org1MSP"), voteId, isValid); err != nil {
+		e.t.Fatalf("CastVote(%s, %s): %v", voteId, voter, err)
+	}
+}
+
+// verifyDevice force-verifies a device key as an admin, failing the test on error
+func (e *testEnv) verifyDevice(pubKeyHash string) {
+	e.t.Helper()
+	if err := e.dr.ForceVerifyDevice(e.admin(), pubKeyHash, "verified for the test"); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// requireError fails the test unless err is non-nil
+func requireError(t testing.TB, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// requireNoError fails the test if err is non-nil
+func requireNoError(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lastEvent returns the name of the most recent chaincode event, "" when none is queued
+func (e *testEnv) lastEvent() string {
+	event := e.lastChaincodeEvent()
+	if event == nil {
+		return ""
+	}
+	return event.EventName
+}
+
+// lastChaincodeEvent drains the queued chaincode events and returns the most recent, nil when none is queued
+func (e *testEnv) lastChaincodeEvent() *pb.ChaincodeEvent {
+	var last *pb.ChaincodeEvent
+	for {
+		select {
+		case event := <-e.stub.ChaincodeEventsChannel:
+			last = event
+		default:
+			return last
+		}
+	}
+}
+
+// invoke submits a transaction through the contract API chaincode, against the env's world state, as a
+// caller enrolled with a certificate
+func (e *testEnv) invoke(function string, args ...string) pb.Response {
+	e.t.Helper()
+	chaincode, err := contractapi.NewChaincode(new(DeviceRegistration))
+	requireNoError(e.t, err)
+	leaf, _ := newTestDevice(e.t, 8).certificateChain(e.t, "caller")
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: []byte(leaf)})
+	requireNoError(e.t, err)
+
+	stub := shimtest.NewMockStub("device-registration", chaincode)
+	stub.State = e.stub.State
+	stub.Creator = creator
+	invokeArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		invokeArgs = append(invokeArgs, []byte(arg))
+	}
+	e.txs++
+	return stub.MockInvoke(fmt.Sprintf("tx-%d", e.txs), invokeArgs)
+}
+
+// Interface checks
+var _ contractapi.TransactionContextInterface = (*testContext)(nil)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// VoteOptions are optional per-vote settings supplied when starting a vote
+type VoteOptions struct {
+	EligibleVoters     []string `json:"eligibleVoters"`     // Identities allowed to vote; empty allows anyone
+	QuorumFraction     float64  `json:"quorumFraction"`     // Quorum as a share of eligible voters, replacing the minimum voter count
+	ExpectedPhotoCount int      `json:"expectedPhotoCount"` // Exact number of photos the set must contain, 0 to accept any count
+	CommitReveal       bool     `json:"commitReveal"`       // Hide ballots behind commitments until the reveal phase
+	RevealDelaySeconds int64    `json:"revealDelaySeconds"` // Time after the vote starts when commits close and reveals open
+	MinValidVotes      int      `json:"minValidVotes"`      // Valid votes required for approval in addition to the ratio
+	AutoFinalize       *bool    `json:"autoFinalize"`       // Finalize as soon as the vote is decided, true when omitted
+	SkipInvalidPhotos  bool     `json:"skipInvalidPhotos"`  // Drop photos that fail validation and open the vote with the rest
+	MinPhotoCount      int      `json:"minPhotoCount"`      // Valid photos that must remain after skipping, at least 1
+	SignatureEncoding  string   `json:"signatureEncoding"`  // Encoding of an ECDSA device key's signatures, "DER" when omitted or "RAW"
+	GraceVotes         int      `json:"graceVotes"`         // Extra votes still accepted and tallied after quorum before the vote is decided
+	SessionChallenge   string   `json:"sessionChallenge"`   // One-time challenge from CreateEnrollmentSession that every photo must be signed for
+}
+
+// validateVoteOptions checks per-vote settings for consistency
+func validateVoteOptions(options VoteOptions) error {
+	for i, voter := range options.EligibleVoters {
+		if voter == "" {
+			return fmt.Errorf("eligible voter identities cannot be empty")
+		}
+		if slices.Contains(options.EligibleVoters[:i], voter) {
+			return fmt.Errorf("eligible voter %s is listed more than once", voter)
+		}
+	}
+
+	if options.QuorumFraction != 0 {
+		if options.QuorumFraction < 0 || options.QuorumFraction > 1 {
+			return fmt.Errorf("quorum fraction must be in (0, 1]")
+		}
+		if len(options.EligibleVoters) == 0 {
+			return fmt.Errorf("quorum fraction requires an eligible voter list")
+		}
+	}
+
+	if options.RevealDelaySeconds < 0 {
+		return fmt.Errorf("reveal delay cannot be negative")
+	}
+	if options.RevealDelaySeconds > 0 && !options.CommitReveal {
+		return fmt.Errorf("reveal delay requires commit-reveal")
+	}
+
+	if options.MinValidVotes < 0 {
+		return fmt.Errorf("minimum valid votes cannot be negative")
+	}
+	if len(options.EligibleVoters) > 0 && options.MinValidVotes > len(options.EligibleVoters) {
+		return fmt.Errorf("minimum valid votes %d exceeds the %d eligible voters", options.MinValidVotes, len(options.EligibleVoters))
+	}
+
+	if options.GraceVotes < 0 {
+		return fmt.Errorf("grace votes cannot be negative")
+	}
+
+	if options.ExpectedPhotoCount < 0 {
+		return fmt.Errorf("expected photo count cannot be negative")
+	}
+	if options.MinPhotoCount < 0 {
+		return fmt.Errorf("minimum photo count cannot be negative")
+	}
+
+	if options.SignatureEncoding != "" && options.SignatureEncoding != signatureEncodingDER && options.SignatureEncoding != signatureEncodingRaw {
+		return fmt.Errorf("unknown signature encoding %s", options.SignatureEncoding)
+	}
+
+	return nil
+}
+
+// fractionQuorum converts a quorum fraction of the eligible voters into a voter count
+func fractionQuorum(fraction float64, eligibleVoters int) int {
+	return max(int(math.Ceil(fraction*float64(eligibleVoters))), 1)
+}
+
+// isEligibleVoter reports whether an identity may vote; votes without a list are open to anyone
+func isEligibleVoter(vote *PhotoVote, voterID string) bool {
+	return len(vote.EligibleVoters) == 0 || slices.Contains(vote.EligibleVoters, voterID)
+}
+
+// StartPhotoVoteWithOptions initiates a new voting session with per-vote settings given as JSON
+func (dr *DeviceRegistration) StartPhotoVoteWithOptions(ctx contractapi.TransactionContextInterface, ipfsPhotos []IPFSPhoto, devicePublicKey string, optionsJSON string) (*PhotoVote, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStrictPhotosArg(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var options VoteOptions
+	if config.StrictJSONInput {
+		err = strictUnmarshal([]byte(optionsJSON), &options)
+	} else {
+		err = json.Unmarshal([]byte(optionsJSON), &options)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vote options: %v", err)
+	}
+
+	return startPhotoVote(ctx, ipfsPhotos, devicePublicKey, options, newVoteBatch())
+}
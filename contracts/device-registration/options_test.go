@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraceVotesMustFitEligibleVoters(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	photos := []IPFSPhoto{device.photo("grace")}
+
+	// A full quorum leaves no eligible voter for the grace vote
+	_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, `{"eligibleVoters": ["a", "b", "c"], "quorumFraction": 1.0, "graceVotes": 1}`)
+	requireError(t, err)
+
+	// A configured quorum above the eligible voters cannot settle either
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, `{"eligibleVoters": ["a", "b", "c"], "graceVotes": 1}`)
+	requireError(t, err)
+
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, `{"eligibleVoters": ["a", "b", "c", "d"], "graceVotes": 1}`)
+	requireNoError(t, err)
+}
+
+func TestQuorumFractionOfEligibleVoters(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"eligibleVoters": ["voter-1", "voter-2", "voter-3", "voter-4", "voter-5"], "quorumFraction": 0.5}`, "fraction")
+	thresholds, err := e.dr.GetEffectiveThresholds(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if thresholds.Thresholds.MinVoters != 3 || thresholds.Source != "QUORUM_FRACTION" {
+		t.Fatalf("half of five eligible voters resolved to %+v", thresholds)
+	}
+
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", true)
+	if status := e.vote(vote.VoteId).Status; status != VoteStatusPending {
+		t.Fatalf("status after two of three ballots %s", status)
+	}
+	e.cast(vote.VoteId, "voter-3", true)
+	if status := e.vote(vote.VoteId).Status; status != VoteStatusApproved {
+		t.Fatalf("status at the fractional quorum %s", status)
+	}
+
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 1).photo("no-list")}, newTestDevice(t, 1).publicKey, `{"quorumFraction": 0.5}`)
+	requireError(t, err)
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 1).photo("too-large")}, newTestDevice(t, 1).publicKey, `{"eligibleVoters": ["voter-1"], "quorumFraction": 1.5}`)
+	requireError(t, err)
+}
+
+func TestExpectedPhotoCountMustMatchExactly(t *testing.T) {
+	e := newTestEnv(t)
+	e.startVoteWithOptions(newTestDevice(t, 0), `{"expectedPhotoCount": 3}`, "pose-1", "pose-2", "pose-3")
+
+	device := newTestDevice(t, 1)
+	photos := []IPFSPhoto{device.photo("short-1"), device.photo("short-2")}
+	_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, `{"expectedPhotoCount": 3}`)
+	if err == nil || !strings.Contains(err.Error(), "expected 3 photos, got 2") {
+		t.Fatalf("StartPhotoVoteWithOptions with one photo short: %v", err)
+	}
+	photos = append(photos, device.photo("short-3"), device.photo("short-4"))
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, `{"expectedPhotoCount": 3}`)
+	if err == nil || !strings.Contains(err.Error(), "expected 3 photos, got 4") {
+		t.Fatalf("StartPhotoVoteWithOptions with one photo over: %v", err)
+	}
+}
+
+func TestPerVoteQuorumBoundedByGlobalCaps(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"minPerVoteQuorum": 2, "maxPerVoteQuorum": 3}`)
+	eligible := `"eligibleVoters": ["voter-1", "voter-2", "voter-3", "voter-4"]`
+	start := func(n int, fraction string) error {
+		device := newTestDevice(t, n)
+		_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("bounded-" + fraction)}, device.publicKey, `{`+eligible+`, "quorumFraction": `+fraction+`}`)
+		return err
+	}
+
+	requireNoError(t, start(0, "0.5"))
+	err := start(1, "0.25")
+	if err == nil || !strings.Contains(err.Error(), "below the minimum of 2") {
+		t.Fatalf("quorum below the global minimum: %v", err)
+	}
+	err = start(2, "1")
+	if err == nil || !strings.Contains(err.Error(), "above the maximum of 3") {
+		t.Fatalf("quorum above the global maximum: %v", err)
+	}
+	requireError(t, e.dr.SetConfig(e.admin(), `{"minPerVoteQuorum": 4, "maxPerVoteQuorum": 3}`))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// VoteParticipant is one counted ballot of a vote and the choice it carried
+type VoteParticipant struct {
+	VoterID   string `json:"voterId"`
+	Choice    string `json:"choice"`                                // "VALID" or "INVALID"
+	Timestamp string `json:"timestamp"`                             // RFC3339 timestamp of the transaction that counted the ballot
+	Round     int    `json:"round"`                                 // Voting round the ballot was counted in, starting at 1
+	CastBy    string `json:"castBy,omitempty" metadata:",optional"` // Delegate who cast the ballot on the voter's behalf
+}
+
+// putVoterBallot records a counted ballot apart from the vote so choices stay unreadable until it ends
+func putVoterBallot(ctx contractapi.TransactionContextInterface, vote *PhotoVote, ballot string, castBy string, isValid bool) error {
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	participant := VoteParticipant{
+		VoterID:   ballot,
+		Choice:    "INVALID",
+		Timestamp: txTime.Format(time.RFC3339),
+		Round:     len(vote.Rounds) + 1,
+	}
+	if isValid {
+		participant.Choice = "VALID"
+	}
+	if castBy != ballot {
+		participant.CastBy = castBy
+	}
+
+	// The zero-padded round keeps a vote's ballots ordered by round, then by voter
+	ballotKey, err := ctx.GetStub().CreateCompositeKey("VoterBallot", []string{vote.VoteId, fmt.Sprintf("%04d", participant.Round), ballot})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for voter ballot: %v", err)
+	}
+
+	participantJSON, err := json.Marshal(participant)
+	if err != nil {
+		return fmt.Errorf("failed to marshal voter ballot: %v", err)
+	}
+
+	return ctx.GetStub().PutState(ballotKey, participantJSON)
+}
+
+// ballotsHidden reports whether a vote's individual choices must stay unreadable because it has not
+// ended yet and they could sway the remaining voters
+func ballotsHidden(vote *PhotoVote) bool {
+	return vote.Status == VoteStatusPending || vote.Status == VoteStatusReady
+}
+
+// getVoterBallots reads every counted ballot of a vote, ordered by round and voter
+func getVoterBallots(ctx contractapi.TransactionContextInterface, voteId string) ([]VoteParticipant, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("VoterBallot", []string{voteId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read voter ballots: %v", err)
+	}
+	defer iterator.Close()
+
+	participants := make([]VoteParticipant, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate voter ballots: %v", err)
+		}
+
+		var participant VoteParticipant
+		if err := json.Unmarshal(entry.Value, &participant); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal voter ballot: %v", err)
+		}
+		participants = append(participants, participant)
+	}
+
+	return participants, nil
+}
+
+// GetVoteParticipants returns who voted on an ended vote and how, ordered by round and voter; choices stay
+// hidden while the vote is PENDING or READY so they cannot sway the remaining voters
+func (dr *DeviceRegistration) GetVoteParticipants(ctx contractapi.TransactionContextInterface, voteId string) ([]VoteParticipant, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+	if ballotsHidden(vote) {
+		return nil, fmt.Errorf("participants of vote %s are hidden until it is finalized", vote.VoteId)
+	}
+
+	return getVoterBallots(ctx, vote.VoteId)
+}
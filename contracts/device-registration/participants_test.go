@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVoteParticipantsHiddenUntilFinalized(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "APPROVE"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "participants")
+
+	e.cast(vote.VoteId, "voter-2", false)
+	_, err := e.dr.GetVoteParticipants(e.admin(), vote.VoteId)
+	requireError(t, err)
+
+	e.advance(time.Minute)
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("status after the tie-breaking ballot %s", got)
+	}
+	participants, err := e.dr.GetVoteParticipants(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	expected := []VoteParticipant{
+		{VoterID: "voter-1", Choice: "VALID", Timestamp: "2025-01-01T00:01:00Z", Round: 1},
+		{VoterID: "voter-2", Choice: "INVALID", Timestamp: "2025-01-01T00:00:00Z", Round: 1},
+	}
+	if len(participants) != len(expected) || participants[0] != expected[0] || participants[1] != expected[1] {
+		t.Fatalf("participants %+v, expected %+v", participants, expected)
+	}
+}
@@ -0,0 +1,997 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RejectionReason is a machine-readable code explaining why a photo was rejected
+type RejectionReason string
+
+const (
+	ReasonInvalidSignature   RejectionReason = "INVALID_SIGNATURE"
+	ReasonDuplicateHash      RejectionReason = "DUPLICATE_HASH"
+	ReasonMalformedHash      RejectionReason = "MALFORMED_HASH"
+	ReasonMissingDescription RejectionReason = "MISSING_DESCRIPTION"
+	ReasonInvalidDescription RejectionReason = "INVALID_DESCRIPTION"
+	ReasonInvalidMetadata    RejectionReason = "INVALID_METADATA"
+)
+
+// PhotoError is a structured photo rejection; its message is prefixed with the reason code
+type PhotoError struct {
+	Reason   RejectionReason
+	IPFSHash string
+	Message  string
+}
+
+func (e *PhotoError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+// newPhotoError builds a PhotoError with a formatted message
+func newPhotoError(reason RejectionReason, ipfsHash string, format string, args ...interface{}) *PhotoError {
+	return &PhotoError{
+		Reason:   reason,
+		IPFSHash: ipfsHash,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// base58Alphabet is the bitcoin base58 alphabet used by CIDv0
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base32CID is the lowercase, unpadded RFC 4648 base32 encoding used by CIDv1
+var base32CID = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// multihash describes a multihash algorithm a CID may use
+type multihash struct {
+	name   string
+	length int // Digest length in bytes
+}
+
+// multihashAlgorithms are the multihash codes photo CIDs are recognised with, keyed by code
+var multihashAlgorithms = map[uint64]multihash{
+	0x12:   {name: "sha2-256", length: 32},
+	0x13:   {name: "sha2-512", length: 64},
+	0x16:   {name: "sha3-256", length: 32},
+	0x14:   {name: "sha3-512", length: 64},
+	0x1e:   {name: "blake3", length: 32},
+	0xb220: {name: "blake2b-256", length: 32},
+	0xb240: {name: "blake2b-512", length: 64},
+}
+
+// isKnownHashAlgorithm reports whether a name is one of the recognised multihash algorithms
+func isKnownHashAlgorithm(name string) bool {
+	for _, algorithm := range multihashAlgorithms {
+		if algorithm.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDv1Multihash decodes the multihash of a binary CIDv1 and returns its algorithm name
+func parseCIDv1Multihash(cidBytes []byte) (string, error) {
+	version, n := binary.Uvarint(cidBytes)
+	if n <= 0 || version != 1 {
+		return "", fmt.Errorf("CIDv1 has an invalid version prefix")
+	}
+	rest := cidBytes[n:]
+
+	_, n = binary.Uvarint(rest)
+	if n <= 0 {
+		return "", fmt.Errorf("CIDv1 has an invalid content codec")
+	}
+	rest = rest[n:]
+
+	code, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return "", fmt.Errorf("CIDv1 has an invalid multihash code")
+	}
+	rest = rest[n:]
+
+	length, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return "", fmt.Errorf("CIDv1 has an invalid multihash length")
+	}
+	digest := rest[n:]
+	if length != uint64(len(digest)) {
+		return "", fmt.Errorf("CIDv1 multihash declares %d digest bytes, has %d", length, len(digest))
+	}
+
+	algorithm, ok := multihashAlgorithms[code]
+	if !ok {
+		return "", fmt.Errorf("CIDv1 uses unrecognised multihash code 0x%x", code)
+	}
+	if len(digest) != algorithm.length {
+		return "", fmt.Errorf("CIDv1 %s digest must be %d bytes, got %d", algorithm.name, algorithm.length, len(digest))
+	}
+	return algorithm.name, nil
+}
+
+// validateIPFSHash checks that a hash is a well-formed CIDv0 or base32 CIDv1 whose multihash
+// algorithm the configuration allows, and returns that algorithm; CIDv0 is always sha2-256
+func validateIPFSHash(ipfsHash string, config *ContractConfig) (string, error) {
+	var algorithm string
+	switch {
+	case strings.HasPrefix(ipfsHash, "Qm"):
+		if len(ipfsHash) != 46 {
+			return "", fmt.Errorf("CIDv0 must be 46 characters, got %d", len(ipfsHash))
+		}
+		for _, r := range ipfsHash {
+			if !strings.ContainsRune(base58Alphabet, r) {
+				return "", fmt.Errorf("CIDv0 contains invalid character %q", r)
+			}
+		}
+		algorithm = "sha2-256"
+	case strings.HasPrefix(ipfsHash, "b"):
+		cidBytes, err := base32CID.DecodeString(ipfsHash[1:])
+		if err != nil {
+			return "", fmt.Errorf("CIDv1 is not valid base32: %v", err)
+		}
+		algorithm, err = parseCIDv1Multihash(cidBytes)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("hash is neither a CIDv0 nor a base32 CIDv1")
+	}
+
+	if !slices.Contains(config.AllowedHashAlgorithms, algorithm) {
+		return "", fmt.Errorf("hash algorithm %s is not allowed", algorithm)
+	}
+	return algorithm, nil
+}
+
+// allowedMimeTypes are the image formats accepted in photo metadata
+var allowedMimeTypes = []string{"image/jpeg", "image/png", "image/webp", "image/heic"}
+
+// validatePhotoMetadata checks the optional MIME type and dimensions of a photo
+func validatePhotoMetadata(photo *IPFSPhoto, config *ContractConfig) error {
+	if photo.MimeType != "" && !slices.Contains(allowedMimeTypes, photo.MimeType) {
+		return fmt.Errorf("unsupported MIME type %s", photo.MimeType)
+	}
+	if photo.Width < 0 || photo.Height < 0 {
+		return fmt.Errorf("dimensions must be positive, got %dx%d", photo.Width, photo.Height)
+	}
+	if (photo.Width == 0) != (photo.Height == 0) {
+		return fmt.Errorf("width and height must be given together")
+	}
+	if photo.ThumbnailIPFSHash != "" {
+		if _, err := validateIPFSHash(photo.ThumbnailIPFSHash, config); err != nil {
+			return fmt.Errorf("malformed thumbnail IPFS hash %s: %v", photo.ThumbnailIPFSHash, err)
+		}
+		if photo.ThumbnailIPFSHash == photo.IPFSHash {
+			return fmt.Errorf("thumbnail IPFS hash must differ from the photo hash")
+		}
+	}
+	return nil
+}
+
+// signatureTally counts the photo signatures checked while validating a photo set
+type signatureTally struct {
+	verified int
+	failed   int
+	reused   int // Photos served from an already stored record
+}
+
+// record counts one signature check; a nil tally records nothing
+func (t *signatureTally) record(ok bool) {
+	if t == nil {
+		return
+	}
+	if ok {
+		t.verified++
+	} else {
+		t.failed++
+	}
+}
+
+// checkPhoto runs every per-photo validation and sanitizes the description in place; a fault in the photo
+// is returned as a PhotoError, and a failure to read the ledger as a plain error
+func checkPhoto(ctx contractapi.TransactionContextInterface, photo *IPFSPhoto, devicePubKey crypto.PublicKey, signatureEncoding string, config *ContractConfig, seen map[string]bool, tally *signatureTally) (*PhotoError, error) {
+	hashAlgorithm, err := validateIPFSHash(photo.IPFSHash, config)
+	if err != nil {
+		return newPhotoError(ReasonMalformedHash, photo.IPFSHash, "malformed IPFS hash %s: %v", photo.IPFSHash, err), nil
+	}
+
+	// Writes are not visible to reads within a transaction, so duplicates in the set are tracked separately
+	if seen[photo.IPFSHash] {
+		return newPhotoError(ReasonDuplicateHash, photo.IPFSHash, "photo with hash %s appears more than once", photo.IPFSHash), nil
+	}
+	seen[photo.IPFSHash] = true
+
+	photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{photo.IPFSHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for photo: %v", err)
+	}
+	existing, err := ctx.GetStub().GetState(photoKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		if !config.ReuseExistingPhotos {
+			return newPhotoError(ReasonDuplicateHash, photo.IPFSHash, "photo with hash %s already exists", photo.IPFSHash), nil
+		}
+
+		// Reuse the stored record, provided the same device key signed it
+		var stored IPFSPhoto
+		if err := json.Unmarshal(existing, &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal existing photo %s: %v", photo.IPFSHash, err)
+		}
+		storedValid := verifyPhotoSignatureWithKey(stored, devicePubKey, signatureEncoding, pssOptions(config))
+		tally.record(storedValid)
+		if !storedValid {
+			return newPhotoError(ReasonDuplicateHash, photo.IPFSHash, "photo with hash %s already exists and was not signed by this device key", photo.IPFSHash), nil
+		}
+		if stored.Status == "FLAGGED" {
+			return newPhotoError(ReasonDuplicateHash, photo.IPFSHash, "existing photo with hash %s has been flagged: %s", photo.IPFSHash, stored.FlagReason), nil
+		}
+		if max(stored.SignatureFormat, photoSignatureFormat) < config.MinSignatureFormat {
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "existing photo with hash %s uses signature format %d, below the required format %d", photo.IPFSHash, stored.SignatureFormat, config.MinSignatureFormat), nil
+		}
+
+		// The stored signature is public, so the submitter must also sign the photo afresh for an enrollment session
+		if photo.SessionChallenge == "" {
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "reusing photo with hash %s requires a signature bound to an enrollment session", photo.IPFSHash), nil
+		}
+		photo.SignedPayloadDigest = ""
+		freshValid := verifyPhotoSignatureWithKey(*photo, devicePubKey, signatureEncoding, pssOptions(config))
+		tally.record(freshValid)
+		if !freshValid {
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "invalid enrollment session signature for reused photo with hash: %s", photo.IPFSHash), nil
+		}
+		if tally != nil {
+			tally.reused++
+		}
+		*photo = stored
+		return nil, nil
+	}
+
+	// Flags, payload digests and the hash algorithm are assigned by the contract, never by the submitter
+	photo.Status = ""
+	photo.FlagReason = ""
+	photo.SignedPayloadDigest = ""
+	photo.HashAlgorithm = hashAlgorithm
+
+	// Record which payload format the signature covers
+	if photo.SignatureFormat == 0 {
+		photo.SignatureFormat = photoSignatureFormat
+	}
+	if photo.SignatureFormat != photoSignatureFormatV1 && photo.SignatureFormat != photoSignatureFormatV2 {
+		return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "unsupported signature format %d for photo with hash: %s", photo.SignatureFormat, photo.IPFSHash), nil
+	}
+	if photo.SignatureFormat < config.MinSignatureFormat {
+		return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "signature format %d for photo with hash %s is below the required format %d", photo.SignatureFormat, photo.IPFSHash, config.MinSignatureFormat), nil
+	}
+
+	// Verify digital signature as the signature mode requires, recording on the photo how it was checked
+	photo.SignatureMode = config.SignatureMode
+	photo.SignatureUnverified = false
+	if config.SignatureMode == "OFF" {
+		photo.SignatureUnverified = true
+	} else {
+		signatureValid := verifyPhotoSignatureWithKey(*photo, devicePubKey, signatureEncoding, pssOptions(config))
+		tally.record(signatureValid)
+		switch {
+		case signatureValid:
+			fmt.Println("Valid digital signature for photo with hash: ", photo.IPFSHash)
+		case config.SignatureMode == "WARN":
+			photo.SignatureUnverified = true
+		default:
+			fmt.Println("Invalid digital signature for photo with hash: ", photo.IPFSHash)
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "invalid digital signature for photo with hash: %s", photo.IPFSHash), nil
+		}
+	}
+
+	// The operator who uploaded the photo may vouch for the upload separately from the device
+	if photo.OperatorPublicKey != "" || photo.OperatorSignature != "" {
+		if photo.OperatorPublicKey == "" || photo.OperatorSignature == "" {
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "photo with hash %s needs both an operator public key and an operator signature", photo.IPFSHash), nil
+		}
+		if !verifyOperatorSignature(*photo, pssOptions(config)) {
+			return newPhotoError(ReasonInvalidSignature, photo.IPFSHash, "invalid operator signature for photo with hash: %s", photo.IPFSHash), nil
+		}
+	}
+
+	// Hex decoding ignores case, so store one casing to keep signatures comparable across records
+	photo.Signature = strings.ToLower(photo.Signature)
+	photo.OperatorSignature = strings.ToLower(photo.OperatorSignature)
+
+	if err := validatePhotoMetadata(photo, config); err != nil {
+		return newPhotoError(ReasonInvalidMetadata, photo.IPFSHash, "invalid metadata for photo with hash %s: %v", photo.IPFSHash, err), nil
+	}
+
+	if config.RequireDescription && strings.TrimSpace(photo.Description) == "" {
+		return newPhotoError(ReasonMissingDescription, photo.IPFSHash, "photo with hash %s has no description", photo.IPFSHash), nil
+	}
+
+	// A version 1 description is not covered by the signature, so it can be sanitized before storing
+	description, err := sanitizeDescription(photo.Description, config)
+	if err != nil {
+		return newPhotoError(ReasonInvalidDescription, photo.IPFSHash, "invalid description for photo with hash %s: %v", photo.IPFSHash, err), nil
+	}
+	if photo.SignatureFormat == photoSignatureFormatV2 && description != photo.Description {
+		return newPhotoError(ReasonInvalidDescription, photo.IPFSHash, "signed description for photo with hash %s contains non-printable characters", photo.IPFSHash), nil
+	}
+	photo.Description = description
+	if err := checkDescriptionBytes(photo.IPFSHash, description, config); err != nil {
+		return newPhotoError(ReasonInvalidDescription, photo.IPFSHash, "%v", err), nil
+	}
+
+	return nil, nil
+}
+
+// checkPhotoSet runs the validations that apply to the photo set as a whole
+func checkPhotoSet(ipfsPhotos []IPFSPhoto, config *ContractConfig) error {
+	if len(ipfsPhotos) == 0 {
+		return fmt.Errorf("IPFS photos array cannot be empty")
+	}
+
+	if config.RequireMonotonicTimestamps {
+		var previous time.Time
+		for i, photo := range ipfsPhotos {
+			timestamp, err := time.Parse(time.RFC3339, photo.TimeStamp)
+			if err != nil {
+				return fmt.Errorf("photo with hash %s has invalid RFC3339 timestamp %s: %v", photo.IPFSHash, photo.TimeStamp, err)
+			}
+			if i > 0 && timestamp.Before(previous) {
+				return fmt.Errorf("photo with hash %s is timestamped before the previous photo", photo.IPFSHash)
+			}
+			previous = timestamp
+		}
+	}
+
+	return checkDistinctUploaders(ipfsPhotos, config)
+}
+
+// checkDistinctUploaders requires the photos to come from at least the configured number of uploaders
+func checkDistinctUploaders(ipfsPhotos []IPFSPhoto, config *ContractConfig) error {
+	uploaders := make(map[string]bool)
+	for _, photo := range ipfsPhotos {
+		uploaders[photo.UploadedBy] = true
+	}
+	if len(uploaders) < config.MinDistinctUploaders {
+		return fmt.Errorf("photos come from %d distinct uploaders, at least %d required", len(uploaders), config.MinDistinctUploaders)
+	}
+
+	return nil
+}
+
+// PhotoCheckResult is the preflight verdict for a single photo
+type PhotoCheckResult struct {
+	IPFSHash string          `json:"ipfsHash"`
+	Valid    bool            `json:"valid"`
+	Reason   RejectionReason `json:"reason"`  // Rejection code, empty when valid
+	Message  string          `json:"message"` // Rejection details, empty when valid
+}
+
+// PreflightReport summarizes whether a photo set would be accepted by StartPhotoVote
+type PreflightReport struct {
+	Valid     bool               `json:"valid"`
+	Photos    []PhotoCheckResult `json:"photos"`
+	SetErrors []string           `json:"setErrors"` // Problems with the photo set as a whole
+}
+
+// PreflightPhotoVote runs the StartPhotoVote photo checks without writing to the world state
+func (dr *DeviceRegistration) PreflightPhotoVote(ctx contractapi.TransactionContextInterface, ipfsPhotos []IPFSPhoto, devicePublicKey string) (*PreflightReport, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PreflightReport{
+		Valid:     true,
+		Photos:    make([]PhotoCheckResult, 0, len(ipfsPhotos)),
+		SetErrors: make([]string, 0),
+	}
+
+	devicePublicKey, _, err = resolveDevicePublicKey(ctx, devicePublicKey, config)
+	if err != nil {
+		report.Valid = false
+		report.SetErrors = append(report.SetErrors, err.Error())
+	}
+	devicePubKey, _ := parsePublicKey(devicePublicKey)
+	if err := checkPhotoSet(ipfsPhotos, config); err != nil {
+		report.Valid = false
+		report.SetErrors = append(report.SetErrors, err.Error())
+	}
+
+	// Signatures are checked with the encoding an already registered key declared
+	deviceKey, err := findDeviceKey(ctx, fmt.Sprintf("%x", sha256.Sum256([]byte(devicePublicKey))))
+	if err != nil {
+		return nil, err
+	}
+	signatureEncoding := ""
+	if deviceKey != nil {
+		signatureEncoding = deviceKey.SignatureEncoding
+	}
+
+	seen := make(map[string]bool)
+	tally := &signatureTally{}
+	for i, photo := range ipfsPhotos {
+		result := PhotoCheckResult{IPFSHash: photo.IPFSHash, Valid: true}
+		applyDefaultDescription(&photo, i+1, config)
+		photoErr, err := checkPhoto(ctx, &photo, devicePubKey, signatureEncoding, config, seen, tally)
+		if err != nil {
+			return nil, err
+		}
+		if photoErr != nil {
+			result.Valid = false
+			result.Reason = photoErr.Reason
+			result.Message = photoErr.Message
+			report.Valid = false
+		}
+		report.Photos = append(report.Photos, result)
+	}
+
+	return report, nil
+}
+
+// SignatureStats reports how many photo signatures verified or failed for a device key
+type SignatureStats struct {
+	PublicKeyHash    string `json:"publicKeyHash"`
+	VerifiedSigCount int    `json:"verifiedSigCount"`
+	FailedSigCount   int    `json:"failedSigCount"`
+}
+
+// GetDeviceSignatureStats returns the photo signature counters recorded for a device key
+func (dr *DeviceRegistration) GetDeviceSignatureStats(ctx contractapi.TransactionContextInterface, pubKeyHash string) (*SignatureStats, error) {
+	deviceKey, err := getDeviceKey(ctx, pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignatureStats{
+		PublicKeyHash:    pubKeyHash,
+		VerifiedSigCount: deviceKey.VerifiedSigCount,
+		FailedSigCount:   deviceKey.FailedSigCount,
+	}, nil
+}
+
+// GetPhotoSigningPayload returns the exact message the contract hashes and verifies for a photo,
+// so clients can sign the authoritative payload; the signature field is ignored
+func (dr *DeviceRegistration) GetPhotoSigningPayload(ctx contractapi.TransactionContextInterface, photo IPFSPhoto) (string, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if photo.SignatureFormat == 0 {
+		photo.SignatureFormat = photoSignatureFormat
+	}
+	if photo.SignatureFormat != photoSignatureFormatV1 && photo.SignatureFormat != photoSignatureFormatV2 {
+		return "", fmt.Errorf("unsupported signature format %d", photo.SignatureFormat)
+	}
+	if photo.SignatureFormat < config.MinSignatureFormat {
+		return "", fmt.Errorf("signature format %d is below the required format %d", photo.SignatureFormat, config.MinSignatureFormat)
+	}
+
+	return photoSigningPayload(photo), nil
+}
+
+// sanitizeDescription applies the configured description policy, stripping or rejecting non-printable characters
+func sanitizeDescription(description string, config *ContractConfig) (string, error) {
+	if !utf8.ValidString(description) {
+		return "", fmt.Errorf("description is not valid UTF-8")
+	}
+
+	var sanitized strings.Builder
+	for _, r := range description {
+		if !unicode.IsPrint(r) {
+			if config.DescriptionPolicy == "REJECT" {
+				return "", fmt.Errorf("description contains non-printable character %U", r)
+			}
+			continue
+		}
+		sanitized.WriteRune(r)
+	}
+
+	if config.MaxDescriptionLength > 0 && utf8.RuneCountInString(sanitized.String()) > config.MaxDescriptionLength {
+		return "", fmt.Errorf("description exceeds %d characters", config.MaxDescriptionLength)
+	}
+
+	return sanitized.String(), nil
+}
+
+// checkDescriptionBytes enforces the configured byte size cap on a photo's sanitized description
+func checkDescriptionBytes(ipfsHash string, description string, config *ContractConfig) error {
+	if config.MaxDescriptionBytes > 0 && len(description) > config.MaxDescriptionBytes {
+		return fmt.Errorf("description of photo %s is %d bytes, exceeding the limit of %d bytes", ipfsHash, len(description), config.MaxDescriptionBytes)
+	}
+	return nil
+}
+
+// applyDefaultDescription fills an empty description from the configured template; position is the
+// photo's 1-based place in its set. A description signed under format 2 is left as it is.
+func applyDefaultDescription(photo *IPFSPhoto, position int, config *ContractConfig) {
+	if config.DefaultDescriptionTemplate == "" || strings.TrimSpace(photo.Description) != "" {
+		return
+	}
+	if photo.SignatureFormat != 0 && photo.SignatureFormat != photoSignatureFormatV1 {
+		return
+	}
+
+	photo.Description = strings.NewReplacer(
+		"{n}", strconv.Itoa(position),
+		"{uploader}", photo.UploadedBy,
+		"{timestamp}", photo.TimeStamp,
+		"{hash}", photo.IPFSHash,
+	).Replace(config.DefaultDescriptionTemplate)
+}
+
+// UpdatePhotoDescription replaces the description of a stored photo (uploader only); descriptions are
+// not stored under the COMPACT photo storage mode, so it is refused there
+func (dr *DeviceRegistration) UpdatePhotoDescription(ctx contractapi.TransactionContextInterface, ipfsHash string, description string) (*IPFSPhoto, error) {
+	photo, err := dr.GetPhotoMetadata(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client identity: %v", err)
+	}
+	if photo.UploadedBy != clientID {
+		return nil, fmt.Errorf("only the uploader may update the description of photo %s", ipfsHash)
+	}
+	if photo.SignatureFormat == photoSignatureFormatV2 {
+		return nil, fmt.Errorf("description of photo %s is covered by its signature and cannot be updated", ipfsHash)
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config.PhotoStorageMode == "COMPACT" {
+		return nil, fmt.Errorf("photo descriptions are not stored under the COMPACT photo storage mode")
+	}
+
+	photo.Description, err = sanitizeDescription(description, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid description for photo with hash %s: %v", ipfsHash, err)
+	}
+	err = checkDescriptionBytes(ipfsHash, photo.Description, config)
+	if err != nil {
+		return nil, err
+	}
+
+	photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{ipfsHash})
+	if err != nil {
+		return nil, err
+	}
+
+	photoJSON, err := photoRecordJSON(*photo, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.GetStub().PutState(photoKey, photoJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return photo, nil
+}
+
+// PhotoFlaggedEvent is the payload of the PhotoFlagged chaincode event
+type PhotoFlaggedEvent struct {
+	IPFSHash         string `json:"ipfsHash"`
+	Reason           string `json:"reason"`
+	VoteId           string `json:"voteId"`
+	FlaggedPhotos    int    `json:"flaggedPhotos"`    // Flagged photos in the vote, including this one
+	TotalPhotos      int    `json:"totalPhotos"`      // Photos in the vote
+	DeviceUnverified bool   `json:"deviceUnverified"` // The flag reached the threshold and returned the device key to UNVERIFIED
+}
+
+// FlagPhoto marks a stored photo FLAGGED; once the configured share of its vote's photos is flagged,
+// a VERIFIED device key returns to UNVERIFIED and must pass a new vote (admin only)
+func (dr *DeviceRegistration) FlagPhoto(ctx contractapi.TransactionContextInterface, ipfsHash string, reason string) (*IPFSPhoto, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if reason == "" {
+		return nil, fmt.Errorf("a reason is required to flag a photo")
+	}
+
+	photo, err := dr.GetPhotoMetadata(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+	if photo.Status == "FLAGGED" {
+		return nil, fmt.Errorf("photo %s is already flagged", ipfsHash)
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	photo.Status = "FLAGGED"
+	photo.FlagReason = reason
+
+	photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{ipfsHash})
+	if err != nil {
+		return nil, err
+	}
+
+	photoJSON, err := photoRecordJSON(*photo, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.GetStub().PutState(photoKey, photoJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	event := PhotoFlaggedEvent{IPFSHash: ipfsHash, Reason: reason}
+
+	event.VoteId, err = findPhotoVoteId(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+	if event.VoteId != "" {
+		vote, err := getVote(ctx, event.VoteId)
+		if err != nil {
+			return nil, err
+		}
+
+		// The flag just written is not visible to reads in this transaction, so this photo is counted directly
+		event.TotalPhotos = len(vote.PhotoIPFSHashes)
+		for _, voteHash := range vote.PhotoIPFSHashes {
+			if voteHash == ipfsHash {
+				event.FlaggedPhotos++
+				continue
+			}
+			votePhoto, err := dr.GetPhotoMetadata(ctx, voteHash)
+			if err != nil {
+				return nil, err
+			}
+			if votePhoto.Status == "FLAGGED" {
+				event.FlaggedPhotos++
+			}
+		}
+
+		if config.PhotoFlagThreshold > 0 && float64(event.FlaggedPhotos) >= config.PhotoFlagThreshold*float64(event.TotalPhotos) {
+			deviceKey, err := findDeviceKey(ctx, vote.DevicePublicKey)
+			if err != nil {
+				return nil, err
+			}
+			if deviceKey != nil && deviceKey.Status == DeviceStatusVerified {
+				deviceKey.Status = DeviceStatusUnverified
+				err = putDeviceKey(ctx, deviceKey, DeviceStatusVerified)
+				if err != nil {
+					return nil, err
+				}
+				event.DeviceUnverified = true
+			}
+		}
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = setEvent(ctx, "PhotoFlagged", eventJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return photo, nil
+}
+
+// compactPhotoRecord is the stored form of a photo under the COMPACT storage mode: the hash, signature
+// and uploader, the state the contract assigns, and the digest its signature can still be checked against
+type compactPhotoRecord struct {
+	IPFSHash            string `json:"ipfsHash"`
+	Signature           string `json:"signature"`
+	UploadedBy          string `json:"uploadedBy"`
+	SignatureFormat     int    `json:"signatureFormat,omitempty"`
+	Status              string `json:"status,omitempty"`
+	FlagReason          string `json:"flagReason,omitempty"`
+	SignatureMode       string `json:"signatureMode,omitempty"`
+	SignatureUnverified bool   `json:"signatureUnverified,omitempty"`
+	HashAlgorithm       string `json:"hashAlgorithm,omitempty"`
+	SignedPayloadDigest string `json:"signedPayloadDigest"`
+}
+
+// photoRecordJSON encodes a photo for the world state under the configured storage mode; compact
+// records decode into an IPFSPhoto whose dropped fields are empty
+func photoRecordJSON(photo IPFSPhoto, config *ContractConfig) ([]byte, error) {
+	if config.PhotoStorageMode != "COMPACT" {
+		return json.Marshal(photo)
+	}
+
+	digest := photo.SignedPayloadDigest
+	if digest == "" {
+		hashed := sha256.Sum256([]byte(photoSigningPayload(photo)))
+		digest = hex.EncodeToString(hashed[:])
+	}
+	return json.Marshal(compactPhotoRecord{
+		IPFSHash:            photo.IPFSHash,
+		Signature:           photo.Signature,
+		UploadedBy:          photo.UploadedBy,
+		SignatureFormat:     photo.SignatureFormat,
+		Status:              photo.Status,
+		FlagReason:          photo.FlagReason,
+		SignatureMode:       photo.SignatureMode,
+		SignatureUnverified: photo.SignatureUnverified,
+		HashAlgorithm:       photo.HashAlgorithm,
+		SignedPayloadDigest: digest,
+	})
+}
+
+// checkVotePhotos re-reads the photos a vote references and returns a description of the first
+// one that is missing or no longer matches, or "" when all are intact
+func checkVotePhotos(ctx contractapi.TransactionContextInterface, vote *PhotoVote) (string, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	deviceKey, err := getDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	devicePubKey, err := parsePublicKey(deviceKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ipfsHash := range vote.PhotoIPFSHashes {
+		photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{ipfsHash})
+		if err != nil {
+			return "", fmt.Errorf("failed to create composite key for photo: %v", err)
+		}
+
+		photoJSON, err := ctx.GetStub().GetState(photoKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to read photo %s: %v", ipfsHash, err)
+		}
+		if photoJSON == nil {
+			return fmt.Sprintf("photo %s is missing", ipfsHash), nil
+		}
+
+		var photo IPFSPhoto
+		if err := json.Unmarshal(photoJSON, &photo); err != nil {
+			return fmt.Sprintf("photo %s cannot be decoded: %v", ipfsHash, err), nil
+		}
+		if photo.IPFSHash != ipfsHash {
+			return fmt.Sprintf("photo %s has hash %s", ipfsHash, photo.IPFSHash), nil
+		}
+		if !photo.SignatureUnverified && !verifyPhotoSignatureWithKey(photo, devicePubKey, deviceKey.SignatureEncoding, pssOptions(config)) {
+			return fmt.Sprintf("photo %s signature no longer verifies", ipfsHash), nil
+		}
+		if photo.Status == "FLAGGED" {
+			return fmt.Sprintf("photo %s has been flagged: %s", ipfsHash, photo.FlagReason), nil
+		}
+	}
+
+	return "", nil
+}
+
+// putPhotoVoteRef records which vote a photo was submitted to, replacing the current reference and
+// adding the vote to the photo's append-only history
+func putPhotoVoteRef(ctx contractapi.TransactionContextInterface, ipfsHash string, voteId string) error {
+	refKey, err := ctx.GetStub().CreateCompositeKey("PhotoVoteRef", []string{ipfsHash})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for photo vote index: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(refKey, []byte(voteId))
+	if err != nil {
+		return err
+	}
+
+	historyKey, err := ctx.GetStub().CreateCompositeKey("PhotoVoteHistory", []string{ipfsHash, voteId})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for photo vote history: %v", err)
+	}
+
+	return ctx.GetStub().PutState(historyKey, []byte{0x00})
+}
+
+// GetAllVotesForPhoto returns every vote that has referenced a photo, oldest first; photos referenced
+// before the history index existed return only their current vote
+func (dr *DeviceRegistration) GetAllVotesForPhoto(ctx contractapi.TransactionContextInterface, ipfsHash string) ([]*PhotoVote, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("PhotoVoteHistory", []string{ipfsHash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read photo vote history: %v", err)
+	}
+	defer iterator.Close()
+
+	votes := make([]*PhotoVote, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate photo vote history: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split photo vote history key: %v", err)
+		}
+
+		vote, err := getVote(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		votes = append(votes, vote)
+	}
+
+	currentVoteId, err := findPhotoVoteId(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+	if currentVoteId != "" && !slices.ContainsFunc(votes, func(vote *PhotoVote) bool { return vote.VoteId == currentVoteId }) {
+		vote, err := getVote(ctx, currentVoteId)
+		if err != nil {
+			return nil, err
+		}
+		votes = append(votes, vote)
+	}
+
+	// History keys sort by vote ID; creation time orders the associations as they happened
+	slices.SortStableFunc(votes, func(a, b *PhotoVote) int { return strings.Compare(a.CreatedAt, b.CreatedAt) })
+
+	return votes, nil
+}
+
+// GetPhotosAwaitingVote returns the photos whose current vote is still PENDING, ordered by vote ID and then
+// by their position in the vote; photos missing from state are left to finalization to flag
+func (dr *DeviceRegistration) GetPhotosAwaitingVote(ctx contractapi.TransactionContextInterface) ([]*IPFSPhoto, error) {
+	votes, err := getVotesByStatus(ctx, VoteStatusPending)
+	if err != nil {
+		return nil, err
+	}
+
+	photos := make([]*IPFSPhoto, 0)
+	for _, vote := range votes {
+		for _, ipfsHash := range vote.PhotoIPFSHashes {
+			// A reused photo belongs to the vote that referenced it last
+			voteId, err := findPhotoVoteId(ctx, ipfsHash)
+			if err != nil {
+				return nil, err
+			}
+			if voteId != vote.VoteId {
+				continue
+			}
+
+			photoKey, err := ctx.GetStub().CreateCompositeKey("Photo", []string{ipfsHash})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create composite key for photo: %v", err)
+			}
+			photoJSON, err := ctx.GetStub().GetState(photoKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read photo %s: %v", ipfsHash, err)
+			}
+			if photoJSON == nil {
+				continue
+			}
+
+			var photo IPFSPhoto
+			if err := json.Unmarshal(photoJSON, &photo); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal photo %s: %v", ipfsHash, err)
+			}
+			photos = append(photos, &photo)
+		}
+	}
+
+	return photos, nil
+}
+
+// findPhotoVoteId returns the ID of the vote a photo was submitted to, or "" when none is recorded
+func findPhotoVoteId(ctx contractapi.TransactionContextInterface, ipfsHash string) (string, error) {
+	refKey, err := ctx.GetStub().CreateCompositeKey("PhotoVoteRef", []string{ipfsHash})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key for photo vote index: %v", err)
+	}
+
+	voteId, err := ctx.GetStub().GetState(refKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read photo vote index: %v", err)
+	}
+
+	return string(voteId), nil
+}
+
+// PhotoContext is a photo together with its vote and the status of the device under vote;
+// Vote and DeviceKeyStatus are omitted for a photo with no associated vote
+type PhotoContext struct {
+	Photo           *IPFSPhoto   `json:"photo"`
+	Vote            *PhotoVote   `json:"vote,omitempty" metadata:",optional"`
+	DeviceKeyStatus DeviceStatus `json:"deviceKeyStatus,omitempty" metadata:",optional"`
+}
+
+// GetPhotoWithContext returns a photo's metadata with the vote it belongs to and the device key status
+func (dr *DeviceRegistration) GetPhotoWithContext(ctx contractapi.TransactionContextInterface, ipfsHash string) (*PhotoContext, error) {
+	photo, err := dr.GetPhotoMetadata(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PhotoContext{Photo: photo}
+
+	voteId, err := findPhotoVoteId(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+	if voteId == "" {
+		return result, nil
+	}
+
+	result.Vote, err = getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceKey, err := findDeviceKey(ctx, result.Vote.DevicePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if deviceKey != nil {
+		result.DeviceKeyStatus = deviceKey.Status
+	}
+
+	return result, nil
+}
+
+// GetPhotoSigner returns the device key of the vote a photo was submitted to, provided the photo's
+// signature still verifies against it
+func (dr *DeviceRegistration) GetPhotoSigner(ctx contractapi.TransactionContextInterface, ipfsHash string) (*DeviceKey, error) {
+	photo, err := dr.GetPhotoMetadata(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+
+	voteId, err := findPhotoVoteId(ctx, ipfsHash)
+	if err != nil {
+		return nil, err
+	}
+	if voteId == "" {
+		return nil, fmt.Errorf("photo %s is not associated with a vote", ipfsHash)
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceKey, err := findDeviceKey(ctx, vote.DevicePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if deviceKey == nil {
+		return nil, fmt.Errorf("device key %s of vote %s no longer exists", vote.DevicePublicKey, voteId)
+	}
+
+	if photo.SignatureUnverified {
+		return nil, fmt.Errorf("photo %s was accepted under the %s signature mode without a verified signature", ipfsHash, photo.SignatureMode)
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyPhotoSignature(*photo, deviceKey.PublicKey, deviceKey.SignatureEncoding, pssOptions(config)) {
+		return nil, fmt.Errorf("signature of photo %s no longer verifies against device key %s", ipfsHash, deviceKey.PublicKeyHash)
+	}
+
+	return deviceKey, nil
+}
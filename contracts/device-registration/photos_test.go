@@ -0,0 +1,847 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionPhoto re-signs a device photo for an enrollment session
+func (d *testDevice) sessionPhoto(name string, challenge string) IPFSPhoto {
+	photo := d.photo(name)
+	photo.SessionChallenge = challenge
+	return d.signPhoto(photo)
+}
+
+// newSession opens an enrollment session, failing the test on error
+func (e *testEnv) newSession() string {
+	e.t.Helper()
+	session, err := e.dr.CreateEnrollmentSession(e.ctx("uploader", "Org1MSP"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return session.Challenge
+}
+
+func TestExistingPhotoRejectedWithoutReuse(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "shared")
+
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("shared")}, device.publicKey)
+	requireError(t, err)
+}
+
+func TestReusedPhotoRequiresFreshSessionSignature(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"reuseExistingPhotos": true}`)
+	device := newTestDevice(t, 0)
+	first := e.startVote(device, "shared")
+
+	// Replaying the stored photo and its public signature must not open a vote
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("shared")}, device.publicKey)
+	requireError(t, err)
+
+	challenge := e.newSession()
+	vote, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.sessionPhoto("shared", challenge)}, device.publicKey, `{"sessionChallenge": "`+challenge+`"}`)
+	requireNoError(t, err)
+	if vote.VoteId == first.VoteId {
+		t.Fatalf("reused photo vote kept the earlier vote ID %s", vote.VoteId)
+	}
+	if vote.PhotoIPFSHashes[0] != testCID("shared") {
+		t.Fatalf("vote references %v, want the stored photo", vote.PhotoIPFSHashes)
+	}
+}
+
+func TestReusedPhotoRefusedForVerifiedKey(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"reuseExistingPhotos": true}`)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "shared")
+	e.verifyDevice(device.hash)
+	before := e.deviceKey(device.hash)
+
+	challenge := e.newSession()
+	_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.sessionPhoto("shared", challenge)}, device.publicKey, `{"sessionChallenge": "`+challenge+`"}`)
+	requireError(t, err)
+
+	after := e.deviceKey(device.hash)
+	if after.Status != DeviceStatusVerified || after.VerifiedAt != before.VerifiedAt || after.ForceVerifiedBy != before.ForceVerifiedBy {
+		t.Fatalf("device key changed from %+v to %+v", before, after)
+	}
+}
+
+func TestNewVoteKeepsExistingDeviceKeyRecord(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "first")
+	e.verifyDevice(device.hash)
+	before := e.deviceKey(device.hash)
+
+	e.advance(time.Minute)
+	e.startVote(device, "second")
+
+	after := e.deviceKey(device.hash)
+	if after.Status != DeviceStatusVerified || after.VerifiedAt != before.VerifiedAt || after.ForceVerifiedBy != before.ForceVerifiedBy || after.ForceVerifyJustification != before.ForceVerifyJustification {
+		t.Fatalf("device key verification was overwritten: %+v", after)
+	}
+	if after.LastVoteAt == before.LastVoteAt {
+		t.Fatalf("last vote time not updated: %s", after.LastVoteAt)
+	}
+}
+
+// storedPhotoFields decodes the raw stored record of a photo into its JSON keys
+func (e *testEnv) storedPhotoFields(ipfsHash string) map[string]json.RawMessage {
+	e.t.Helper()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(e.getState("Photo", ipfsHash), &fields); err != nil {
+		e.t.Fatal(err)
+	}
+	return fields
+}
+
+func TestCompactStorageAppliesToEveryPhotoWrite(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"photoStorageMode": "COMPACT"}`)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "compact")
+	ipfsHash := vote.PhotoIPFSHashes[0]
+
+	_, err := e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), ipfsHash, "new description")
+	requireError(t, err)
+
+	_, err = e.dr.FlagPhoto(e.admin(), ipfsHash, "tampered")
+	requireNoError(t, err)
+	fields := e.storedPhotoFields(ipfsHash)
+	if _, ok := fields["description"]; ok {
+		t.Fatalf("flagged photo was rewritten as a full record: %v", fields)
+	}
+	if string(fields["status"]) != `"FLAGGED"` {
+		t.Fatalf("flag was not stored: %s", fields["status"])
+	}
+
+	// A bundle imported under the COMPACT mode stores compact photo records too
+	source := newTestEnv(t)
+	imported := source.startVote(newTestDevice(t, 1), "imported")
+	_, err = e.dr.ImportVoteBundle(e.admin(), bundleJSON(t, source.exportBundle(imported.VoteId)))
+	requireNoError(t, err)
+	fields = e.storedPhotoFields(imported.PhotoIPFSHashes[0])
+	if _, ok := fields["description"]; ok {
+		t.Fatalf("imported photo was stored as a full record: %v", fields)
+	}
+}
+
+func TestFullStorageUpdatesPhotoDescription(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVote(newTestDevice(t, 0), "full")
+	ipfsHash := vote.PhotoIPFSHashes[0]
+
+	_, err := e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), ipfsHash, "new description")
+	requireNoError(t, err)
+	if fields := e.storedPhotoFields(ipfsHash); string(fields["description"]) != `"new description"` {
+		t.Fatalf("stored description %s", fields["description"])
+	}
+}
+
+func TestPreflightPhotoVoteWritesNothing(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "registered")
+	before := e.getState("DeviceKey", device.hash)
+
+	forged := device.photo("forged")
+	forged.Signature = newTestDevice(t, 1).sign("forged")
+	report, err := e.dr.PreflightPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("checked"), forged}, device.publicKey)
+	requireNoError(t, err)
+	if report.Valid || !report.Photos[0].Valid || report.Photos[1].Valid {
+		t.Fatalf("unexpected preflight report %+v", report)
+	}
+	if after := e.getState("DeviceKey", device.hash); string(after) != string(before) {
+		t.Fatalf("preflight rewrote the device key:\n%s\n%s", before, after)
+	}
+}
+
+func TestSignatureCountersRecordOpenedVotes(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	forged := device.photo("forged")
+	forged.Signature = newTestDevice(t, 1).sign("forged")
+
+	_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("kept"), forged}, device.publicKey, `{"skipInvalidPhotos": true}`)
+	requireNoError(t, err)
+
+	stats, err := e.dr.GetDeviceSignatureStats(e.admin(), device.hash)
+	requireNoError(t, err)
+	if stats.VerifiedSigCount != 1 || stats.FailedSigCount != 1 {
+		t.Fatalf("signature stats %+v, expected 1 verified and 1 failed", stats)
+	}
+}
+
+// describedPhoto returns a signed photo with the given description
+func (d *testDevice) describedPhoto(name string, description string) IPFSPhoto {
+	photo := d.photo(name)
+	photo.Description = description
+	return d.signPhoto(photo)
+}
+
+func TestDescriptionSanitization(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxDescriptionLength": 16}`)
+	device := newTestDevice(t, 0)
+
+	vote, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.describedPhoto("stripped", "bell\x07 <b>ok</b>"), device.describedPhoto("plain", "front camera")}, device.publicKey)
+	requireNoError(t, err)
+	photo, err := e.dr.GetPhotoMetadata(e.admin(), vote.PhotoIPFSHashes[0])
+	requireNoError(t, err)
+	if photo.Description != "bell <b>ok</b>" {
+		t.Fatalf("stripped description %q", photo.Description)
+	}
+	photo, err = e.dr.GetPhotoMetadata(e.admin(), vote.PhotoIPFSHashes[1])
+	requireNoError(t, err)
+	if photo.Description != "front camera" {
+		t.Fatalf("plain description %q", photo.Description)
+	}
+
+	// The update path applies the same policy
+	_, err = e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), vote.PhotoIPFSHashes[1], "seventeen chars!!")
+	requireError(t, err)
+	updated, err := e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), vote.PhotoIPFSHashes[1], "new\x00 text")
+	requireNoError(t, err)
+	if updated.Description != "new text" {
+		t.Fatalf("updated description %q", updated.Description)
+	}
+
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 1).describedPhoto("overlength", "seventeen chars!!")}, newTestDevice(t, 1).publicKey)
+	requireError(t, err)
+
+	e.setConfig(`{"descriptionPolicy": "REJECT"}`)
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 2).describedPhoto("rejected", "tab\tseparated")}, newTestDevice(t, 2).publicKey)
+	requireError(t, err)
+}
+
+func TestMaxDescriptionBytesCapsStartAndUpdate(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"maxDescriptionBytes": 10}`)
+	device := newTestDevice(t, 0)
+	start := func(photo IPFSPhoto) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		return err
+	}
+
+	// Five two-byte runes sit exactly at the byte cap though well under the rune length limit
+	requireNoError(t, start(device.describedPhoto("at-cap", "ééééé")))
+	over := device.describedPhoto("over-cap", "éééééa")
+	err := start(over)
+	if err == nil || !strings.Contains(err.Error(), over.IPFSHash) || !strings.Contains(err.Error(), "limit of 10 bytes") {
+		t.Fatalf("StartPhotoVote over the byte cap: %v", err)
+	}
+
+	_, err = e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), testCID("at-cap"), "0123456789")
+	requireNoError(t, err)
+	_, err = e.dr.UpdatePhotoDescription(e.ctx("uploader", "Org1MSP"), testCID("at-cap"), "0123456789a")
+	if err == nil || !strings.Contains(err.Error(), testCID("at-cap")) || !strings.Contains(err.Error(), "limit of 10 bytes") {
+		t.Fatalf("UpdatePhotoDescription over the byte cap: %v", err)
+	}
+}
+
+func TestRejectedPhotosCarryReasonCodes(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"requireDescription": true}`)
+	device := newTestDevice(t, 0)
+
+	forged := device.photo("forged")
+	forged.Signature = newTestDevice(t, 1).sign("forged")
+	malformed := device.photo("malformed")
+	malformed.IPFSHash = "not-a-cid"
+	malformed = device.signPhoto(malformed)
+	cases := []struct {
+		photos []IPFSPhoto
+		reason RejectionReason
+	}{
+		{[]IPFSPhoto{forged}, ReasonInvalidSignature},
+		{[]IPFSPhoto{device.photo("twice"), device.photo("twice")}, ReasonDuplicateHash},
+		{[]IPFSPhoto{malformed}, ReasonMalformedHash},
+		{[]IPFSPhoto{device.describedPhoto("undescribed", "")}, ReasonMissingDescription},
+	}
+
+	for _, c := range cases {
+		report, err := e.dr.PreflightPhotoVote(e.ctx("uploader", "Org1MSP"), c.photos, device.publicKey)
+		requireNoError(t, err)
+		last := report.Photos[len(report.Photos)-1]
+		if report.Valid || last.Reason != c.reason {
+			t.Errorf("preflight reason %s, expected %s", last.Reason, c.reason)
+		}
+
+		_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), c.photos, device.publicKey)
+		if err == nil || !strings.HasPrefix(err.Error(), string(c.reason)+": ") {
+			t.Errorf("StartPhotoVote error %v, expected reason %s", err, c.reason)
+		}
+	}
+}
+
+func TestLedgerFailuresCarryNoReasonCode(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"reuseExistingPhotos": true}`)
+	device := newTestDevice(t, 0)
+	corrupt := device.photo("corrupt")
+	e.putState("Photo", []string{corrupt.IPFSHash}, []byte("not json"))
+
+	// An unreadable stored record is the ledger's fault, not the submitter's
+	_, err := e.dr.PreflightPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{corrupt}, device.publicKey)
+	requireError(t, err)
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{corrupt, device.photo("intact")}, device.publicKey, `{"skipInvalidPhotos": true}`)
+	if err == nil || !strings.Contains(err.Error(), "failed to unmarshal existing photo") {
+		t.Fatalf("StartPhotoVote over a corrupt stored photo: %v", err)
+	}
+	for _, reason := range []RejectionReason{ReasonDuplicateHash, ReasonMalformedHash} {
+		if strings.HasPrefix(err.Error(), string(reason)+": ") {
+			t.Fatalf("ledger failure reported as %s: %v", reason, err)
+		}
+	}
+}
+
+func TestMonotonicTimestampCheck(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	burst := func(prefix string, timestamps ...string) []IPFSPhoto {
+		photos := make([]IPFSPhoto, 0, len(timestamps))
+		for i, timestamp := range timestamps {
+			photo := device.photo(prefix + strings.Repeat("-", i+1))
+			photo.TimeStamp = timestamp
+			photos = append(photos, device.signPhoto(photo))
+		}
+		return photos
+	}
+
+	// The check is off by default
+	report, err := e.dr.PreflightPhotoVote(e.ctx("uploader", "Org1MSP"), burst("default", "2025-01-01T00:00:02Z", "2025-01-01T00:00:01Z"), device.publicKey)
+	requireNoError(t, err)
+	if !report.Valid {
+		t.Fatalf("out-of-order set rejected with the check off: %+v", report)
+	}
+
+	e.setConfig(`{"requireMonotonicTimestamps": true}`)
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), burst("backwards", "2025-01-01T00:00:02Z", "2025-01-01T00:00:01Z"), device.publicKey)
+	requireError(t, err)
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), burst("in-order", "2025-01-01T00:00:01Z", "2025-01-01T00:00:01Z", "2025-01-01T01:00:02+01:00", "2025-01-01T00:00:03Z"), device.publicKey)
+	requireNoError(t, err)
+}
+
+// metadataPhoto returns a device photo carrying MIME type and dimensions, signed under the given format
+func (d *testDevice) metadataPhoto(name string, mimeType string, width int, height int, format int) IPFSPhoto {
+	photo := d.photo(name)
+	photo.MimeType = mimeType
+	photo.Width = width
+	photo.Height = height
+	photo.SignatureFormat = format
+	return d.signPhoto(photo)
+}
+
+// cidV1 builds a base32 CIDv1 naming a raw block under the given multihash code and digest length
+func cidV1(name string, code uint64, length int) string {
+	digest := make([]byte, 0, length)
+	for len(digest) < length {
+		hashed := sha256.Sum256(append([]byte(name), byte(len(digest))))
+		digest = append(digest, hashed[:]...)
+	}
+	cid := binary.AppendUvarint(nil, 1)
+	cid = binary.AppendUvarint(cid, 0x55)
+	cid = binary.AppendUvarint(cid, code)
+	cid = binary.AppendUvarint(cid, uint64(length))
+	return "b" + base32CID.EncodeToString(append(cid, digest[:length]...))
+}
+
+func TestValidateIPFSHashDetectsAlgorithm(t *testing.T) {
+	config := defaultConfig()
+	config.AllowedHashAlgorithms = []string{"sha2-256", "blake2b-256"}
+	cases := []struct {
+		hash      string
+		algorithm string
+		valid     bool
+	}{
+		{testCID("v0"), "sha2-256", true},
+		{cidV1("sha2", 0x12, 32), "sha2-256", true},
+		{cidV1("blake2b", 0xb220, 32), "blake2b-256", true},
+		{cidV1("sha3", 0x16, 32), "", false},
+		{cidV1("unknown", 0x99, 32), "", false},
+		{cidV1("short", 0x12, 16), "", false},
+		{"bnot-base32!", "", false},
+	}
+	for _, c := range cases {
+		algorithm, err := validateIPFSHash(c.hash, &config)
+		if (err == nil) != c.valid || algorithm != c.algorithm {
+			t.Errorf("validateIPFSHash(%s) = %q, %v; expected %q, valid %v", c.hash, algorithm, err, c.algorithm, c.valid)
+		}
+	}
+}
+
+func TestPhotoRecordsDetectedHashAlgorithm(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	blake := device.photo("blake")
+	blake.IPFSHash = cidV1("blake", 0xb220, 32)
+	blake = device.signPhoto(blake)
+
+	// The default configuration only allows sha2-256
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{blake}, device.publicKey)
+	requireError(t, err)
+
+	e = newTestEnv(t)
+	e.setConfig(`{"allowedHashAlgorithms": ["sha2-256", "blake2b-256"]}`)
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{blake, device.photo("sha2")}, device.publicKey)
+	requireNoError(t, err)
+	for hash, expected := range map[string]string{blake.IPFSHash: "blake2b-256", testCID("sha2"): "sha2-256"} {
+		stored, err := e.dr.GetPhotoMetadata(e.admin(), hash)
+		requireNoError(t, err)
+		if stored.HashAlgorithm != expected {
+			t.Errorf("photo %s recorded algorithm %q, expected %q", hash, stored.HashAlgorithm, expected)
+		}
+	}
+	requireError(t, e.dr.SetConfig(e.admin(), `{"allowedHashAlgorithms": ["md5"]}`))
+}
+
+func TestPhotoMetadataValidation(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	cases := []struct {
+		photo IPFSPhoto
+		valid bool
+	}{
+		{device.metadataPhoto("jpeg", "image/jpeg", 640, 480, photoSignatureFormatV1), true},
+		{device.metadataPhoto("bare", "", 0, 0, photoSignatureFormatV1), true},
+		{device.metadataPhoto("gif", "image/gif", 640, 480, photoSignatureFormatV1), false},
+		{device.metadataPhoto("negative", "image/png", -1, 480, photoSignatureFormatV1), false},
+		{device.metadataPhoto("width-only", "image/png", 640, 0, photoSignatureFormatV1), false},
+	}
+	for _, c := range cases {
+		report, err := e.dr.PreflightPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{c.photo}, device.publicKey)
+		requireNoError(t, err)
+		if report.Valid != c.valid {
+			t.Errorf("photo %s %dx%d valid = %v, expected %v", c.photo.MimeType, c.photo.Width, c.photo.Height, report.Valid, c.valid)
+		}
+	}
+
+	signed := device.metadataPhoto("signed", "image/webp", 800, 600, photoSignatureFormatV2)
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{signed}, device.publicKey)
+	requireNoError(t, err)
+	stored, err := e.dr.GetPhotoMetadata(e.admin(), signed.IPFSHash)
+	requireNoError(t, err)
+	if stored.MimeType != "image/webp" || stored.Width != 800 || stored.Height != 600 {
+		t.Fatalf("stored photo metadata %s %dx%d", stored.MimeType, stored.Width, stored.Height)
+	}
+
+	// Format 2 signs the metadata, so altering it after signing breaks the signature
+	tampered := device.metadataPhoto("tampered", "image/webp", 800, 600, photoSignatureFormatV2)
+	tampered.Width = 1600
+	_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{tampered}, device.publicKey)
+	if err == nil || !strings.HasPrefix(err.Error(), string(ReasonInvalidSignature)+": ") {
+		t.Fatalf("StartPhotoVote with tampered metadata: %v", err)
+	}
+}
+
+func TestDefaultDescriptionTemplateFillsUnsignedDescriptions(t *testing.T) {
+	device := newTestDevice(t, 0)
+	undescribed := func(name string, format int) IPFSPhoto {
+		photo := device.photo(name)
+		photo.Description = ""
+		photo.SignatureFormat = format
+		return device.signPhoto(photo)
+	}
+	photos := []IPFSPhoto{device.photo("described"), undescribed("unsigned", photoSignatureFormatV1), undescribed("signed", photoSignatureFormatV2)}
+	stored := func(e *testEnv, name string) string {
+		t.Helper()
+		photo, err := e.dr.GetPhotoMetadata(e.admin(), testCID(name))
+		requireNoError(t, err)
+		return photo.Description
+	}
+
+	e := newTestEnv(t)
+	e.setConfig(`{"defaultDescriptionTemplate": "Enrollment photo {n} for {uploader} at {timestamp}"}`)
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), photos, device.publicKey)
+	requireNoError(t, err)
+	if got := stored(e, "unsigned"); got != "Enrollment photo 2 for uploader at 2025-01-01T00:00:00Z" {
+		t.Fatalf("generated description %q", got)
+	}
+	if got := stored(e, "described"); got != "photo described" {
+		t.Fatalf("supplied description replaced with %q", got)
+	}
+	// Format 2 signs the description, so filling it in would break the signature
+	if got := stored(e, "signed"); got != "" {
+		t.Fatalf("signed empty description replaced with %q", got)
+	}
+
+	disabled := newTestEnv(t)
+	_, err = disabled.dr.StartPhotoVote(disabled.ctx("uploader", "Org1MSP"), photos, device.publicKey)
+	requireNoError(t, err)
+	if got := stored(disabled, "unsigned"); got != "" {
+		t.Fatalf("description generated without a template: %q", got)
+	}
+}
+
+func TestSignatureFormat2CoversDescription(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	start := func(photo IPFSPhoto) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		return err
+	}
+
+	// Format 1 leaves the description unsigned, so the default configuration accepts a rewritten one
+	unsigned := device.photo("format-1")
+	unsigned.Description = "rewritten"
+	requireNoError(t, start(unsigned))
+
+	signed := device.metadataPhoto("format-2", "image/png", 0, 0, photoSignatureFormatV2)
+	tampered := signed
+	tampered.Description = "rewritten"
+	requireError(t, start(tampered))
+	requireNoError(t, start(signed))
+
+	e.setConfig(`{"minSignatureFormat": 2}`)
+	requireError(t, start(device.photo("below-minimum")))
+}
+
+func TestGetPhotoWithContext(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "in-vote")
+
+	full, err := e.dr.GetPhotoWithContext(e.admin(), testCID("in-vote"))
+	requireNoError(t, err)
+	if full.Photo.IPFSHash != testCID("in-vote") || full.Vote == nil || full.Vote.VoteId != vote.VoteId || full.DeviceKeyStatus != e.deviceKey(device.hash).Status {
+		t.Fatalf("photo context %+v", full)
+	}
+
+	orphan := device.photo("orphan")
+	e.putState("Photo", []string{orphan.IPFSHash}, orphan)
+	context, err := e.dr.GetPhotoWithContext(e.admin(), orphan.IPFSHash)
+	requireNoError(t, err)
+	if context.Photo.IPFSHash != orphan.IPFSHash || context.Vote != nil || context.DeviceKeyStatus != "" {
+		t.Fatalf("orphan photo context %+v", context)
+	}
+
+	_, err = e.dr.GetPhotoWithContext(e.admin(), testCID("absent"))
+	requireError(t, err)
+}
+
+func TestGetPhotoSignerConfirmsSignature(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	e.startVote(device, "attributed", "tampered")
+
+	signer, err := e.dr.GetPhotoSigner(e.ctx("user", "Org2MSP"), testCID("attributed"))
+	requireNoError(t, err)
+	if signer.PublicKeyHash != device.hash || signer.PublicKey != device.publicKey {
+		t.Fatalf("photo attributed to %s, want %s", signer.PublicKeyHash, device.hash)
+	}
+
+	stored, err := e.dr.GetPhotoMetadata(e.admin(), testCID("tampered"))
+	requireNoError(t, err)
+	stored.TimeStamp = "2025-01-02T00:00:00Z"
+	e.putState("Photo", []string{stored.IPFSHash}, stored)
+	_, err = e.dr.GetPhotoSigner(e.ctx("user", "Org2MSP"), stored.IPFSHash)
+	if err == nil || !strings.Contains(err.Error(), "no longer verifies") {
+		t.Fatalf("GetPhotoSigner for a tampered photo: %v", err)
+	}
+
+	orphan := device.photo("unattributed")
+	e.putState("Photo", []string{orphan.IPFSHash}, orphan)
+	_, err = e.dr.GetPhotoSigner(e.ctx("user", "Org2MSP"), orphan.IPFSHash)
+	requireError(t, err)
+}
+
+func TestUppercaseSignaturesStoredLowercase(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	photo := device.photo("uppercase")
+	photo.Signature = strings.ToUpper(photo.Signature)
+	vote, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+	requireNoError(t, err)
+
+	stored, err := e.dr.GetPhotoMetadata(e.admin(), photo.IPFSHash)
+	requireNoError(t, err)
+	if stored.Signature != strings.ToLower(photo.Signature) {
+		t.Fatalf("stored signature %s", stored.Signature)
+	}
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("vote over the normalized signature finalized as %s", got)
+	}
+
+	signature := strings.ToUpper(device.sign("helper"))
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "helper", device.hash, signature, "uppercase", 0))
+	record, err := e.dr.GetHelperData(e.ctx("uploader", "Org1MSP"), "uppercase")
+	requireNoError(t, err)
+	if record.Signature != strings.ToLower(signature) {
+		t.Fatalf("stored helper data signature %s", record.Signature)
+	}
+}
+
+func TestGetPhotoSigningPayloadIsWhatVerificationChecks(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	for _, format := range []int{0, photoSignatureFormatV1, photoSignatureFormatV2} {
+		photo := device.photo(fmt.Sprintf("payload-%d", format))
+		photo.SignatureFormat = format
+		photo.MimeType = "image/jpeg"
+		payload, err := e.dr.GetPhotoSigningPayload(e.ctx("uploader", "Org1MSP"), photo)
+		requireNoError(t, err)
+		photo.Signature = device.sign(payload)
+		_, err = e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		if err != nil {
+			t.Fatalf("photo signed over the format %d payload: %v", format, err)
+		}
+	}
+
+	photo := device.photo("unknown-format")
+	photo.SignatureFormat = 3
+	_, err := e.dr.GetPhotoSigningPayload(e.ctx("uploader", "Org1MSP"), photo)
+	requireError(t, err)
+	e.setConfig(`{"minSignatureFormat": 2}`)
+	_, err = e.dr.GetPhotoSigningPayload(e.ctx("uploader", "Org1MSP"), device.photo("below-minimum"))
+	requireError(t, err)
+}
+
+func TestFlaggingPhotosUnverifiesDeviceAtThreshold(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	vote := e.startVote(device, "flag-1", "flag-2", "flag-3", "flag-4")
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := e.deviceKey(device.hash).Status; got != DeviceStatusVerified {
+		t.Fatalf("device status after approval %s", got)
+	}
+
+	_, err := e.dr.FlagPhoto(e.ctx("user", "Org2MSP"), testCID("flag-1"), "fraudulent")
+	requireError(t, err)
+	flagged, err := e.dr.FlagPhoto(e.admin(), testCID("flag-1"), "fraudulent")
+	requireNoError(t, err)
+	if flagged.Status != "FLAGGED" {
+		t.Fatalf("flagged photo status %q", flagged.Status)
+	}
+	_, err = e.dr.FlagPhoto(e.admin(), testCID("flag-1"), "again")
+	requireError(t, err)
+	if got := e.deviceKey(device.hash).Status; got != DeviceStatusVerified {
+		t.Fatalf("device status with one of four photos flagged %s", got)
+	}
+
+	_, err = e.dr.FlagPhoto(e.admin(), testCID("flag-2"), "fraudulent")
+	requireNoError(t, err)
+	if got := e.deviceKey(device.hash).Status; got != DeviceStatusUnverified {
+		t.Fatalf("device status with half of the photos flagged %s", got)
+	}
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusApproved {
+		t.Fatalf("flagging photos changed the vote status to %s", got)
+	}
+}
+
+// operatorPhoto returns a device photo vouched for by an operator key
+func (d *testDevice) operatorPhoto(name string, operator *testDevice) IPFSPhoto {
+	photo := d.photo(name)
+	photo.OperatorPublicKey = operator.publicKey
+	photo.OperatorSignature = operator.sign(operatorSigningPayload(photo))
+	return photo
+}
+
+func TestOperatorSignatureVerifiedSeparately(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	operator := newTestDevice(t, 1)
+	start := func(photo IPFSPhoto) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		return err
+	}
+
+	requireNoError(t, start(device.operatorPhoto("vouched", operator)))
+
+	forged := device.operatorPhoto("forged-operator", operator)
+	forged.OperatorSignature = newTestDevice(t, 2).sign(operatorSigningPayload(forged))
+	err := start(forged)
+	if err == nil || !strings.Contains(err.Error(), "invalid operator signature") {
+		t.Fatalf("StartPhotoVote with a bad operator signature: %v", err)
+	}
+
+	unsigned := device.operatorPhoto("unsigned-operator", operator)
+	unsigned.OperatorSignature = ""
+	requireError(t, start(unsigned))
+}
+
+func TestSkipInvalidPhotosOpensVoteWithRemainder(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	forged := device.photo("skip-forged")
+	forged.Signature = newTestDevice(t, 1).sign("forged")
+	malformed := device.photo("skip-malformed")
+	malformed.IPFSHash = "not-a-cid"
+	malformed = device.signPhoto(malformed)
+	photos := []IPFSPhoto{forged, device.photo("skip-good-1"), malformed, device.photo("skip-good-2")}
+	start := func(optionsJSON string) (*PhotoVote, error) {
+		return e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), photos, device.publicKey, optionsJSON)
+	}
+
+	_, err := start(`{}`)
+	requireError(t, err)
+	_, err = start(`{"skipInvalidPhotos": true, "minPhotoCount": 3}`)
+	requireError(t, err)
+
+	vote, err := start(`{"skipInvalidPhotos": true, "minPhotoCount": 2}`)
+	requireNoError(t, err)
+	if !slices.Equal(vote.PhotoIPFSHashes, []string{testCID("skip-good-1"), testCID("skip-good-2")}) || vote.VoteId != voteIdPrefix+testCID("skip-good-1") {
+		t.Fatalf("vote over the valid photos: %s with %v", vote.VoteId, vote.PhotoIPFSHashes)
+	}
+	if len(vote.SkippedPhotos) != 2 || vote.SkippedPhotos[0].Reason != ReasonInvalidSignature || vote.SkippedPhotos[1].Reason != ReasonMalformedHash {
+		t.Fatalf("skipped photos %+v", vote.SkippedPhotos)
+	}
+	if e.getState("Photo", forged.IPFSHash) != nil {
+		t.Fatal("a skipped photo was stored")
+	}
+}
+
+func TestGetAllVotesForPhotoKeepsEveryReference(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"reuseExistingPhotos": true}`)
+	device := newTestDevice(t, 0)
+	votes := []*PhotoVote{e.startVote(device, "referenced")}
+	for range 2 {
+		e.advance(time.Minute)
+		challenge := e.newSession()
+		vote, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.sessionPhoto("referenced", challenge)}, device.publicKey, `{"sessionChallenge": "`+challenge+`"}`)
+		requireNoError(t, err)
+		votes = append(votes, vote)
+	}
+
+	all, err := e.dr.GetAllVotesForPhoto(e.admin(), testCID("referenced"))
+	requireNoError(t, err)
+	if !slices.Equal(voteIds(all), voteIds(votes)) {
+		t.Fatalf("votes referencing the photo %v, expected %v", voteIds(all), voteIds(votes))
+	}
+	current, err := e.dr.GetPhotoWithContext(e.admin(), testCID("referenced"))
+	requireNoError(t, err)
+	if current.Vote.VoteId != votes[2].VoteId {
+		t.Fatalf("current vote %s, expected the latest reference", current.Vote.VoteId)
+	}
+
+	unreferenced, err := e.dr.GetAllVotesForPhoto(e.admin(), testCID("unreferenced"))
+	requireNoError(t, err)
+	if len(unreferenced) != 0 {
+		t.Fatalf("votes for an unknown photo %v", voteIds(unreferenced))
+	}
+}
+
+func TestSignatureModesRecordHowPhotosWereChecked(t *testing.T) {
+	cases := []struct {
+		mode             string
+		forgedAccepted   bool
+		validUnverified  bool
+		forgedUnverified bool
+	}{
+		{"STRICT", false, false, false},
+		{"WARN", true, false, true},
+		{"OFF", true, true, true},
+	}
+	for _, c := range cases {
+		e := newTestEnv(t)
+		e.setConfig(`{"signatureMode": "` + c.mode + `"}`)
+		device := newTestDevice(t, 0)
+		forged := device.photo("mode-forged")
+		forged.Signature = newTestDevice(t, 1).sign("forged")
+		start := func(photo IPFSPhoto) error {
+			_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+			return err
+		}
+
+		requireNoError(t, start(device.photo("mode-valid")))
+		stored, err := e.dr.GetPhotoMetadata(e.admin(), testCID("mode-valid"))
+		requireNoError(t, err)
+		if stored.SignatureMode != c.mode || stored.SignatureUnverified != c.validUnverified {
+			t.Errorf("%s: valid photo stored with mode %q, unverified %v", c.mode, stored.SignatureMode, stored.SignatureUnverified)
+		}
+
+		err = start(forged)
+		if (err == nil) != c.forgedAccepted {
+			t.Errorf("%s: forged photo error %v", c.mode, err)
+			continue
+		}
+		if c.forgedAccepted {
+			stored, err := e.dr.GetPhotoMetadata(e.admin(), forged.IPFSHash)
+			requireNoError(t, err)
+			if stored.SignatureMode != c.mode || stored.SignatureUnverified != c.forgedUnverified {
+				t.Errorf("%s: forged photo stored with mode %q, unverified %v", c.mode, stored.SignatureMode, stored.SignatureUnverified)
+			}
+		}
+	}
+}
+
+func TestGetPhotosAwaitingVoteSkipsFinalizedVotes(t *testing.T) {
+	e := newTestEnv(t)
+	pending := e.startVote(newTestDevice(t, 0), "awaiting-1", "awaiting-2")
+	finalized := e.startVote(newTestDevice(t, 1), "finalized")
+	e.cast(finalized.VoteId, "voter-1", true)
+
+	photos, err := e.dr.GetPhotosAwaitingVote(e.admin())
+	requireNoError(t, err)
+	hashes := make([]string, 0, len(photos))
+	for _, photo := range photos {
+		hashes = append(hashes, photo.IPFSHash)
+	}
+	if !slices.Equal(hashes, pending.PhotoIPFSHashes) {
+		t.Fatalf("photos awaiting a vote %v, expected %v", hashes, pending.PhotoIPFSHashes)
+	}
+}
+
+func TestThumbnailHashValidatedAndSignedUnderFormat2(t *testing.T) {
+	e := newTestEnv(t)
+	device := newTestDevice(t, 0)
+	thumbnailPhoto := func(name string, thumbnail string) IPFSPhoto {
+		photo := device.photo(name)
+		photo.SignatureFormat = photoSignatureFormatV2
+		photo.ThumbnailIPFSHash = thumbnail
+		return device.signPhoto(photo)
+	}
+	start := func(photo IPFSPhoto) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{photo}, device.publicKey)
+		return err
+	}
+
+	requireNoError(t, start(thumbnailPhoto("with-thumbnail", testCID("thumbnail"))))
+	stored, err := e.dr.GetPhotoMetadata(e.admin(), testCID("with-thumbnail"))
+	requireNoError(t, err)
+	if stored.ThumbnailIPFSHash != testCID("thumbnail") {
+		t.Fatalf("stored thumbnail hash %q", stored.ThumbnailIPFSHash)
+	}
+
+	err = start(thumbnailPhoto("malformed-thumbnail", "not-a-cid"))
+	if err == nil || !strings.Contains(err.Error(), "malformed thumbnail") {
+		t.Fatalf("StartPhotoVote with a malformed thumbnail hash: %v", err)
+	}
+	requireError(t, start(thumbnailPhoto("self-thumbnail", testCID("self-thumbnail"))))
+
+	swapped := thumbnailPhoto("swapped-thumbnail", testCID("thumbnail-a"))
+	swapped.ThumbnailIPFSHash = testCID("thumbnail-b")
+	requireError(t, start(swapped))
+}
+
+func TestMinDistinctUploaders(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"minDistinctUploaders": 2}`)
+	device := newTestDevice(t, 0)
+	uploadedBy := func(name string, uploader string) IPFSPhoto {
+		photo := device.photo(name)
+		photo.UploadedBy = uploader
+		return device.signPhoto(photo)
+	}
+	start := func(photos ...IPFSPhoto) error {
+		_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), photos, device.publicKey)
+		return err
+	}
+
+	err := start(uploadedBy("single-1", "operator-1"), uploadedBy("single-2", "operator-1"))
+	if err == nil || !strings.Contains(err.Error(), "1 distinct uploaders, at least 2 required") {
+		t.Fatalf("StartPhotoVote with one uploader: %v", err)
+	}
+	requireNoError(t, start(uploadedBy("distinct-1", "operator-1"), uploadedBy("distinct-2", "operator-2")))
+}
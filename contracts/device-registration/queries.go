@@ -0,0 +1,658 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// collectVotes drains a state iterator into a slice of votes
+func collectVotes(iterator shim.StateQueryIteratorInterface) ([]*PhotoVote, error) {
+	defer iterator.Close()
+
+	votes := make([]*PhotoVote, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate votes: %v", err)
+		}
+
+		var vote PhotoVote
+		err = json.Unmarshal(entry.Value, &vote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vote %s: %v", entry.Key, err)
+		}
+		votes = append(votes, &vote)
+	}
+
+	return votes, nil
+}
+
+// getAllVotes scans the PhotoVote namespace and returns every stored vote
+func getAllVotes(ctx contractapi.TransactionContextInterface) ([]*PhotoVote, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("PhotoVote", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read votes from world state: %v", err)
+	}
+
+	return collectVotes(iterator)
+}
+
+// GetVotesByDateRange returns all votes created between start and end (inclusive, RFC3339)
+func (dr *DeviceRegistration) GetVotesByDateRange(ctx contractapi.TransactionContextInterface, startRFC3339 string, endRFC3339 string) ([]*PhotoVote, error) {
+	start, err := time.Parse(time.RFC3339, startRFC3339)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start date %s: %v", startRFC3339, err)
+	}
+	end, err := time.Parse(time.RFC3339, endRFC3339)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end date %s: %v", endRFC3339, err)
+	}
+	if start.After(end) {
+		return nil, fmt.Errorf("start date %s is after end date %s", startRFC3339, endRFC3339)
+	}
+
+	// CreatedAt is stored as second-precision UTC RFC3339, so bounds are rounded inwards to whole
+	// seconds; both query paths then compare against the same bounds
+	start = start.UTC()
+	if truncated := start.Truncate(time.Second); !truncated.Equal(start) {
+		start = truncated.Add(time.Second)
+	}
+	end = end.UTC().Truncate(time.Second)
+	startKey := start.Format(time.RFC3339)
+	endKey := end.Format(time.RFC3339)
+
+	// Prefer a rich query when the peer uses CouchDB
+	query := fmt.Sprintf(`{"selector":{"voteId":{"$exists":true},"createdAt":{"$gte":%q,"$lte":%q}}}`, startKey, endKey)
+	iterator, err := ctx.GetStub().GetQueryResult(query)
+	if err == nil {
+		return collectVotes(iterator)
+	}
+
+	// Fall back to a full scan on LevelDB
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]*PhotoVote, 0)
+	for _, vote := range votes {
+		if vote.CreatedAt == "" {
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339, vote.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("vote %s has invalid creation date: %v", vote.VoteId, err)
+		}
+		if !createdAt.Before(start) && !createdAt.After(end) {
+			matching = append(matching, vote)
+		}
+	}
+
+	return matching, nil
+}
+
+// GetVotesByConsensusRule returns all votes evaluated under the given consensus rule
+func (dr *DeviceRegistration) GetVotesByConsensusRule(ctx contractapi.TransactionContextInterface, rule string) ([]*PhotoVote, error) {
+	if err := validateConsensusRule(ConsensusRule(rule)); err != nil {
+		return nil, err
+	}
+
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]*PhotoVote, 0)
+	for _, vote := range votes {
+		if voteConsensusRule(vote) == ConsensusRule(rule) {
+			matching = append(matching, vote)
+		}
+	}
+
+	return matching, nil
+}
+
+// getVotesByStatus reads the votes in a status through the status index, ordered by vote ID
+func getVotesByStatus(ctx contractapi.TransactionContextInterface, status VoteStatus) ([]*PhotoVote, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("VoteByStatus", []string{string(status)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vote status index: %v", err)
+	}
+	defer iterator.Close()
+
+	votes := make([]*PhotoVote, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate vote status index: %v", err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split vote status index key: %v", err)
+		}
+
+		vote, err := getVote(ctx, attributes[1])
+		if err != nil {
+			return nil, err
+		}
+		votes = append(votes, vote)
+	}
+
+	return votes, nil
+}
+
+// GetVotesByStatus returns all votes currently in the given status
+func (dr *DeviceRegistration) GetVotesByStatus(ctx contractapi.TransactionContextInterface, status string) ([]*PhotoVote, error) {
+	if err := validateVoteStatus(VoteStatus(status)); err != nil {
+		return nil, err
+	}
+	return getVotesByStatus(ctx, VoteStatus(status))
+}
+
+// RebuildVoteStatusIndex indexes every stored vote under its current status, for votes created
+// before the index existed (admin only); it returns the number of votes indexed
+func (dr *DeviceRegistration) RebuildVoteStatusIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, vote := range votes {
+		indexKey, err := ctx.GetStub().CreateCompositeKey("VoteByStatus", []string{string(vote.Status), vote.VoteId})
+		if err != nil {
+			return 0, fmt.Errorf("failed to create composite key for vote status index: %v", err)
+		}
+		err = ctx.GetStub().PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return 0, fmt.Errorf("failed to store vote status index entry: %v", err)
+		}
+	}
+
+	return len(votes), nil
+}
+
+// pendingVotesForVoter returns pending votes the voter is eligible for and has not voted on yet
+func pendingVotesForVoter(ctx contractapi.TransactionContextInterface, voterID string) ([]*PhotoVote, error) {
+	votes, err := getVotesByStatus(ctx, VoteStatusPending)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*PhotoVote, 0)
+	for _, vote := range votes {
+		if !slices.Contains(vote.Voters, voterID) && isEligibleVoter(vote, voterID) {
+			pending = append(pending, vote)
+		}
+	}
+
+	return pending, nil
+}
+
+// GetPendingVotesForVoter returns pending votes the caller is eligible for and has not voted on yet
+func (dr *DeviceRegistration) GetPendingVotesForVoter(ctx contractapi.TransactionContextInterface) ([]*PhotoVote, error) {
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	return pendingVotesForVoter(ctx, voterID)
+}
+
+// GetMyPendingReviewCount returns how many pending votes the caller is eligible for and has not voted on yet
+func (dr *DeviceRegistration) GetMyPendingReviewCount(ctx contractapi.TransactionContextInterface) (int, error) {
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	pending, err := pendingVotesForVoter(ctx, voterID)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(pending), nil
+}
+
+// ReviewAssignment is the next vote a voter should review; Vote is omitted when HasWork is false
+type ReviewAssignment struct {
+	HasWork bool       `json:"hasWork"`
+	Vote    *PhotoVote `json:"vote,omitempty" metadata:",optional"`
+}
+
+// GetNextVoteToReview returns the oldest pending vote the caller is eligible for and has not voted on yet
+func (dr *DeviceRegistration) GetNextVoteToReview(ctx contractapi.TransactionContextInterface) (*ReviewAssignment, error) {
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	pending, err := pendingVotesForVoter(ctx, voterID)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return &ReviewAssignment{HasWork: false}, nil
+	}
+
+	// CreatedAt is second-precision RFC3339, so ties are broken by vote ID to keep the order deterministic
+	oldest := slices.MinFunc(pending, func(a, b *PhotoVote) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), cmp.Compare(a.VoteId, b.VoteId))
+	})
+
+	return &ReviewAssignment{HasWork: true, Vote: oldest}, nil
+}
+
+// VoteEligibility reports whether the caller may vote; Reason explains why not and is empty when eligible
+type VoteEligibility struct {
+	Eligible     bool   `json:"eligible"`
+	AlreadyVoted bool   `json:"alreadyVoted"`
+	Reason       string `json:"reason,omitempty" metadata:",optional"`
+}
+
+// CanVote reports whether the caller may cast a ballot on a vote, following the checks CastVote applies
+func (dr *DeviceRegistration) CanVote(ctx contractapi.TransactionContextInterface, voteId string) (*VoteEligibility, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	voterID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	pausedErr := requireVotingOpen(config)
+	eligibility := &VoteEligibility{AlreadyVoted: slices.Contains(vote.Voters, voterID)}
+	switch {
+	case vote.Status != VoteStatusPending:
+		eligibility.Reason = fmt.Sprintf("voting for this photo set has ended with status %s", vote.Status)
+	case pausedErr != nil:
+		eligibility.Reason = pausedErr.Error()
+	case eligibility.AlreadyVoted:
+		eligibility.Reason = "voter has already cast a vote"
+	case vote.Delegations[voterID] != "":
+		eligibility.Reason = fmt.Sprintf("vote has been delegated to %s", vote.Delegations[voterID])
+	case !isEligibleVoter(vote, voterID):
+		eligibility.Reason = fmt.Sprintf("voter is not eligible to vote on %s", voteId)
+	default:
+		if err := checkTallyCapacity(vote, 1, config); err != nil {
+			eligibility.Reason = err.Error()
+		}
+	}
+	if eligibility.Reason == "" && config.BlockDeviceSelfVote {
+		if err := rejectDeviceSelfVote(ctx, vote); err != nil {
+			eligibility.Reason = err.Error()
+		}
+	}
+	eligibility.Eligible = eligibility.Reason == ""
+
+	return eligibility, nil
+}
+
+// getAllDeviceKeys scans the DeviceKey namespace and returns every stored device key
+func getAllDeviceKeys(ctx contractapi.TransactionContextInterface) ([]*DeviceKey, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("DeviceKey", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device keys from world state: %v", err)
+	}
+	defer iterator.Close()
+
+	deviceKeys := make([]*DeviceKey, 0)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate device keys: %v", err)
+		}
+
+		var deviceKey DeviceKey
+		err = json.Unmarshal(entry.Value, &deviceKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal device key %s: %v", entry.Key, err)
+		}
+		deviceKeys = append(deviceKeys, &deviceKey)
+	}
+
+	return deviceKeys, nil
+}
+
+// deviceKeyStatusCounts scans the device keys and counts them by status
+func deviceKeyStatusCounts(ctx contractapi.TransactionContextInterface) (map[string]int, error) {
+	deviceKeys, err := getAllDeviceKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{
+		string(DeviceStatusUnverified): 0,
+		string(DeviceStatusVerified):   0,
+		string(DeviceStatusRevoked):    0,
+		string(DeviceStatusRotated):    0,
+	}
+	for _, deviceKey := range deviceKeys {
+		counts[string(deviceKey.Status)]++
+	}
+
+	return counts, nil
+}
+
+// GetDeviceKeyStatusCounts returns the number of device keys in each status
+func (dr *DeviceRegistration) GetDeviceKeyStatusCounts(ctx contractapi.TransactionContextInterface) (map[string]int, error) {
+	return deviceKeyStatusCounts(ctx)
+}
+
+// countRecords counts the entries stored under a composite key object type without decoding them
+func countRecords(ctx contractapi.TransactionContextInterface, objectType string) (int, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s records from world state: %v", objectType, err)
+	}
+	defer iterator.Close()
+
+	count := 0
+	for iterator.HasNext() {
+		if _, err := iterator.Next(); err != nil {
+			return 0, fmt.Errorf("failed to iterate %s records: %v", objectType, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// ContractMetrics aggregates record counts across the contract's namespaces
+type ContractMetrics struct {
+	TotalVotes            int            `json:"totalVotes"`
+	VoteStatusCounts      map[string]int `json:"voteStatusCounts"`
+	TotalPhotos           int            `json:"totalPhotos"`
+	TotalDeviceKeys       int            `json:"totalDeviceKeys"`
+	DeviceKeyStatusCounts map[string]int `json:"deviceKeyStatusCounts"`
+	TotalHelperData       int            `json:"totalHelperData"`
+}
+
+// GetContractMetrics returns record counts for an operations dashboard. It scans the vote, photo,
+// device key and helper data namespaces in full, so its cost grows with the size of the world state;
+// it is meant to be evaluated as a query rather than submitted, and may exceed the peer's query
+// limits on large ledgers.
+func (dr *DeviceRegistration) GetContractMetrics(ctx contractapi.TransactionContextInterface) (*ContractMetrics, error) {
+	votes, err := getAllVotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := &ContractMetrics{
+		TotalVotes: len(votes),
+		VoteStatusCounts: map[string]int{
+			string(VoteStatusPending):  0,
+			string(VoteStatusReady):    0,
+			string(VoteStatusApproved): 0,
+			string(VoteStatusRejected): 0,
+			string(VoteStatusFlagged):  0,
+		},
+	}
+	for _, vote := range votes {
+		metrics.VoteStatusCounts[string(vote.Status)]++
+	}
+
+	metrics.TotalPhotos, err = countRecords(ctx, "Photo")
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.DeviceKeyStatusCounts, err = deviceKeyStatusCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, count := range metrics.DeviceKeyStatusCounts {
+		metrics.TotalDeviceKeys += count
+	}
+
+	metrics.TotalHelperData, err = countRecords(ctx, "HelperData")
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// VoteLookup is the result of reading one vote in a batch; Vote is omitted when Error is set
+type VoteLookup struct {
+	VoteId string     `json:"voteId"`
+	Vote   *PhotoVote `json:"vote,omitempty" metadata:",optional"`
+	Error  string     `json:"error"`
+}
+
+// GetVotesByIDs reads several votes at once, returning results in request order with per-vote errors
+func (dr *DeviceRegistration) GetVotesByIDs(ctx contractapi.TransactionContextInterface, voteIds []string) ([]*VoteLookup, error) {
+	results := make([]*VoteLookup, 0, len(voteIds))
+	for _, voteId := range voteIds {
+		result := &VoteLookup{VoteId: voteId}
+
+		vote, err := getVote(ctx, voteId)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Vote = vote
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// VoterPage is one page of a vote's voter list
+type VoterPage struct {
+	VoteId string   `json:"voteId"`
+	Voters []string `json:"voters"`
+	Offset int      `json:"offset"`
+	Total  int      `json:"total"` // Number of voters on the whole vote
+}
+
+// GetVoteVoters returns up to pageSize voters of a vote starting at offset, in casting order
+func (dr *DeviceRegistration) GetVoteVoters(ctx contractapi.TransactionContextInterface, voteId string, pageSize int, offset int) (*VoterPage, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive")
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset cannot be negative")
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	start := min(offset, len(vote.Voters))
+	end := min(start+pageSize, len(vote.Voters))
+
+	voters := make([]string, 0, end-start)
+	voters = append(voters, vote.Voters[start:end]...)
+
+	return &VoterPage{
+		VoteId: voteId,
+		Voters: voters,
+		Offset: offset,
+		Total:  len(vote.Voters),
+	}, nil
+}
+
+// remainingEligibleVoters counts the eligible voters who can still cast a ballot on a vote: not the
+// device's own identity while self-votes are blocked, and once reveals open only unrevealed committers
+func remainingEligibleVoters(ctx contractapi.TransactionContextInterface, vote *PhotoVote, config *ContractConfig, txTime time.Time) (int, error) {
+	// The device's identity is known when it presented a certificate chain, whose leaf it enrolls with
+	deviceVoterID := ""
+	if config.BlockDeviceSelfVote {
+		deviceKey, err := findDeviceKey(ctx, vote.DevicePublicKey)
+		if err != nil {
+			return 0, err
+		}
+		if deviceKey != nil && len(deviceKey.CertificateChain) > 0 {
+			deviceVoterID, err = certificateClientID(deviceKey.CertificateChain[0])
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	revealOpen := false
+	if vote.CommitReveal {
+		revealOpensAt, err := time.Parse(time.RFC3339, vote.RevealOpensAt)
+		if err != nil {
+			return 0, fmt.Errorf("vote %s has invalid reveal time: %v", vote.VoteId, err)
+		}
+		revealOpen = !txTime.Before(revealOpensAt)
+	}
+
+	remaining := 0
+	for _, voter := range vote.EligibleVoters {
+		if slices.Contains(vote.Voters, voter) || voter == deviceVoterID {
+			continue
+		}
+		if _, committed := vote.Commitments[voter]; revealOpen && !committed {
+			continue
+		}
+		remaining++
+	}
+
+	return remaining, nil
+}
+
+// GetStuckVotes returns pending votes that can no longer reach quorum because too few eligible
+// voters remain; votes open to anyone are never considered stuck
+func (dr *DeviceRegistration) GetStuckVotes(ctx contractapi.TransactionContextInterface) ([]*PhotoVote, error) {
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	votes, err := getVotesByStatus(ctx, VoteStatusPending)
+	if err != nil {
+		return nil, err
+	}
+
+	stuck := make([]*PhotoVote, 0)
+	for _, vote := range votes {
+		if len(vote.EligibleVoters) == 0 {
+			continue
+		}
+
+		thresholds, err := effectiveThresholds(ctx, vote)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining, err := remainingEligibleVoters(ctx, vote, config, txTime)
+		if err != nil {
+			return nil, err
+		}
+		if vote.VoteCount+remaining < thresholds.MinVoters || vote.ValidVotes+remaining < vote.MinValidVotes {
+			stuck = append(stuck, vote)
+		}
+	}
+
+	return stuck, nil
+}
+
+// VoteFieldChange is one top-level vote field that differs between two versions, as JSON values;
+// a field absent from a version is reported as an empty string
+type VoteFieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// VoteDiff lists the fields that changed between the versions of a vote written by two transactions
+type VoteDiff struct {
+	VoteId  string            `json:"voteId"`
+	FromTx  string            `json:"fromTx"`
+	ToTx    string            `json:"toTx"`
+	Changes []VoteFieldChange `json:"changes"`
+}
+
+// GetVoteDiff compares the versions of a vote written by two transactions field by field, using the key history
+func (dr *DeviceRegistration) GetVoteDiff(ctx contractapi.TransactionContextInterface, voteId string, txId1 string, txId2 string) (*VoteDiff, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	voteKey, err := ctx.GetStub().CreateCompositeKey("PhotoVote", []string{vote.VoteId})
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetHistoryForKey(voteKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history of vote %s: %v", vote.VoteId, err)
+	}
+	defer iterator.Close()
+
+	versions := make(map[string][]byte)
+	for iterator.HasNext() {
+		modification, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate history of vote %s: %v", vote.VoteId, err)
+		}
+		if modification.GetTxId() == txId1 || modification.GetTxId() == txId2 {
+			versions[modification.GetTxId()] = modification.GetValue()
+		}
+	}
+
+	fields := make([]map[string]json.RawMessage, 2)
+	for i, txId := range []string{txId1, txId2} {
+		value, ok := versions[txId]
+		if !ok {
+			return nil, fmt.Errorf("transaction %s did not write vote %s", txId, vote.VoteId)
+		}
+		fields[i] = make(map[string]json.RawMessage)
+		// A deletion leaves an empty value, which compares as a vote without fields
+		if len(value) > 0 {
+			err = json.Unmarshal(value, &fields[i])
+			if err != nil {
+				return nil, fmt.Errorf("failed to unmarshal vote %s at transaction %s: %v", vote.VoteId, txId, err)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, version := range fields {
+		for name := range version {
+			names[name] = true
+		}
+	}
+
+	diff := &VoteDiff{
+		VoteId:  vote.VoteId,
+		FromTx:  txId1,
+		ToTx:    txId2,
+		Changes: make([]VoteFieldChange, 0),
+	}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		before, after := string(fields[0][name]), string(fields[1][name])
+		if before != after {
+			diff.Changes = append(diff.Changes, VoteFieldChange{Field: name, Before: before, After: after})
+		}
+	}
+
+	return diff, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// voteIds lists the IDs of votes in order
+func voteIds(votes []*PhotoVote) []string {
+	ids := make([]string, 0, len(votes))
+	for _, vote := range votes {
+		ids = append(ids, vote.VoteId)
+	}
+	return ids
+}
+
+func TestGetVotesByConsensusRuleFiltersStoredRule(t *testing.T) {
+	e := newTestEnv(t)
+	ratio := e.startVote(newTestDevice(t, 0), "ratio")
+	minValid := e.startVoteWithOptions(newTestDevice(t, 1), `{"minValidVotes": 1}`, "min-valid")
+	if ratio.ConsensusRule != ConsensusRuleRatio || minValid.ConsensusRule != ConsensusRuleRatioMinValid {
+		t.Fatalf("stored rules %s and %s", ratio.ConsensusRule, minValid.ConsensusRule)
+	}
+
+	// A vote stored before the rule was recorded is matched by the rule its settings imply
+	legacy := e.startVoteWithOptions(newTestDevice(t, 2), `{"minValidVotes": 1}`, "legacy")
+	legacy.ConsensusRule = ""
+	e.putState("PhotoVote", []string{legacy.VoteId}, legacy)
+
+	votes, err := e.dr.GetVotesByConsensusRule(e.admin(), string(ConsensusRuleRatio))
+	requireNoError(t, err)
+	if ids := voteIds(votes); !slices.Equal(ids, []string{ratio.VoteId}) {
+		t.Fatalf("RATIO votes %v", ids)
+	}
+
+	votes, err = e.dr.GetVotesByConsensusRule(e.admin(), string(ConsensusRuleRatioMinValid))
+	requireNoError(t, err)
+	ids := voteIds(votes)
+	slices.Sort(ids)
+	expected := []string{minValid.VoteId, legacy.VoteId}
+	slices.Sort(expected)
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("RATIO_MIN_VALID votes %v, expected %v", ids, expected)
+	}
+
+	_, err = e.dr.GetVotesByConsensusRule(e.admin(), "UNANIMOUS")
+	requireError(t, err)
+	_, err = e.dr.GetVotesByConsensusRule(e.admin(), "")
+	requireError(t, err)
+}
+
+// stuckVoteIds lists the IDs of the votes GetStuckVotes reports
+func (e *testEnv) stuckVoteIds() []string {
+	e.t.Helper()
+	votes, err := e.dr.GetStuckVotes(e.admin())
+	requireNoError(e.t, err)
+	return voteIds(votes)
+}
+
+func TestStuckVotesDiscountBlockedDeviceIdentity(t *testing.T) {
+	for _, blocked := range []bool{true, false} {
+		e := newTestEnv(t)
+		device := newTestDevice(t, 0)
+		chain, anchor := device.certificateChain(t, "device-0")
+		anchors, err := json.Marshal([]string{anchor})
+		requireNoError(t, err)
+		blockedJSON, err := json.Marshal(blocked)
+		requireNoError(t, err)
+		e.setConfig(`{"trustAnchors": ` + string(anchors) + `, "blockDeviceSelfVote": ` + string(blockedJSON) + `}`)
+
+		// The device's own enrolment identity is one of the two voters quorum needs
+		deviceVoterID, err := certificateClientID(chain)
+		requireNoError(t, err)
+		options, err := json.Marshal(VoteOptions{EligibleVoters: []string{deviceVoterID, "voter-1"}, QuorumFraction: 1})
+		requireNoError(t, err)
+		vote, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.photo("chained")}, chain, string(options))
+		requireNoError(t, err)
+
+		stuck := slices.Contains(e.stuckVoteIds(), vote.VoteId)
+		if stuck != blocked {
+			t.Fatalf("blockDeviceSelfVote %v: vote stuck %v", blocked, stuck)
+		}
+	}
+}
+
+func TestStuckVotesCountOnlyCommittersOnceRevealsOpen(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"eligibleVoters": ["voter-1", "voter-2"], "quorumFraction": 1, "commitReveal": true, "revealDelaySeconds": 60}`, "hidden")
+	requireNoError(t, e.dr.CommitVote(e.ctx("voter-1", "Org1MSP"), vote.VoteId, ballotCommitment("voter-1", true, testNonce("nonce"))))
+
+	if slices.Contains(e.stuckVoteIds(), vote.VoteId) {
+		t.Fatal("vote is stuck while commits are still open")
+	}
+
+	// voter-2 can no longer commit, so only voter-1's reveal remains of the two ballots quorum needs
+	e.advance(time.Minute)
+	if !slices.Contains(e.stuckVoteIds(), vote.VoteId) {
+		t.Fatal("vote is not stuck after the commit phase closed with one committer")
+	}
+}
+
+func TestGetVotesByDateRangeFiltersCreationTime(t *testing.T) {
+	e := newTestEnv(t)
+	early := e.startVote(newTestDevice(t, 0), "early")
+	e.advance(time.Hour)
+	inside := e.startVote(newTestDevice(t, 1), "inside")
+	e.advance(time.Hour)
+	late := e.startVote(newTestDevice(t, 2), "late")
+
+	votes, err := e.dr.GetVotesByDateRange(e.admin(), "2025-01-01T00:30:00Z", "2025-01-01T01:30:00Z")
+	requireNoError(t, err)
+	if ids := voteIds(votes); !slices.Equal(ids, []string{inside.VoteId}) {
+		t.Fatalf("votes in range %v, expected only %s", ids, inside.VoteId)
+	}
+
+	// Bounds are inclusive and fractional seconds round inwards
+	votes, err = e.dr.GetVotesByDateRange(e.admin(), "2025-01-01T00:00:00Z", "2025-01-01T02:00:00.5Z")
+	requireNoError(t, err)
+	if len(votes) != 3 {
+		t.Fatalf("inclusive range returned %v, expected %s, %s and %s", voteIds(votes), early.VoteId, inside.VoteId, late.VoteId)
+	}
+	votes, err = e.dr.GetVotesByDateRange(e.admin(), "2025-01-01T00:00:00.5Z", "2025-01-01T01:59:59Z")
+	requireNoError(t, err)
+	if ids := voteIds(votes); !slices.Equal(ids, []string{inside.VoteId}) {
+		t.Fatalf("rounded range returned %v", ids)
+	}
+
+	_, err = e.dr.GetVotesByDateRange(e.admin(), "2025-01-02T00:00:00Z", "2025-01-01T00:00:00Z")
+	requireError(t, err)
+	_, err = e.dr.GetVotesByDateRange(e.admin(), "yesterday", "2025-01-01T00:00:00Z")
+	requireError(t, err)
+}
+
+func TestGetPendingVotesForVoterListsUntouchedEligibleVotes(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	voted := e.startVote(newTestDevice(t, 0), "voted")
+	untouched := e.startVote(newTestDevice(t, 1), "untouched")
+	e.startVoteWithOptions(newTestDevice(t, 2), `{"eligibleVoters": ["voter-2", "voter-3", "voter-4"]}`, "ineligible")
+	e.cast(voted.VoteId, "voter-1", true)
+
+	votes, err := e.dr.GetPendingVotesForVoter(e.ctx("voter-1", "Org1MSP"))
+	requireNoError(t, err)
+	if ids := voteIds(votes); !slices.Equal(ids, []string{untouched.VoteId}) {
+		t.Fatalf("worklist %v, expected only %s", ids, untouched.VoteId)
+	}
+
+	votes, err = e.dr.GetPendingVotesForVoter(e.ctx("voter-2", "Org1MSP"))
+	requireNoError(t, err)
+	if len(votes) != 3 {
+		t.Fatalf("voter-2 worklist %v, expected all three votes", voteIds(votes))
+	}
+}
+
+func TestGetDeviceKeyStatusCountsCountsEveryStatus(t *testing.T) {
+	e := newTestEnv(t)
+	for n := 0; n < 5; n++ {
+		e.startVote(newTestDevice(t, n), fmt.Sprintf("device-%d", n))
+	}
+	e.verifyDevice(newTestDevice(t, 1).hash)
+	e.verifyDevice(newTestDevice(t, 2).hash)
+	e.setDeviceStatus(newTestDevice(t, 3).hash, DeviceStatusRevoked)
+
+	counts, err := e.dr.GetDeviceKeyStatusCounts(e.admin())
+	requireNoError(t, err)
+	expected := map[string]int{"UNVERIFIED": 2, "VERIFIED": 2, "REVOKED": 1, "ROTATED": 0}
+	if !maps.Equal(counts, expected) {
+		t.Fatalf("status counts %v, expected %v", counts, expected)
+	}
+}
+
+func TestGetVotesByIDsKeepsRequestOrder(t *testing.T) {
+	e := newTestEnv(t)
+	first := e.startVote(newTestDevice(t, 0), "first")
+	second := e.startVote(newTestDevice(t, 1), "second")
+
+	results, err := e.dr.GetVotesByIDs(e.admin(), []string{second.VoteId, "vote-missing", first.VoteId})
+	requireNoError(t, err)
+	if len(results) != 3 {
+		t.Fatalf("%d results", len(results))
+	}
+	if results[0].Vote == nil || results[0].Vote.VoteId != second.VoteId || results[0].Error != "" {
+		t.Fatalf("result 0 %+v", results[0])
+	}
+	if results[1].VoteId != "vote-missing" || results[1].Vote != nil || results[1].Error == "" {
+		t.Fatalf("result 1 %+v", results[1])
+	}
+	if results[2].Vote == nil || results[2].Vote.VoteId != first.VoteId {
+		t.Fatalf("result 2 %+v", results[2])
+	}
+}
+
+func TestGetVoteVotersPagesThroughVoters(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 10, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "many-voters")
+	voters := make([]string, 0, 7)
+	for i := 1; i <= 7; i++ {
+		voters = append(voters, fmt.Sprintf("voter-%d", i))
+		e.cast(vote.VoteId, voters[i-1], true)
+	}
+
+	collected := make([]string, 0, len(voters))
+	for offset := 0; offset < len(voters); offset += 3 {
+		page, err := e.dr.GetVoteVoters(e.admin(), vote.VoteId, 3, offset)
+		requireNoError(t, err)
+		if page.Total != len(voters) || page.Offset != offset || len(page.Voters) > 3 {
+			t.Fatalf("page at offset %d: %+v", offset, page)
+		}
+		collected = append(collected, page.Voters...)
+	}
+	if !slices.Equal(collected, voters) {
+		t.Fatalf("paged voters %v, expected %v", collected, voters)
+	}
+
+	page, err := e.dr.GetVoteVoters(e.admin(), vote.VoteId, 3, len(voters))
+	requireNoError(t, err)
+	if len(page.Voters) != 0 {
+		t.Fatalf("page past the end %v", page.Voters)
+	}
+	_, err = e.dr.GetVoteVoters(e.admin(), vote.VoteId, 0, 0)
+	requireError(t, err)
+	_, err = e.dr.GetVoteVoters(e.admin(), vote.VoteId, 3, -1)
+	requireError(t, err)
+}
+
+func TestGetNextVoteToReviewSkipsReviewedVotes(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 10, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	votes := make([]*PhotoVote, 0, 3)
+	for i, name := range []string{"oldest", "middle", "newest"} {
+		votes = append(votes, e.startVote(newTestDevice(t, i), name))
+		e.advance(time.Minute)
+	}
+	next := func(voter string) *ReviewAssignment {
+		assignment, err := e.dr.GetNextVoteToReview(e.ctx(voter, "Org1MSP"))
+		requireNoError(t, err)
+		return assignment
+	}
+
+	if assignment := next("voter-1"); !assignment.HasWork || assignment.Vote.VoteId != votes[0].VoteId {
+		t.Fatalf("first assignment %+v, expected the oldest vote", assignment)
+	}
+	e.cast(votes[0].VoteId, "voter-1", true)
+	if assignment := next("voter-1"); !assignment.HasWork || assignment.Vote.VoteId != votes[1].VoteId {
+		t.Fatalf("assignment after reviewing the oldest vote %+v, expected the middle vote", assignment)
+	}
+	if assignment := next("voter-2"); assignment.Vote.VoteId != votes[0].VoteId {
+		t.Fatalf("another voter was assigned %s, expected the oldest vote", assignment.Vote.VoteId)
+	}
+
+	e.cast(votes[1].VoteId, "voter-1", true)
+	e.cast(votes[2].VoteId, "voter-1", false)
+	if assignment := next("voter-1"); assignment.HasWork || assignment.Vote != nil {
+		t.Fatalf("assignment after reviewing every vote %+v, expected no work", assignment)
+	}
+}
+
+func TestVoteStatusIndexMovesOnTransition(t *testing.T) {
+	e := newTestEnv(t)
+	vote := e.startVote(newTestDevice(t, 0), "indexed")
+	if e.getState("VoteByStatus", string(VoteStatusPending), vote.VoteId) == nil {
+		t.Fatal("pending vote missing from the status index")
+	}
+
+	e.cast(vote.VoteId, "voter-1", true)
+	if e.getState("VoteByStatus", string(VoteStatusPending), vote.VoteId) != nil {
+		t.Fatal("approved vote left in the PENDING index")
+	}
+	if e.getState("VoteByStatus", string(VoteStatusApproved), vote.VoteId) == nil {
+		t.Fatal("approved vote missing from the APPROVED index")
+	}
+
+	approved, err := getVotesByStatus(e.admin(), VoteStatusApproved)
+	requireNoError(t, err)
+	pending, err := getVotesByStatus(e.admin(), VoteStatusPending)
+	requireNoError(t, err)
+	if !slices.Equal(voteIds(approved), []string{vote.VoteId}) || len(pending) != 0 {
+		t.Fatalf("indexed votes: approved %v, pending %v", voteIds(approved), voteIds(pending))
+	}
+}
+
+func TestCanVoteScenarios(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVoteWithOptions(newTestDevice(t, 0), `{"eligibleVoters": ["voter-1", "voter-2"]}`, "eligibility")
+	canVote := func(voter string) *VoteEligibility {
+		eligibility, err := e.dr.CanVote(e.ctx(voter, "Org1MSP"), vote.VoteId)
+		requireNoError(t, err)
+		return eligibility
+	}
+
+	if got := canVote("voter-1"); !got.Eligible || got.AlreadyVoted || got.Reason != "" {
+		t.Fatalf("eligible voter: %+v", got)
+	}
+	if got := canVote("outsider"); got.Eligible || got.AlreadyVoted || !strings.Contains(got.Reason, "not eligible") {
+		t.Fatalf("voter outside the eligibility list: %+v", got)
+	}
+	e.cast(vote.VoteId, "voter-1", true)
+	if got := canVote("voter-1"); got.Eligible || !got.AlreadyVoted || !strings.Contains(got.Reason, "already cast") {
+		t.Fatalf("voter who already voted: %+v", got)
+	}
+	e.cast(vote.VoteId, "voter-2", true)
+	if got := canVote("voter-2"); got.Eligible || !got.AlreadyVoted || !strings.Contains(got.Reason, "has ended") {
+		t.Fatalf("voter on a closed vote: %+v", got)
+	}
+}
+
+func TestGetContractMetricsMatchesSeededState(t *testing.T) {
+	e := newTestEnv(t)
+	verified := newTestDevice(t, 0)
+	approved := e.startVote(verified, "metrics-1", "metrics-2")
+	e.cast(approved.VoteId, "voter-1", true)
+	e.startVote(newTestDevice(t, 1), "metrics-3")
+	requireNoError(t, e.dr.StoreHelperData(e.ctx("uploader", "Org1MSP"), "helper", verified.hash, verified.sign("helper"), "metrics", 0))
+
+	metrics, err := e.dr.GetContractMetrics(e.admin())
+	requireNoError(t, err)
+	expected := &ContractMetrics{
+		TotalVotes:            2,
+		VoteStatusCounts:      map[string]int{"PENDING": 1, "READY": 0, "APPROVED": 1, "REJECTED": 0, "FLAGGED": 0},
+		TotalPhotos:           3,
+		TotalDeviceKeys:       2,
+		DeviceKeyStatusCounts: map[string]int{"UNVERIFIED": 1, "VERIFIED": 1, "REVOKED": 0, "ROTATED": 0},
+		TotalHelperData:       1,
+	}
+	if metrics.TotalVotes != expected.TotalVotes || metrics.TotalPhotos != expected.TotalPhotos || metrics.TotalDeviceKeys != expected.TotalDeviceKeys || metrics.TotalHelperData != expected.TotalHelperData ||
+		!maps.Equal(metrics.VoteStatusCounts, expected.VoteStatusCounts) || !maps.Equal(metrics.DeviceKeyStatusCounts, expected.DeviceKeyStatusCounts) {
+		t.Fatalf("metrics %+v, expected %+v", metrics, expected)
+	}
+}
+
+func TestGetVoteDiffComparesHistoricalVersions(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "diffed")
+	startTx := fmt.Sprintf("tx-%d", e.txs)
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", true)
+	finalTx := fmt.Sprintf("tx-%d", e.txs)
+
+	diff, err := e.dr.GetVoteDiff(e.admin(), vote.VoteId, startTx, finalTx)
+	requireNoError(t, err)
+	changes := make(map[string]VoteFieldChange)
+	for _, change := range diff.Changes {
+		changes[change.Field] = change
+	}
+	if changes["status"].Before != `"PENDING"` || changes["status"].After != `"APPROVED"` {
+		t.Fatalf("status change %+v", changes["status"])
+	}
+	if changes["voteCount"].Before != "0" || changes["voteCount"].After != "2" {
+		t.Fatalf("vote count change %+v", changes["voteCount"])
+	}
+	if _, changed := changes["devicePublicKey"]; changed {
+		t.Fatal("unchanged device key reported as a change")
+	}
+	if changes["finalizedTxId"].Before != "" || changes["finalizedTxId"].After != `"`+finalTx+`"` {
+		t.Fatalf("finalizing transaction change %+v", changes["finalizedTxId"])
+	}
+
+	_, err = e.dr.GetVoteDiff(e.admin(), vote.VoteId, startTx, "tx-unknown")
+	requireError(t, err)
+}
+
+func TestGetMyPendingReviewCount(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	open := e.startVote(newTestDevice(t, 0), "review-open")
+	reviewed := e.startVote(newTestDevice(t, 1), "review-reviewed")
+	e.startVoteWithOptions(newTestDevice(t, 2), `{"eligibleVoters": ["voter-2", "voter-3"]}`, "review-restricted")
+	finished := e.startVote(newTestDevice(t, 3), "review-finished")
+	e.cast(reviewed.VoteId, "voter-1", true)
+	e.cast(finished.VoteId, "voter-2", true)
+	e.cast(finished.VoteId, "voter-3", true)
+	count := func(voter string) int {
+		n, err := e.dr.GetMyPendingReviewCount(e.ctx(voter, "Org1MSP"))
+		requireNoError(t, err)
+		return n
+	}
+
+	// voter-1 has only the open vote left: they reviewed one, are not eligible for one and one is finished
+	if got := count("voter-1"); got != 1 {
+		t.Fatalf("voter-1 has %d reviews outstanding, expected 1", got)
+	}
+	if got := count("voter-2"); got != 3 {
+		t.Fatalf("voter-2 has %d reviews outstanding, expected 3", got)
+	}
+	e.cast(open.VoteId, "voter-1", true)
+	if got := count("voter-1"); got != 0 {
+		t.Fatalf("voter-1 has %d reviews outstanding after reviewing the last one", got)
+	}
+}
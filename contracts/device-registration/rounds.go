@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RoundResult is the tally of a voting round that ended without a decision
+type RoundResult struct {
+	Round        int      `json:"round"`
+	VoteCount    int      `json:"voteCount"`
+	ValidVotes   int      `json:"validVotes"`
+	InvalidVotes int      `json:"invalidVotes"`
+	Voters       []string `json:"voters"`
+	Reason       string   `json:"reason"`  // Why the round was inconclusive
+	EndedAt      string   `json:"endedAt"` // RFC3339 timestamp of the transaction that opened the next round
+}
+
+// StartNextRound closes an inconclusive round, one that met quorum without a decision, and opens a
+// new one with an empty tally; earlier rounds are kept in Rounds and only a decided round settles
+// the vote (admin only, refused while voting is paused)
+func (dr *DeviceRegistration) StartNextRound(ctx contractapi.TransactionContextInterface, voteId string) (*PhotoVote, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = requireVotingOpen(config)
+	if err != nil {
+		return nil, err
+	}
+
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+	if vote.Status != VoteStatusPending {
+		return nil, fmt.Errorf("voting for this photo set has ended")
+	}
+
+	thresholds, err := effectiveThresholds(ctx, vote)
+	if err != nil {
+		return nil, err
+	}
+	outcome := evaluateVote(vote, thresholds)
+	if !outcome.QuorumMet {
+		return nil, fmt.Errorf("round %d of vote %s is still open: %s", len(vote.Rounds)+1, voteId, outcome.Reason)
+	}
+	if outcome.Status != VoteStatusPending || outcome.GraceOpen {
+		return nil, fmt.Errorf("round %d of vote %s is decisive and must be finalized", len(vote.Rounds)+1, voteId)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vote.Rounds = append(vote.Rounds, RoundResult{
+		Round:        len(vote.Rounds) + 1,
+		VoteCount:    vote.VoteCount,
+		ValidVotes:   vote.ValidVotes,
+		InvalidVotes: vote.InvalidVotes,
+		Voters:       vote.Voters,
+		Reason:       outcome.Reason,
+		EndedAt:      txTime.Format(time.RFC3339),
+	})
+	vote.VoteCount = 0
+	vote.ValidVotes = 0
+	vote.InvalidVotes = 0
+	vote.Voters = make([]string, 0)
+
+	// A commit-reveal round starts a fresh commit phase of the original length
+	if vote.CommitReveal {
+		createdAt, err := time.Parse(time.RFC3339, vote.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("vote %s has invalid creation date: %v", voteId, err)
+		}
+		revealOpensAt, err := time.Parse(time.RFC3339, vote.RevealOpensAt)
+		if err != nil {
+			return nil, fmt.Errorf("vote %s has invalid reveal time: %v", voteId, err)
+		}
+		vote.Commitments = nil
+		vote.RevealOpensAt = txTime.Add(revealOpensAt.Sub(createdAt)).Format(time.RFC3339)
+	}
+
+	err = appendTimelineEntry(ctx, vote, "NEXT_ROUND", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putVote(ctx, vote, vote.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	return vote, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVoteProgressesAcrossTwoRounds(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "contentious")
+
+	e.cast(vote.VoteId, "voter-1", true)
+	_, err := e.dr.StartNextRound(e.admin(), vote.VoteId)
+	requireError(t, err)
+	e.cast(vote.VoteId, "voter-2", false)
+	if got := e.vote(vote.VoteId).Status; got != VoteStatusPending {
+		t.Fatalf("status after a tied round %s", got)
+	}
+
+	_, err = e.dr.StartNextRound(e.ctx("voter-1", "Org2MSP"), vote.VoteId)
+	requireError(t, err)
+	next, err := e.dr.StartNextRound(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+	if len(next.Rounds) != 1 || next.VoteCount != 0 || len(next.Voters) != 0 {
+		t.Fatalf("vote after the first round %+v", next)
+	}
+	round := next.Rounds[0]
+	if round.Round != 1 || round.ValidVotes != 1 || round.InvalidVotes != 1 || !slices.Equal(round.Voters, []string{"voter-1", "voter-2"}) {
+		t.Fatalf("first round result %+v", round)
+	}
+
+	// Voters of the first round may vote again in the second
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", true)
+	finished := e.vote(vote.VoteId)
+	if finished.Status != VoteStatusApproved || len(finished.Rounds) != 1 || finished.ValidVotes != 2 {
+		t.Fatalf("vote after the second round %+v", finished)
+	}
+	_, err = e.dr.StartNextRound(e.admin(), vote.VoteId)
+	requireError(t, err)
+}
+
+func TestStartNextRoundRefusedWhilePaused(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 2, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "paused-round")
+	e.cast(vote.VoteId, "voter-1", true)
+	e.cast(vote.VoteId, "voter-2", false)
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), true))
+	_, err := e.dr.StartNextRound(e.admin(), vote.VoteId)
+	if err == nil || !strings.Contains(err.Error(), "voting paused") {
+		t.Fatalf("StartNextRound while paused: %v", err)
+	}
+
+	if got := e.vote(vote.VoteId); len(got.Rounds) != 0 || got.VoteCount != 2 {
+		t.Fatalf("refused round changed the vote: %+v", got)
+	}
+
+	requireNoError(t, e.dr.SetVotingPaused(e.admin(), false))
+	_, err = e.dr.StartNextRound(e.admin(), vote.VoteId)
+	requireNoError(t, err)
+}
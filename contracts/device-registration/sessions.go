@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EnrollmentSession is a one-time challenge that binds the photo signatures of a single vote
+type EnrollmentSession struct {
+	Challenge string `json:"challenge"`                             // Hex string each photo of the vote must carry and sign
+	CreatedBy string `json:"createdBy"`                             // Identity that opened the session
+	CreatedAt string `json:"createdAt"`                             // RFC3339 timestamp of the opening transaction
+	UsedBy    string `json:"usedBy,omitempty" metadata:",optional"` // Vote that consumed the challenge, empty while unused
+}
+
+// CreateEnrollmentSession stores a fresh one-time challenge for the photos of one vote. The challenge is
+// derived from the transaction ID rather than randomness so that every endorsing peer computes the same value.
+func (dr *DeviceRegistration) CreateEnrollmentSession(ctx contractapi.TransactionContextInterface) (*EnrollmentSession, error) {
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client identity: %v", err)
+	}
+
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256([]byte("enrollment-session:" + ctx.GetStub().GetTxID()))
+	session := &EnrollmentSession{
+		Challenge: hex.EncodeToString(challenge[:]),
+		CreatedBy: clientID,
+		CreatedAt: txTime.Format(time.RFC3339),
+	}
+
+	return session, putEnrollmentSession(ctx, session)
+}
+
+// putEnrollmentSession stores an enrollment session under its challenge
+func putEnrollmentSession(ctx contractapi.TransactionContextInterface, session *EnrollmentSession) error {
+	sessionKey, err := ctx.GetStub().CreateCompositeKey("EnrollmentSession", []string{session.Challenge})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key for enrollment session: %v", err)
+	}
+
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal enrollment session: %v", err)
+	}
+
+	return ctx.GetStub().PutState(sessionKey, sessionJSON)
+}
+
+// checkEnrollmentSession resolves the session a vote is bound to and requires every photo to carry its
+// challenge; it returns nil when the vote is not bound to a session and the config does not demand one
+func checkEnrollmentSession(ctx contractapi.TransactionContextInterface, photos []IPFSPhoto, challenge string, config *ContractConfig) (*EnrollmentSession, error) {
+	if challenge == "" {
+		if config.RequireEnrollmentSession {
+			return nil, fmt.Errorf("votes must be bound to an enrollment session challenge")
+		}
+		for _, photo := range photos {
+			if photo.SessionChallenge != "" {
+				return nil, fmt.Errorf("photo with hash %s is bound to an enrollment session, supply its challenge", photo.IPFSHash)
+			}
+		}
+		return nil, nil
+	}
+
+	sessionKey, err := ctx.GetStub().CreateCompositeKey("EnrollmentSession", []string{challenge})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key for enrollment session: %v", err)
+	}
+	sessionJSON, err := ctx.GetStub().GetState(sessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment session: %v", err)
+	}
+	if sessionJSON == nil {
+		return nil, fmt.Errorf("unknown enrollment session challenge %s", challenge)
+	}
+
+	var session EnrollmentSession
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal enrollment session: %v", err)
+	}
+	if session.UsedBy != "" {
+		return nil, fmt.Errorf("enrollment session challenge %s was already used by %s", challenge, session.UsedBy)
+	}
+
+	// The challenge is part of the signed payload, so a matching photo also proves it was signed for this session
+	for _, photo := range photos {
+		if photo.SessionChallenge != challenge {
+			return nil, fmt.Errorf("photo with hash %s was not signed for enrollment session %s", photo.IPFSHash, challenge)
+		}
+	}
+
+	return &session, nil
+}
+
+// consumeEnrollmentSession marks a session's challenge as used by a vote
+func consumeEnrollmentSession(ctx contractapi.TransactionContextInterface, session *EnrollmentSession, voteId string) error {
+	session.UsedBy = voteId
+	return putEnrollmentSession(ctx, session)
+}
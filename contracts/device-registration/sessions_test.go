@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnrollmentSessionChallenges(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"requireEnrollmentSession": true}`)
+	start := func(n int, name string, challenge string) error {
+		device := newTestDevice(t, n)
+		_, err := e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.sessionPhoto(name, challenge)}, device.publicKey, `{"sessionChallenge": "`+challenge+`"}`)
+		return err
+	}
+
+	_, err := e.dr.StartPhotoVote(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{newTestDevice(t, 0).photo("unbound")}, newTestDevice(t, 0).publicKey)
+	requireError(t, err)
+
+	challenge := e.newSession()
+	requireNoError(t, start(0, "session-valid", challenge))
+
+	err = start(1, "session-reused", challenge)
+	if err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("StartPhotoVote with a used challenge: %v", err)
+	}
+	err = start(2, "session-unknown", "unknown-challenge")
+	if err == nil || !strings.Contains(err.Error(), "unknown enrollment session challenge") {
+		t.Fatalf("StartPhotoVote with an unknown challenge: %v", err)
+	}
+
+	// A photo signed for one session cannot be replayed into another
+	other := e.newSession()
+	device := newTestDevice(t, 3)
+	_, err = e.dr.StartPhotoVoteWithOptions(e.ctx("uploader", "Org1MSP"), []IPFSPhoto{device.sessionPhoto("session-replayed", challenge)}, device.publicKey, `{"sessionChallenge": "`+other+`"}`)
+	requireError(t, err)
+}
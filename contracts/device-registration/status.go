@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// VoteStatus is the lifecycle state of a photo vote
+type VoteStatus string
+
+// Vote statuses
+const (
+	VoteStatusPending  VoteStatus = "PENDING"  // Open for ballots
+	VoteStatusReady    VoteStatus = "READY"    // Decided but waiting for FinalizeVote
+	VoteStatusApproved VoteStatus = "APPROVED" // Finalized in favour of the device
+	VoteStatusRejected VoteStatus = "REJECTED" // Finalized against the device
+	VoteStatusFlagged  VoteStatus = "FLAGGED"  // Finalization refused because the photos were tampered with or flagged
+)
+
+// DeviceStatus is the verification state of a device key
+type DeviceStatus string
+
+// Device key statuses
+const (
+	DeviceStatusUnverified DeviceStatus = "UNVERIFIED" // Registered through a vote that has not approved it
+	DeviceStatusVerified   DeviceStatus = "VERIFIED"   // Approved by a vote or verified by an admin
+	DeviceStatusRevoked    DeviceStatus = "REVOKED"    // No longer trusted
+	DeviceStatusRotated    DeviceStatus = "ROTATED"    // Replaced by a newer key through RotateDeviceKey
+)
+
+// ConsensusRule names the approval rule a vote was opened under
+type ConsensusRule string
+
+// Consensus rules
+const (
+	ConsensusRuleRatio         ConsensusRule = "RATIO"           // Approved once the valid share exceeds the approval ratio
+	ConsensusRuleRatioMinValid ConsensusRule = "RATIO_MIN_VALID" // Approved once the ratio is exceeded and the vote's minimum valid votes are cast
+)
+
+// validateConsensusRule rejects a rule that is not one of the consensus rules
+func validateConsensusRule(rule ConsensusRule) error {
+	switch rule {
+	case ConsensusRuleRatio, ConsensusRuleRatioMinValid:
+		return nil
+	default:
+		return fmt.Errorf("unknown consensus rule %q", rule)
+	}
+}
+
+// validateVoteStatus rejects a status that is not one of the vote statuses
+func validateVoteStatus(status VoteStatus) error {
+	switch status {
+	case VoteStatusPending, VoteStatusReady, VoteStatusApproved, VoteStatusRejected, VoteStatusFlagged:
+		return nil
+	default:
+		return fmt.Errorf("unknown vote status %q", status)
+	}
+}
+
+// validateDeviceStatus rejects a status that is not one of the device key statuses
+func validateDeviceStatus(status DeviceStatus) error {
+	switch status {
+	case DeviceStatusUnverified, DeviceStatusVerified, DeviceStatusRevoked, DeviceStatusRotated:
+		return nil
+	default:
+		return fmt.Errorf("unknown device key status %q", status)
+	}
+}
+
+// UnmarshalJSON decodes a device key, rejecting an unknown status
+func (d *DeviceKey) UnmarshalJSON(data []byte) error {
+	type plainDeviceKey DeviceKey
+	var decoded plainDeviceKey
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if err := validateDeviceStatus(decoded.Status); err != nil {
+		return fmt.Errorf("device key %s: %v", decoded.PublicKeyHash, err)
+	}
+	*d = DeviceKey(decoded)
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// strictUnmarshal decodes JSON into v, rejecting unknown fields, keys that only match a field
+// case-insensitively and trailing data
+func strictUnmarshal(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+
+	return checkFieldNames(data, reflect.TypeOf(v), "")
+}
+
+// checkFieldNames walks a JSON value alongside its Go type and rejects object keys that are not
+// exactly a field's JSON name
+func checkFieldNames(data []byte, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(data, &object); err != nil || object == nil {
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = field.Type
+		}
+
+		// Keys are visited in sorted order so every peer reports the same field
+		for _, key := range slices.Sorted(maps.Keys(object)) {
+			fieldType, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("unknown field %q at $%s", key, path)
+			}
+			if err := checkFieldNames(object[key], fieldType, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(data, &elements); err != nil {
+			return nil
+		}
+		for i, element := range elements {
+			if err := checkFieldNames(element, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil
+		}
+		for _, key := range slices.Sorted(maps.Keys(entries)) {
+			if err := checkFieldNames(entries[key], t.Elem(), path+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkStrictPhotosArg re-decodes the raw photo set argument strictly when strict JSON input is configured;
+// the typed argument has already been decoded leniently by the contract API
+func checkStrictPhotosArg(ctx contractapi.TransactionContextInterface, config *ContractConfig) error {
+	if !config.StrictJSONInput {
+		return nil
+	}
+
+	args := ctx.GetStub().GetArgs()
+	if len(args) < 2 {
+		return nil
+	}
+
+	var photos []IPFSPhoto
+	if err := strictUnmarshal(args[1], &photos); err != nil {
+		return fmt.Errorf("invalid photo set: %v", err)
+	}
+
+	return nil
+}
+
+// checkStrictVoteRequestsArg re-decodes each raw request of a StartPhotoVotes batch strictly when strict
+// JSON input is configured, returning the decoding error of each request by index
+func checkStrictVoteRequestsArg(ctx contractapi.TransactionContextInterface, config *ContractConfig) (map[int]error, error) {
+	failures := make(map[int]error)
+	if !config.StrictJSONInput {
+		return failures, nil
+	}
+
+	args := ctx.GetStub().GetArgs()
+	if len(args) < 2 {
+		return failures, nil
+	}
+
+	var requests []json.RawMessage
+	if err := json.Unmarshal(args[1], &requests); err != nil {
+		return nil, fmt.Errorf("invalid vote requests: %v", err)
+	}
+	for i, raw := range requests {
+		var request VoteRequest
+		if err := strictUnmarshal(raw, &request); err != nil {
+			failures[i] = fmt.Errorf("invalid vote request: %v", err)
+		}
+	}
+
+	return failures, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxTimelineEntries bounds the timeline kept on a vote; older entries are dropped first
+const maxTimelineEntries = 50
+
+// TimelineEntry records one step in a vote's progression; while the vote is open a cast only shows how
+// many ballots it counted, and its choice and the running tally are revealed once the vote has ended
+type TimelineEntry struct {
+	Timestamp    string     `json:"timestamp"`                                 // RFC3339 timestamp of the transaction
+	Action       string     `json:"action"`                                    // "CAST" or "NEXT_ROUND"; an ended vote reports casts as "CAST_VALID" or "CAST_INVALID"
+	Ballots      int        `json:"ballots"`                                   // Ballots counted by the action, more than one with delegations
+	Round        int        `json:"round"`                                     // Voting round the action applied to, starting at 1
+	VoteCount    int        `json:"voteCount"`                                 // Ballots counted in the round after the action
+	ValidVotes   int        `json:"validVotes,omitempty" metadata:",optional"` // Valid ballots in the round after the action, revealed once the vote has ended
+	InvalidVotes int        `json:"invalidVotes,omitempty" metadata:",optional"`
+	Status       VoteStatus `json:"status"`
+}
+
+// appendTimelineEntry adds an entry with the vote's current ballot count, dropping the oldest beyond the cap
+func appendTimelineEntry(ctx contractapi.TransactionContextInterface, vote *PhotoVote, action string, ballots int) error {
+	txTime, err := getTxTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	vote.Timeline = append(vote.Timeline, TimelineEntry{
+		Timestamp: txTime.Format(time.RFC3339),
+		Action:    action,
+		Ballots:   ballots,
+		Round:     len(vote.Rounds) + 1,
+		VoteCount: vote.VoteCount,
+		Status:    vote.Status,
+	})
+	if overflow := len(vote.Timeline) - maxTimelineEntries; overflow > 0 {
+		vote.Timeline = append([]TimelineEntry(nil), vote.Timeline[overflow:]...)
+	}
+
+	return nil
+}
+
+// revealTimeline fills in the choice and running tally of each cast of an ended vote from its voter
+// ballots; a round's voters are kept in cast order, so a cast covers the voters just below its count
+func revealTimeline(ctx contractapi.TransactionContextInterface, vote *PhotoVote, timeline []TimelineEntry) error {
+	participants, err := getVoterBallots(ctx, vote.VoteId)
+	if err != nil {
+		return err
+	}
+	choices := make(map[int]map[string]string)
+	for _, participant := range participants {
+		if choices[participant.Round] == nil {
+			choices[participant.Round] = make(map[string]string)
+		}
+		choices[participant.Round][participant.VoterID] = participant.Choice
+	}
+
+	for i, entry := range timeline {
+		if entry.Action != "CAST" || entry.Round < 1 {
+			continue
+		}
+		voters := vote.Voters
+		if entry.Round <= len(vote.Rounds) {
+			voters = vote.Rounds[entry.Round-1].Voters
+		}
+		if entry.Ballots < 1 || entry.VoteCount > len(voters) || entry.Ballots > entry.VoteCount {
+			return fmt.Errorf("timeline entry %d of vote %s does not match its voters", i, vote.VoteId)
+		}
+
+		for _, voter := range voters[:entry.VoteCount] {
+			if choices[entry.Round][voter] == "VALID" {
+				timeline[i].ValidVotes++
+			}
+		}
+		timeline[i].InvalidVotes = entry.VoteCount - timeline[i].ValidVotes
+		if choice := choices[entry.Round][voters[entry.VoteCount-1]]; choice != "" {
+			timeline[i].Action = "CAST_" + choice
+		}
+	}
+
+	return nil
+}
+
+// GetVoteTimeline returns the recorded progression of a vote, oldest first
+func (dr *DeviceRegistration) GetVoteTimeline(ctx contractapi.TransactionContextInterface, voteId string) ([]TimelineEntry, error) {
+	vote, err := getVote(ctx, voteId)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := make([]TimelineEntry, 0, len(vote.Timeline))
+	timeline = append(timeline, vote.Timeline...)
+	if ballotsHidden(vote) {
+		return timeline, nil
+	}
+
+	err = revealTimeline(ctx, vote, timeline)
+	if err != nil {
+		return nil, err
+	}
+	return timeline, nil
+}
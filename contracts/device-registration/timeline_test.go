@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// timeline reads a vote's timeline, failing the test on error
+func (e *testEnv) timeline(voteId string) []TimelineEntry {
+	e.t.Helper()
+	timeline, err := e.dr.GetVoteTimeline(e.ctx("reader", "Org1MSP"), voteId)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return timeline
+}
+
+func TestTimelineHidesChoicesUntilVoteEnds(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 3, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "timeline")
+
+	e.cast(vote.VoteId, "voter-1", false)
+	e.cast(vote.VoteId, "voter-2", true)
+	for i, entry := range e.timeline(vote.VoteId) {
+		if entry.Action != "CAST" || entry.ValidVotes != 0 || entry.InvalidVotes != 0 {
+			t.Fatalf("pending timeline entry %d reveals its ballot: %+v", i, entry)
+		}
+		if entry.VoteCount != i+1 {
+			t.Fatalf("pending timeline entry %d has vote count %d", i, entry.VoteCount)
+		}
+	}
+
+	e.cast(vote.VoteId, "voter-3", true)
+	want := []struct {
+		action         string
+		valid, invalid int
+	}{
+		{"CAST_INVALID", 0, 1},
+		{"CAST_VALID", 1, 1},
+		{"CAST_VALID", 2, 1},
+	}
+	timeline := e.timeline(vote.VoteId)
+	if len(timeline) != len(want) {
+		t.Fatalf("timeline has %d entries, want %d", len(timeline), len(want))
+	}
+	for i, entry := range timeline {
+		if entry.Action != want[i].action || entry.ValidVotes != want[i].valid || entry.InvalidVotes != want[i].invalid {
+			t.Fatalf("ended timeline entry %d = %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestTimelineKeepsMostRecentEntries(t *testing.T) {
+	e := newTestEnv(t)
+	e.setConfig(`{"thresholds": {"minVoters": 100, "approvalRatio": 0.5, "tieBreak": "PENDING"}}`)
+	vote := e.startVote(newTestDevice(t, 0), "timeline-cap")
+
+	casts := maxTimelineEntries + 5
+	for i := 1; i <= casts; i++ {
+		e.cast(vote.VoteId, fmt.Sprintf("voter-%d", i), true)
+	}
+
+	timeline := e.timeline(vote.VoteId)
+	if len(timeline) != maxTimelineEntries {
+		t.Fatalf("timeline has %d entries, want the cap of %d", len(timeline), maxTimelineEntries)
+	}
+	if first := timeline[0].VoteCount; first != casts-maxTimelineEntries+1 {
+		t.Fatalf("oldest kept entry has vote count %d, want %d", first, casts-maxTimelineEntries+1)
+	}
+	if last := timeline[len(timeline)-1].VoteCount; last != casts {
+		t.Fatalf("newest entry has vote count %d, want %d", last, casts)
+	}
+}